@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+	"github.com/philogag/peer-banner/internal/output"
+	"github.com/philogag/peer-banner/internal/units"
+)
+
+// runBan administers the ban state by hand. Changes are applied directly
+// when the daemon is stopped, and queued for its next cycle while it runs.
+// It returns the process exit code.
+func runBan(path string, args []string) int {
+	if len(args) == 0 {
+		banUsage(os.Stderr)
+		return 2
+	}
+
+	switch args[0] {
+	case "add":
+		return runBanAdd(path, args[1:])
+	case "remove":
+		return runBanRemove(path, args[1:])
+	case "list":
+		return runBanList(path, args[1:])
+	case "show":
+		return runBanShow(path, args[1:])
+	case "prune":
+		return runBanPrune(path, args[1:])
+	case "-h", "-help", "--help", "help":
+		banUsage(os.Stdout)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "ban: unknown command %q\n", args[0])
+	banUsage(os.Stderr)
+	return 2
+}
+
+// banUsage lists the ban subcommands
+func banUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [flags] ban <command> [arguments]\n\n", os.Args[0])
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  add <ip|cidr>     Ban an IP or range (-duration, -reason)")
+	fmt.Fprintln(w, "  remove <ip|cidr>  Lift a ban and forget its offence history (-reason)")
+	fmt.Fprintln(w, "  list              List bans (-rule, -permanent, -expiring-before, -all, -json)")
+	fmt.Fprintln(w, "  show <ip>         Show an IP's ban entry, evidence and covering range bans")
+	fmt.Fprintln(w, "  prune             Remove entries of bans that have expired (-expired-for)")
+	fmt.Fprintln(w, "\nRun a command with -h for its flags.")
+}
+
+// newCommandFlags creates the flag set of a subcommand such as "ban add"
+func newCommandFlags(command, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] %s %s\n\n", os.Args[0], command, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseInterspersed parses flags that may follow positional arguments, as
+// in "ban add 1.2.3.4 --duration 7d", and returns the positional ones
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// currentUser names the administrator for the audit log
+func currentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "unknown"
+}
+
+func runBanAdd(path string, args []string) int {
+	fs := newCommandFlags("ban add", "<ip|cidr> [-duration DURATION] [-reason TEXT]")
+	duration := fs.String("duration", "", "Ban duration such as 24h or 7d; empty or permanent for a permanent ban")
+	reason := fs.String("reason", "", "Why the IP is banned")
+	by := fs.String("by", currentUser(), "Who is banning, for the audit log")
+	targets, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(targets) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	return applyBanOp(path, ban.Op{
+		Op:       ban.OpAdd,
+		Target:   targets[0],
+		Duration: *duration,
+		Reason:   *reason,
+		By:       *by,
+	})
+}
+
+func runBanRemove(path string, args []string) int {
+	fs := newCommandFlags("ban remove", "<ip|cidr> [-reason TEXT]")
+	reason := fs.String("reason", "", "Why the ban is lifted")
+	by := fs.String("by", currentUser(), "Who is lifting the ban, for the audit log")
+	targets, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(targets) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	return applyBanOp(path, ban.Op{
+		Op:     ban.OpRemove,
+		Target: targets[0],
+		Reason: *reason,
+		By:     *by,
+	})
+}
+
+func runBanPrune(path string, args []string) int {
+	fs := newCommandFlags("ban prune", "[-expired-for DURATION]")
+	expiredFor := fs.String("expired-for", "0", "Only entries whose ban expired at least this long ago, such as 30d")
+	by := fs.String("by", currentUser(), "Who is pruning, for the audit log")
+	if rest, err := parseInterspersed(fs, args); err != nil || len(rest) > 0 {
+		if err == nil {
+			fs.Usage()
+		}
+		return 2
+	}
+	age, err := units.ParseDuration(*expiredFor)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ban prune: -expired-for: %v\n", err)
+		return 2
+	}
+
+	return applyBanOp(path, ban.Op{
+		Op:     ban.OpPrune,
+		Before: time.Now().Add(-age),
+		By:     *by,
+	})
+}
+
+// applyBanOp applies a change to the ban state and saves it, or queues it
+// when the daemon holds the state file
+func applyBanOp(path string, op ban.Op) int {
+	if err := op.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "ban %s: %v\n", op.Op, err)
+		return 2
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	stateFile := cfg.App.GetStateFile()
+
+	banManager, err := ban.NewManager(stateFile, &cfg.Ban)
+	if ban.IsLocked(err) {
+		if op.Op == ban.OpRemove {
+			warnIfNoEntry(stateFile, &cfg.Ban, op.Target)
+		}
+		if err := ban.Enqueue(stateFile, op); err != nil {
+			fmt.Fprintf(os.Stderr, "ban %s: %v\n", op.Op, err)
+			return 1
+		}
+		fmt.Printf("The daemon is running: queued %s, it is applied at the start of the next detection cycle\n", describeOp(&op))
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open ban state: %v\n", err)
+		return 1
+	}
+	defer banManager.Close()
+
+	// Changes queued before the daemon stopped come first
+	if applied, err := banManager.ApplyQueued(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to apply queued ban changes: %v\n", err)
+		return 1
+	} else if applied > 0 {
+		fmt.Printf("Applied %d queued changes\n", applied)
+	}
+
+	desc, err := banManager.Apply(op)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ban %s: %v\n", op.Op, err)
+		if op.Op == ban.OpRemove {
+			printCoveringRanges(os.Stderr, banManager, op.Target)
+		}
+		return 1
+	}
+	if err := banManager.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save ban state: %v\n", err)
+		return 1
+	}
+	fmt.Println(strings.ToUpper(desc[:1]) + desc[1:])
+	if op.Op == ban.OpRemove {
+		printCoveringRanges(os.Stdout, banManager, op.Target)
+	}
+	return 0
+}
+
+// describeOp summarizes a queued op
+func describeOp(op *ban.Op) string {
+	switch op.Op {
+	case ban.OpAdd:
+		length := "permanently"
+		if op.Duration != "" && op.Duration != "0" && op.Duration != "permanent" {
+			length = "for " + op.Duration
+		}
+		return fmt.Sprintf("ban of %s %s", op.Target, length)
+	case ban.OpRemove:
+		return "removal of " + op.Target
+	case ban.OpPrune:
+		return "prune of entries expired before " + op.Before.Local().Format("2006-01-02 15:04:05")
+	}
+	return op.Op
+}
+
+// warnIfNoEntry warns when a removal the daemon will apply targets an IP
+// with no saved entry
+func warnIfNoEntry(stateFile string, cfg *config.BanConfig, target string) {
+	banManager, err := ban.OpenReadOnly(stateFile, cfg)
+	if err != nil {
+		return
+	}
+	defer banManager.Close()
+	if _, ok := banManager.GetBan(target); !ok {
+		fmt.Fprintf(os.Stderr, "Warning: %s has no saved ban entry\n", target)
+		printCoveringRanges(os.Stderr, banManager, target)
+	}
+}
+
+// printCoveringRanges mentions the active range bans that still cover an IP
+func printCoveringRanges(w io.Writer, banManager *ban.Manager, ip string) {
+	for _, r := range banManager.RangesContaining(ip) {
+		if !r.IsExpired() {
+			fmt.Fprintf(w, "Note: %s is still covered by the range ban %s\n", ip, r.IP)
+		}
+	}
+}
+
+// openBanState opens the ban state read-only for the listing commands
+func openBanState(path string) (*ban.Manager, string, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid configuration: %w", err)
+	}
+	stateFile := cfg.App.GetStateFile()
+	banManager, err := ban.OpenReadOnly(stateFile, &cfg.Ban)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load ban state: %w", err)
+	}
+	return banManager, stateFile, nil
+}
+
+func runBanList(path string, args []string) int {
+	fs := newCommandFlags("ban list", "[-rule NAME] [-permanent] [-expiring-before TIME] [-all] [-json]")
+	rule := fs.String("rule", "", "Only bans by this rule (manual for bans added by hand)")
+	permanent := fs.Bool("permanent", false, "Only permanent bans")
+	expiringBefore := fs.String("expiring-before", "", "Only temporary bans ending before this time: a date, an RFC 3339 time or a duration from now such as 7d")
+	all := fs.Bool("all", false, "Include expired entries kept as offence history")
+	asJSON := fs.Bool("json", false, "Print entries as JSON lines")
+	if rest, err := parseInterspersed(fs, args); err != nil || len(rest) > 0 {
+		if err == nil {
+			fs.Usage()
+		}
+		return 2
+	}
+	now := time.Now()
+	before, err := parseTime(*expiringBefore, now, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ban list: -expiring-before: %v\n", err)
+		return 2
+	}
+
+	banManager, stateFile, err := openBanState(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ban list: %v\n", err)
+		return 1
+	}
+	defer banManager.Close()
+
+	var bans []*models.BannedIP
+	for _, b := range banManager.GetAllBans() {
+		switch {
+		case !*all && b.IsExpired():
+		case *rule != "" && b.RuleName != *rule:
+		case *permanent && !b.IsPermanentBan():
+		case !before.IsZero() && (b.IsPermanentBan() || b.ExpiresAt.IsZero() || !b.ExpiresAt.Before(before)):
+		default:
+			bans = append(bans, b)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for _, b := range bans {
+			enc.Encode(b)
+		}
+	} else {
+		printBanList(os.Stdout, bans, now)
+	}
+	printQueued(os.Stderr, stateFile)
+	return 0
+}
+
+// printBanList prints ban entries as a table
+func printBanList(w io.Writer, bans []*models.BannedIP, now time.Time) {
+	if len(bans) == 0 {
+		fmt.Fprintln(w, "No matching bans")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tRULE\tOFFENCES\tEXPIRES\tREASON")
+	for _, b := range bans {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", b.IP, orDash(b.RuleName), b.BanCount, describeExpiry(b, now), b.Reason)
+	}
+	tw.Flush()
+}
+
+// describeExpiry says when a ban ends relative to now
+func describeExpiry(b *models.BannedIP, now time.Time) string {
+	switch {
+	case b.IsPermanentBan():
+		return "permanent"
+	case b.ExpiresAt.IsZero():
+		return "never"
+	case b.ExpiresAt.After(now):
+		return "in " + units.FormatDuration(b.ExpiresAt.Sub(now).Round(time.Minute))
+	}
+	return "expired " + units.FormatDuration(now.Sub(b.ExpiresAt).Round(time.Minute)) + " ago"
+}
+
+// printQueued mentions changes the daemon has not applied yet
+func printQueued(w io.Writer, stateFile string) {
+	ops, err := ban.Queued(stateFile)
+	if err != nil || len(ops) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d queued changes are not applied yet:\n", len(ops))
+	for i := range ops {
+		fmt.Fprintf(w, "  %s (by %s)\n", describeOp(&ops[i]), orDash(ops[i].By))
+	}
+}
+
+func runBanShow(path string, args []string) int {
+	fs := newCommandFlags("ban show", "<ip|cidr>")
+	targets, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(targets) != 1 {
+		fs.Usage()
+		return 2
+	}
+	target, err := ban.ParseTarget(targets[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ban show: %v\n", err)
+		return 2
+	}
+
+	banManager, stateFile, err := openBanState(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ban show: %v\n", err)
+		return 1
+	}
+	defer banManager.Close()
+
+	now := time.Now()
+	b, ok := banManager.GetBan(target)
+	if ok {
+		printBanEntry(os.Stdout, b, now)
+	} else {
+		fmt.Printf("%s has no ban entry\n", target)
+	}
+	for _, r := range banManager.RangesContaining(target) {
+		if r.IP != target {
+			fmt.Printf("Covered by range ban %s: %s, rule %s\n", r.IP, describeExpiry(r, now), orDash(r.RuleName))
+		}
+	}
+	printQueued(os.Stderr, stateFile)
+	return 0
+}
+
+// printBanEntry prints every field of a ban entry
+func printBanEntry(w io.Writer, b *models.BannedIP, now time.Time) {
+	fmt.Fprintf(w, "IP:        %s\n", b.IP)
+	fmt.Fprintf(w, "Status:    %s\n", describeBan(b, !b.IsExpired()))
+	fmt.Fprintf(w, "Rule:      %s\n", orDash(b.RuleName))
+	if len(b.MatchedRules) > 1 {
+		fmt.Fprintf(w, "Matched:   %s\n", strings.Join(b.MatchedRules, ", "))
+	}
+	fmt.Fprintf(w, "Reason:    %s\n", orDash(b.Reason))
+	fmt.Fprintf(w, "Offences:  %d\n", b.BanCount)
+	fmt.Fprintf(w, "Banned at: %s\n", b.BannedAt.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "Expires:   %s\n", describeExpiry(b, now))
+	if !b.DecayedAt.IsZero() {
+		fmt.Fprintf(w, "Decayed:   %s\n", b.DecayedAt.Local().Format(time.RFC3339))
+	}
+	if b.RuleName != ban.ManualRule {
+		fmt.Fprintln(w, "Evidence:")
+		fmt.Fprint(w, output.FormatEvidence(b.Evidence, "  "))
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/api"
+	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/blocklist"
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/detector"
+	"github.com/philogag/peer-banner/internal/models"
+	"github.com/philogag/peer-banner/internal/output"
+	"github.com/philogag/peer-banner/internal/peerid"
+	"github.com/philogag/peer-banner/internal/units"
+)
+
+// explainFixture is a peer and torrent to explain without a server, in the
+// same JSON form the qBittorrent API returns (progress is 0-1)
+type explainFixture struct {
+	Peer    models.Peer    `json:"peer"`
+	Torrent models.Torrent `json:"torrent"`
+}
+
+// runExplain shows how every rule evaluates a peer, either one connected
+// to a server or one described by a fixture file. Nothing is banned or
+// saved. It returns the process exit code.
+func runExplain(path string, args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	server := fs.String("server", "", "Server whose rules to use (optional with a single server)")
+	ip := fs.String("ip", "", "Explain this IP on every torrent it is connected to")
+	fixture := fs.String("fixture", "", "Explain a peer and torrent read from a JSON file instead")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] explain [-server NAME] (-ip IP | -fixture FILE)\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (*ip == "") == (*fixture == "") {
+		fmt.Fprintln(os.Stderr, "explain: exactly one of -ip or -fixture is required")
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	serverCfg, err := explainServer(cfg, *server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "explain: %v\n", err)
+		return 2
+	}
+
+	// The ban state is only read, so this works while the daemon runs
+	banManager, err := ban.OpenReadOnly(cfg.App.GetStateFile(), &cfg.Ban)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to load ban state: %v\n", err)
+	}
+
+	client := api.NewClient(serverCfg)
+	d, err := detector.NewDetector(client, cfg, banManager)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid rule configuration: %v\n", err)
+		return 1
+	}
+
+	// Blocklists as last fetched; explain doesn't download them
+	if len(cfg.Blocklists) > 0 {
+		lists, err := blocklist.NewSet(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid blocklist configuration: %v\n", err)
+			return 1
+		}
+		lists.LoadCached()
+		if banManager != nil {
+			lists.SetPardons(banManager.PardonedNetworks())
+		}
+		d.UseBlocklists(lists)
+	}
+
+	var explanations []*detector.Explanation
+	if *fixture != "" {
+		f, err := readFixture(*fixture)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "explain: %v\n", err)
+			return 1
+		}
+		explanations = append(explanations, d.ExplainPeer(&f.Peer, &f.Torrent, time.Now()))
+	} else {
+		if err := client.Login(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to login to %s: %v\n", serverCfg.Name, err)
+			return 1
+		}
+		explanations, err = d.Explain(*ip)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "explain: %v\n", err)
+			return 1
+		}
+		if len(explanations) == 0 {
+			fmt.Printf("%s is not a peer of any torrent on %s\n", *ip, serverCfg.Name)
+			return 0
+		}
+	}
+
+	for i, e := range explanations {
+		if i > 0 {
+			fmt.Println()
+		}
+		printExplanation(os.Stdout, e)
+	}
+	return 0
+}
+
+// explainServer picks the server named on the command line, or the only
+// configured server when none is named
+func explainServer(cfg *config.Config, name string) (*config.ServerConfig, error) {
+	if name == "" {
+		if len(cfg.Servers) != 1 {
+			return nil, fmt.Errorf("%d servers are configured, choose one with -server", len(cfg.Servers))
+		}
+		return &cfg.Servers[0], nil
+	}
+	for i := range cfg.Servers {
+		if cfg.Servers[i].Name == name {
+			return &cfg.Servers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown server %q", name)
+}
+
+// readFixture reads a peer and torrent from a JSON file
+func readFixture(path string) (*explainFixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture: %w", err)
+	}
+	var f explainFixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse fixture %s: %w", path, err)
+	}
+	if f.Peer.IP == "" {
+		return nil, fmt.Errorf("fixture %s: peer.ip is required", path)
+	}
+	return &f, nil
+}
+
+// printExplanation writes a human readable trace of an explanation
+func printExplanation(w io.Writer, e *detector.Explanation) {
+	p, t := &e.Peer, &e.Torrent
+	fmt.Fprintf(w, "Peer %s:%d on %q (%s) [server %s]\n", p.IP, p.Port, t.Name, t.Hash, e.Server)
+	fmt.Fprintf(w, "  client %q, flags %q, progress %.2f%%, downloaded %s, uploaded %s, active %s\n",
+		p.Client, p.Flags, p.Progress*100, units.FormatSize(p.Downloaded), units.FormatSize(p.Uploaded),
+		units.FormatDuration(time.Duration(p.ActiveTime)*time.Second))
+	if p.PeerID != "" {
+		fmt.Fprintf(w, "  peer ID %q (%s)\n", p.PeerID, describePeerID(p.PeerID))
+	}
+
+	fmt.Fprintf(w, "Whitelisted: %s\n", yesNo(e.Whitelisted))
+	if e.Pardon != nil {
+		fmt.Fprintf(w, "Pardoned: %s\n", describePardon(e.Pardon))
+	}
+	if e.Blocklist != "" {
+		fmt.Fprintf(w, "Blocklisted: by %s\n", e.Blocklist)
+	}
+	fmt.Fprintf(w, "Existing ban: %s\n", describeBan(e.Ban, e.Banned))
+	if e.Ban != nil {
+		fmt.Fprint(w, output.FormatEvidence(e.Ban.Evidence, "  "))
+	}
+
+	fmt.Fprintf(w, "Rules (resolution: %s):\n", e.Resolution)
+	for _, rt := range e.Rules {
+		status := "not matched"
+		if rt.Verdict.Matched {
+			status = "matched"
+		}
+		if rt.Verdict.Score > 0 || rt.Rule.Type == config.RuleTypeScoring {
+			status += fmt.Sprintf(", score %g/%g", rt.Verdict.Score, rt.Rule.Threshold)
+		}
+		if rt.Skipped != "" {
+			status = "skipped: " + rt.Skipped + "; would be " + status
+		}
+		fmt.Fprintf(w, "  %s (priority %d) [%s]\n", rt.Rule.Name, rt.Rule.Priority, status)
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, ft := range rt.Filters {
+			result := "fail"
+			if ft.Passed {
+				result = "pass"
+			}
+			fmt.Fprintf(tw, "    %s\tobserved %s\tthreshold %s\t%s\n", ft.Filter, ft.Observed, ft.Threshold, result)
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintf(w, "Decision: %s\n", describeDecision(e))
+}
+
+// describeBan summarizes an existing ban record
+func describeBan(b *models.BannedIP, active bool) string {
+	if b == nil {
+		return "none"
+	}
+	state := fmt.Sprintf("rule %s, %d offences", b.RuleName, b.BanCount)
+	switch {
+	case active && b.IsPermanentBan():
+		return "permanent (" + state + ")"
+	case active:
+		return fmt.Sprintf("active until %s (%s)", b.ExpiresAt.Format(time.RFC3339), state)
+	}
+	return fmt.Sprintf("expired at %s (%s)", b.ExpiresAt.Format(time.RFC3339), state)
+}
+
+// describeDecision states what Detect would do with the peer
+func describeDecision(e *detector.Explanation) string {
+	verdict := "no rule matched"
+	if e.Decision != nil {
+		verdict = describeBanDecision(e)
+	}
+	switch {
+	case e.Whitelisted:
+		return "not banned, the IP is whitelisted (otherwise: " + verdict + ")"
+	case e.Pardon != nil:
+		return "not banned, the IP is pardoned (otherwise: " + verdict + ")"
+	case e.Banned:
+		return "not banned again, the IP is already banned (otherwise: " + verdict + ")"
+	case e.Blocklist != "":
+		return "not banned, the IP is blocked by blocklist " + e.Blocklist + " (otherwise: " + verdict + ")"
+	case e.Decision == nil:
+		return "not banned, " + verdict
+	case e.Shadowed != "":
+		return "not banned, " + e.Shadowed + " (otherwise: " + verdict + ")"
+	}
+	return verdict
+}
+
+// describeBanDecision describes the ban the deciding rule would give
+func describeBanDecision(e *detector.Explanation) string {
+	rule := e.Decision.Rule
+	duration, permanent := rule.GetPenalty().For(e.Count)
+	length := "permanent"
+	if !permanent {
+		length = units.FormatDuration(duration)
+	}
+	var others []string
+	for _, rt := range e.Rules {
+		if rt.Skipped == "" && rt.Verdict.Matched && rt.Rule != rule {
+			others = append(others, rt.Rule.Name)
+		}
+	}
+	decision := fmt.Sprintf("ban by %s, offence #%d, %s", rule.Name, e.Count, length)
+	if len(others) > 0 {
+		decision += " (also matched: " + strings.Join(others, ", ") + ")"
+	}
+	return decision
+}
+
+// describePardon summarizes a pardon
+func describePardon(p *ban.Pardon) string {
+	s := fmt.Sprintf("%s until %s", p.Target, p.ExpiresAt.Local().Format("2006-01-02 15:04:05"))
+	if p.Note != "" {
+		s += " (" + p.Note + ")"
+	}
+	return s
+}
+
+// describePeerID formats the client decoded from a peer ID
+func describePeerID(id string) string {
+	if info, ok := peerid.Decode(id); ok {
+		return info.String()
+	}
+	return "not decodable"
+}
+
+// yesNo formats a boolean for display
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/audit"
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/units"
+)
+
+// runHistory prints the events in the audit log that match the given
+// filters. It returns the process exit code.
+func runHistory(path string, args []string) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	ip := fs.String("ip", "", "Only events for this IP or CIDR range")
+	rule := fs.String("rule", "", "Only events for this rule")
+	types := fs.String("type", "", "Only these event types, comma separated ("+strings.Join(audit.EventTypes, ", ")+")")
+	since := fs.String("since", "", "Only events at or after this time: a date, an RFC 3339 time or a duration ago such as 30d")
+	until := fs.String("until", "", "Only events at or before this time, in the same forms as -since")
+	asJSON := fs.Bool("json", false, "Print events as JSON lines")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] history [-ip IP|CIDR] [-rule NAME] [-type TYPES] [-since TIME] [-until TIME] [-json]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	filter, err := historyFilter(*ip, *rule, *types, *since, *until, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "history: %v\n", err)
+		return 2
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	events, err := audit.Query(cfg.Ban.Audit.GetFile(cfg.App.GetStateFile()), filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "history: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for i := range events {
+			enc.Encode(&events[i])
+		}
+		return 0
+	}
+	printHistory(os.Stdout, events)
+	return 0
+}
+
+// historyFilter builds an audit filter from the command line flags
+func historyFilter(ip, rule, types, since, until string, now time.Time) (*audit.Filter, error) {
+	f := &audit.Filter{Rule: rule}
+
+	if ip != "" {
+		network, err := parseNetwork(ip)
+		if err != nil {
+			return nil, fmt.Errorf("-ip: %w", err)
+		}
+		f.Network = network
+	}
+
+	if types != "" {
+		known := make(map[string]bool, len(audit.EventTypes))
+		for _, t := range audit.EventTypes {
+			known[t] = true
+		}
+		f.Types = make(map[string]bool)
+		for _, t := range strings.Split(types, ",") {
+			t = strings.TrimSpace(t)
+			if !known[t] {
+				return nil, fmt.Errorf("-type: unknown event type %q (use %s)", t, strings.Join(audit.EventTypes, ", "))
+			}
+			f.Types[t] = true
+		}
+	}
+
+	var err error
+	if f.Since, err = parseTime(since, now, true); err != nil {
+		return nil, fmt.Errorf("-since: %w", err)
+	}
+	if f.Until, err = parseTime(until, now, true); err != nil {
+		return nil, fmt.Errorf("-until: %w", err)
+	}
+	return f, nil
+}
+
+// parseNetwork parses an IP or CIDR range
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", s)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseTime parses a time as a local date, an RFC 3339 time or a duration
+// before now (ago) or after it. An empty string is the zero time.
+func parseTime(s string, now time.Time, ago bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if d, err := units.ParseDuration(s); err == nil {
+		if ago {
+			return now.Add(-d), nil
+		}
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (use 2006-01-02, an RFC 3339 time or a duration such as 30d)", s)
+}
+
+// printHistory prints events as a table, oldest first
+func printHistory(w io.Writer, events []audit.Event) {
+	if len(events) == 0 {
+		fmt.Fprintln(w, "No matching events")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tIP\tRULE\tDETAILS")
+	for i := range events {
+		e := &events[i]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Local().Format("2006-01-02 15:04:05"), e.Type, e.IP, orDash(e.Rule), describeEvent(e))
+	}
+	tw.Flush()
+}
+
+// describeEvent summarises what an event did
+func describeEvent(e *audit.Event) string {
+	var parts []string
+	switch {
+	case e.Type == audit.EventRemove || e.Type == audit.EventLift:
+		by := e.By
+		if by == "" {
+			by = "unknown"
+		}
+		parts = append(parts, "by "+by)
+	case e.Type == audit.EventForget:
+	case e.Permanent:
+		parts = append(parts, "permanent")
+	case e.ExpiresAt != nil && e.Type == audit.EventExpire:
+		parts = append(parts, "expired "+e.ExpiresAt.Local().Format("2006-01-02 15:04:05"))
+	case e.ExpiresAt != nil:
+		parts = append(parts, "until "+e.ExpiresAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	if e.BanCount > 0 {
+		parts = append(parts, fmt.Sprintf("offence #%d", e.BanCount))
+	}
+	if e.Reason != "" {
+		parts = append(parts, e.Reason)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// orDash returns s, or "-" when it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -153,6 +153,7 @@ func (c *Client) GetTorrentPeers(hash string) ([]models.Peer, error) {
 			DownloadedT int64   `json:"downloadedt"`
 			UploadedT   int64   `json:"uploadedt"`
 			Client      string  `json:"client,omitempty"`
+			PeerID      string  `json:"peer_id_client,omitempty"`
 		} `json:"peers"`
 	}
 
@@ -172,6 +173,7 @@ func (c *Client) GetTorrentPeers(hash string) ([]models.Peer, error) {
 			Flags:      p.Flags,
 			Relevance:  p.Relevance,
 			Client:     p.Client,
+			PeerID:     p.PeerID,
 		})
 	}
 
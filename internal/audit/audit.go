@@ -0,0 +1,262 @@
+// Package audit keeps a history of ban events in an append-only JSON lines
+// file, so that past bans can be looked up after their state entries have
+// expired, decayed or been removed.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventBan      = "ban"      // A new ban, or a repeat offence after the last one expired
+	EventExtend   = "extend"   // An active ban replaced by a new offence
+	EventEscalate = "escalate" // A ban made permanent after max_ban_count offences
+	EventExpire   = "expire"   // A temporary ban ran out
+	EventRemove   = "remove"   // A ban lifted by hand
+	EventLift     = "lift"     // A ban ended early, keeping the offence history
+	EventForget   = "forget"   // An entry dropped after its offences decayed to zero
+)
+
+// EventTypes lists every event type
+var EventTypes = []string{EventBan, EventExtend, EventEscalate, EventExpire, EventRemove, EventLift, EventForget}
+
+// Event is one line of the audit log
+type Event struct {
+	Time      time.Time  `json:"time"`
+	Type      string     `json:"type"`
+	IP        string     `json:"ip"`
+	Rule      string     `json:"rule,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	By        string     `json:"by,omitempty"` // Who lifted a ban by hand
+	BanCount  int        `json:"ban_count,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Nil for permanent bans
+	Permanent bool       `json:"permanent,omitempty"`
+}
+
+// pruneEvery is how often a running log drops events past retention
+const pruneEvery = 24 * time.Hour
+
+// Log appends events to the audit file. Events are buffered by Record and
+// written by Flush, so that they reach the disk together with the ban
+// state they describe.
+type Log struct {
+	path      string
+	retention time.Duration // 0 = keep forever
+	pending   []Event
+	last      time.Time
+	prunedAt  time.Time
+	mu        sync.Mutex
+}
+
+// Open opens the audit log at path, dropping events older than retention
+func Open(path string, retention time.Duration) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	l := &Log{path: path, retention: retention}
+	if err := l.prune(time.Now()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Last returns the time of the newest event written, zero if there is none
+func (l *Log) Last() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last
+}
+
+// Record buffers an event until the next Flush
+func (l *Log) Record(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	l.pending = append(l.pending, e)
+}
+
+// Flush appends the buffered events to the file and syncs it. Once a day
+// it also drops events past retention.
+func (l *Log) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.pending) > 0 {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		for i := range l.pending {
+			if err := enc.Encode(&l.pending[i]); err != nil {
+				return fmt.Errorf("failed to encode audit event: %w", err)
+			}
+		}
+
+		f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		if _, err := f.Write(buf.Bytes()); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to sync audit log: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to close audit log: %w", err)
+		}
+
+		if t := l.pending[len(l.pending)-1].Time; t.After(l.last) {
+			l.last = t
+		}
+		l.pending = nil
+	}
+
+	if now := time.Now(); now.Sub(l.prunedAt) >= pruneEvery {
+		return l.prune(now)
+	}
+	return nil
+}
+
+// prune rewrites the file without the events older than retention, and
+// notes the time of the newest event. A partial last line, left by a crash
+// mid-append, is dropped so the next append starts on a line of its own;
+// other lines that cannot be parsed are kept as they are.
+func (l *Log) prune(now time.Time) error {
+	l.prunedAt = now
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	cutoff := time.Time{}
+	if l.retention > 0 {
+		cutoff = now.Add(-l.retention)
+	}
+	var kept bytes.Buffer
+	changed := false
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		complete := bytes.HasSuffix(line, []byte("\n"))
+		var e Event
+		err := json.Unmarshal(line, &e)
+		switch {
+		case err != nil && !complete:
+			changed = true
+			continue
+		case err == nil:
+			if e.Time.Before(cutoff) {
+				changed = true
+				continue
+			}
+			if e.Time.After(l.last) {
+				l.last = e.Time
+			}
+			if !complete {
+				line = append(line, '\n')
+				changed = true
+			}
+		}
+		kept.Write(line)
+	}
+	if !changed {
+		return nil
+	}
+
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, kept.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to prune audit log: %w", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to prune audit log: %w", err)
+	}
+	return nil
+}
+
+// Filter selects events. Zero fields match everything.
+type Filter struct {
+	Network *net.IPNet // IP or range the event's IP must fall in
+	Rule    string
+	Types   map[string]bool
+	Since   time.Time
+	Until   time.Time
+}
+
+// Match reports whether an event passes the filter
+func (f *Filter) Match(e *Event) bool {
+	if f.Network != nil {
+		ip := net.ParseIP(e.IP)
+		if ip == nil || !f.Network.Contains(ip) {
+			return false
+		}
+	}
+	if f.Rule != "" && e.Rule != f.Rule {
+		return false
+	}
+	if len(f.Types) > 0 && !f.Types[e.Type] {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Query reads the events in the audit file at path that pass the filter,
+// oldest first. A missing file has no events.
+func Query(path string, f *Filter) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var events []Event
+	r := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		raw, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(raw)) > 0 {
+			var e Event
+			if jerr := json.Unmarshal(raw, &e); jerr != nil {
+				if err == io.EOF {
+					return events, nil // Partial last line of an interrupted append
+				}
+				return nil, fmt.Errorf("%s: line %d: %w", path, line, jerr)
+			}
+			if f.Match(&e) {
+				events = append(events, e)
+			}
+		}
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package ban
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/config"
+)
+
+// ManualRule is the rule name recorded for bans added by hand
+const ManualRule = "manual"
+
+// Administrative operations
+const (
+	OpAdd    = "add"
+	OpRemove = "remove"
+	OpPrune  = "prune"
+)
+
+// Op is a change to the ban state requested by an administrator. When the
+// daemon holds the state file, ops are queued in <state file>.queue and
+// the daemon applies them at the start of its next cycle.
+type Op struct {
+	Op       string    `json:"op"`
+	Target   string    `json:"target,omitempty"`   // add, remove: IP or CIDR range
+	Duration string    `json:"duration,omitempty"` // add: same grammar as ban_duration, empty = permanent
+	Reason   string    `json:"reason,omitempty"`
+	By       string    `json:"by,omitempty"`
+	Before   time.Time `json:"before,omitempty"` // prune: only entries that expired before this
+	Time     time.Time `json:"time"`             // When the op was requested
+}
+
+// ParseTarget normalizes an IP or CIDR range to the key its ban entry is
+// stored under. A range covering a single address is stored as the address.
+func ParseTarget(s string) (string, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String(), nil
+	}
+	ip, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid IP address or CIDR range %q", s)
+	}
+	if !ip.Equal(network.IP) {
+		return "", fmt.Errorf("%s has host bits set, did you mean %s?", s, network)
+	}
+	if ones, bits := network.Mask.Size(); ones == bits {
+		return network.IP.String(), nil
+	}
+	return network.String(), nil
+}
+
+// Validate checks an op before it is applied or queued
+func (o *Op) Validate() error {
+	switch o.Op {
+	case OpAdd:
+		if _, err := config.ParseBanDuration(o.Duration); err != nil {
+			return fmt.Errorf("duration: %w", err)
+		}
+		fallthrough
+	case OpRemove:
+		key, err := ParseTarget(o.Target)
+		if err != nil {
+			return err
+		}
+		o.Target = key
+	case OpPrune:
+	default:
+		return fmt.Errorf("unknown operation %q", o.Op)
+	}
+	return nil
+}
+
+// Apply performs an op and describes what it did. The caller saves.
+func (m *Manager) Apply(o Op) (string, error) {
+	if err := o.Validate(); err != nil {
+		return "", err
+	}
+
+	switch o.Op {
+	case OpAdd:
+		duration, _ := config.ParseBanDuration(o.Duration)
+		reason := o.Reason
+		if reason == "" {
+			reason = "Manual ban"
+		}
+		ban, applied := m.AddBan(Offence{
+			IP:           o.Target,
+			Reason:       reason,
+			RuleName:     ManualRule,
+			MatchedRules: []string{ManualRule},
+			Penalty:      Penalty{Duration: duration},
+			By:           o.By,
+		})
+		// An active ban that is already as harsh is kept as it is
+		switch {
+		case !applied && ban.IsPermanent:
+			return fmt.Sprintf("%s stays banned permanently (rule %s)", o.Target, ban.RuleName), nil
+		case !applied:
+			return fmt.Sprintf("%s stays banned until %s (rule %s)", o.Target, ban.ExpiresAt.Format(time.RFC3339), ban.RuleName), nil
+		case ban.IsPermanent:
+			return fmt.Sprintf("banned %s permanently", o.Target), nil
+		}
+		return fmt.Sprintf("banned %s for %s", o.Target, o.Duration), nil
+
+	case OpRemove:
+		if !m.RemoveBan(o.Target, o.By, o.Reason) {
+			return "", fmt.Errorf("%s has no ban entry", o.Target)
+		}
+		return fmt.Sprintf("removed %s", o.Target), nil
+
+	case OpPrune:
+		n := m.Prune(o.Before, o.By)
+		return fmt.Sprintf("pruned %d expired entries", n), nil
+	}
+	return "", nil
+}
+
+// Prune removes the entries of bans that expired before the given time,
+// forgetting those IPs' offence history. Active and permanent bans are
+// kept. It returns the number of entries removed.
+func (m *Manager) Prune(before time.Time, by string) int {
+	var ips []string
+	m.mu.RLock()
+	for ip, ban := range m.state.Bans {
+		if ban.IsExpired() && ban.ExpiresAt.Before(before) {
+			ips = append(ips, ip)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, ip := range ips {
+		m.RemoveBan(ip, by, "pruned expired entry")
+	}
+	return len(ips)
+}
+
+// queuePath returns the file ops are queued in while the daemon runs
+func queuePath(stateFile string) string {
+	return stateFile + ".queue"
+}
+
+// Enqueue appends an op to the queue of a state file held by a running
+// daemon
+func Enqueue(stateFile string, o Op) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if o.Time.IsZero() {
+		o.Time = time.Now()
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		return fmt.Errorf("failed to encode op: %w", err)
+	}
+
+	f, err := os.OpenFile(queuePath(stateFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open ban queue: %w", err)
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock ban queue: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write ban queue: %w", err)
+	}
+	return f.Sync()
+}
+
+// Queued returns the ops waiting in a state file's queue
+func Queued(stateFile string) ([]Op, error) {
+	data, err := os.ReadFile(queuePath(stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read ban queue: %w", err)
+	}
+	return parseQueue(data)
+}
+
+// parseQueue decodes queued ops, skipping lines that cannot be parsed
+func parseQueue(data []byte) ([]Op, error) {
+	var ops []Op
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, 1<<20)
+	for line := 1; s.Scan(); line++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		var o Op
+		if err := json.Unmarshal(s.Bytes(), &o); err != nil {
+			log.Printf("Warning: ban queue line %d: %v, skipping", line, err)
+			continue
+		}
+		ops = append(ops, o)
+	}
+	return ops, s.Err()
+}
+
+// ApplyQueued applies the ops queued by administrators and saves the
+// state. The queue stays locked until the changes are saved, and is only
+// emptied once they are, so no op is lost. When the save fails, the ops
+// stay queued but are remembered as applied, so the next call saves them
+// without applying them twice. It returns the number of ops applied.
+func (m *Manager) ApplyQueued() (int, error) {
+	if m.lock == nil {
+		return 0, nil
+	}
+
+	f, err := os.OpenFile(queuePath(m.stateFile), os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open ban queue: %w", err)
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return 0, fmt.Errorf("failed to lock ban queue: %w", err)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read ban queue: %w", err)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if int64(len(data)) < m.queueApplied {
+		m.queueApplied = 0 // Not the queue we applied from
+	}
+	ops, err := parseQueue(data[m.queueApplied:])
+	if err != nil {
+		return 0, fmt.Errorf("failed to read ban queue: %w", err)
+	}
+
+	applied := 0
+	for _, o := range ops {
+		desc, err := m.Apply(o)
+		if err != nil {
+			log.Printf("Queued %s by %s failed: %v", o.Op, orUnknown(o.By), err)
+			continue
+		}
+		log.Printf("Queued %s by %s: %s", o.Op, orUnknown(o.By), desc)
+		applied++
+	}
+	m.queueApplied = int64(len(data))
+
+	if err := m.Save(); err != nil {
+		return applied, err
+	}
+	if err := f.Truncate(0); err != nil {
+		return applied, fmt.Errorf("failed to empty ban queue: %w", err)
+	}
+	m.queueApplied = 0
+	return applied, nil
+}
+
+// orUnknown returns s, or "unknown" when it is empty
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// IsLocked reports whether an error from NewManager means another
+// instance holds the state file
+func IsLocked(err error) bool {
+	return errors.Is(err, errLocked)
+}
@@ -0,0 +1,138 @@
+package ban
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingStore fails every Flush while fail is set
+type failingStore struct {
+	Store
+	fail bool
+}
+
+func (s *failingStore) Flush() error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	return s.Store.Flush()
+}
+
+func newTestManager(t *testing.T) (*Manager, string) {
+	t.Helper()
+	stateFile := filepath.Join(t.TempDir(), "bans.json")
+	m, err := NewManager(stateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m, stateFile
+}
+
+func TestApplyQueuedSaveFailure(t *testing.T) {
+	m, stateFile := newTestManager(t)
+	store := &failingStore{Store: m.store, fail: true}
+	m.store = store
+
+	if err := Enqueue(stateFile, Op{Op: OpAdd, Target: "10.0.0.1", By: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ApplyQueued(); err == nil {
+		t.Fatal("ApplyQueued succeeded with a failing store")
+	}
+	if ops, _ := Queued(stateFile); len(ops) != 1 {
+		t.Fatalf("%d ops queued after a failed save, want 1", len(ops))
+	}
+
+	// Queued while the save was failing
+	if err := Enqueue(stateFile, Op{Op: OpAdd, Target: "10.0.0.2", By: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	store.fail = false
+	applied, err := m.ApplyQueued()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 1 {
+		t.Errorf("applied %d ops on retry, want only the new one", applied)
+	}
+	if n := m.OffenceCount("10.0.0.1"); n != 1 {
+		t.Errorf("10.0.0.1 has %d offences, want 1", n)
+	}
+	if n := m.OffenceCount("10.0.0.2"); n != 1 {
+		t.Errorf("10.0.0.2 has %d offences, want 1", n)
+	}
+	if ops, _ := Queued(stateFile); len(ops) != 0 {
+		t.Errorf("%d ops still queued after a successful save", len(ops))
+	}
+
+	// Both were saved
+	m.Close()
+	reopened, err := NewManager(stateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if !reopened.IsBanned(ip) {
+			t.Errorf("%s is not banned after reopening", ip)
+		}
+	}
+}
+
+func TestApplyQueuedAfterRestart(t *testing.T) {
+	m, stateFile := newTestManager(t)
+	m.store = &failingStore{Store: m.store, fail: true}
+
+	if err := Enqueue(stateFile, Op{Op: OpAdd, Target: "10.0.0.1", Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ApplyQueued(); err == nil {
+		t.Fatal("ApplyQueued succeeded with a failing store")
+	}
+	m.Close()
+
+	// The unsaved op is applied once by the next daemon
+	reopened, err := NewManager(stateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if applied, err := reopened.ApplyQueued(); err != nil || applied != 1 {
+		t.Fatalf("ApplyQueued = %d, %v, want 1", applied, err)
+	}
+	if n := reopened.OffenceCount("10.0.0.1"); n != 1 {
+		t.Errorf("10.0.0.1 has %d offences, want 1", n)
+	}
+	if _, err := os.Stat(queuePath(stateFile)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyAddKeepsHarsherBan(t *testing.T) {
+	m, _ := newTestManager(t)
+	m.AddBan(Offence{IP: "10.0.0.1", RuleName: "auto_rule", Penalty: Penalty{Duration: 7 * 24 * time.Hour}})
+
+	msg, err := m.Apply(Op{Op: OpAdd, Target: "10.0.0.1", Duration: "1h", By: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg, "stays banned until") || !strings.Contains(msg, "auto_rule") {
+		t.Errorf("message %q, want the ban in force", msg)
+	}
+	if b, _ := m.GetBan("10.0.0.1"); b.RuleName != "auto_rule" || b.BanCount != 1 {
+		t.Errorf("a shorter manual ban changed the entry: %+v", b)
+	}
+
+	// A permanent manual ban replaces it
+	if msg, _ = m.Apply(Op{Op: OpAdd, Target: "10.0.0.1", By: "admin"}); msg != "banned 10.0.0.1 permanently" {
+		t.Errorf("message %q", msg)
+	}
+	if b, _ := m.GetBan("10.0.0.1"); b.RuleName != ManualRule || b.BanCount != 2 {
+		t.Errorf("permanent manual ban: %+v", b)
+	}
+}
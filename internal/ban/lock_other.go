@@ -0,0 +1,16 @@
+//go:build !unix
+
+package ban
+
+import "os"
+
+// tryLock is a no-op where advisory file locks are not available; running
+// two instances on the same state file is then not detected
+func tryLock(f *os.File) error {
+	return nil
+}
+
+// lockFile is a no-op where advisory file locks are not available
+func lockFile(f *os.File) error {
+	return nil
+}
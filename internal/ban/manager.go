@@ -1,188 +1,584 @@
 package ban
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/philogag/peer-banner/internal/audit"
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/iptrie"
 	"github.com/philogag/peer-banner/internal/models"
 )
 
-// Manager handles ban state persistence and expiry
+// Manager handles ban state persistence and expiry.
+//
+// Expired bans are kept as offence history so that BanCount survives
+// between bans. With a decay interval configured, each full interval an IP
+// stays clean after its ban expires forgives one offence, and an IP whose
+// count reaches zero is forgotten entirely.
+//
+// A Manager opened with NewManager holds an advisory lock on the state file
+// until Close, so that two instances cannot overwrite each other's bans.
+// The entries live in memory; Save passes only those changed since the
+// previous Save to the configured Store.
+//
+// Every ban, extension, escalation, expiry and removal is also recorded in
+// the audit log, which outlives the state entries.
 type Manager struct {
-	stateFile string
-	state     *models.BanState
-	mu        sync.RWMutex
+	stateFile     string
+	decayInterval time.Duration
+	store         Store
+	audit         *audit.Log // nil for read-only managers
+	sweptAt       time.Time  // Bans expiring after this have no expire event yet
+	lock          *os.File   // nil for read-only managers
+	state         *models.BanState
+	ranges        iptrie.Trie[string] // Keys of the entries keyed by a CIDR range
+	dirty         map[string]bool     // IPs changed or removed since the last Save
+	queueApplied  int64               // Bytes of the queue applied but not yet emptied
+	lifted        map[string]bool     // Bans lifted since the last Expire, which has no expiry to report
+	mu            sync.RWMutex
+
+	pardons        []*Pardon              // Read from the pardons file next to the state file
+	pardonIndex    iptrie.Trie[[]*Pardon] // pardons by network
+	pardonsModTime time.Time
+	pardonsLoaded  bool
 }
 
-// NewManager creates a new ban manager
-func NewManager(stateFile string) (*Manager, error) {
+var (
+	// errLocked is returned when another process holds the state file lock
+	errLocked = errors.New("in use by another instance")
+	// errCorrupt marks a state file that exists but cannot be parsed
+	errCorrupt = errors.New("corrupt ban state")
+)
+
+// NewManager opens the ban state for reading and writing. It fails when
+// another instance is using the same state file, or when the file is
+// corrupt and cannot be restored from a backup.
+func NewManager(stateFile string, cfg *config.BanConfig) (*Manager, error) {
+	m, err := newManager(stateFile, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(stateFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	if err := m.acquireLock(); err != nil {
+		return nil, err
+	}
+
+	if m.store, err = openStore(stateFile, cfg, true); err != nil {
+		m.Close()
+		return nil, err
+	}
+	if err := m.Load(); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	if cfg != nil {
+		retention, err := cfg.Audit.GetRetention()
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("invalid audit retention: %w", err)
+		}
+		if m.audit, err = audit.Open(cfg.Audit.GetFile(stateFile), retention); err != nil {
+			m.Close()
+			return nil, err
+		}
+		// A new log starts now rather than reporting every past expiry
+		if m.sweptAt = m.audit.Last(); m.sweptAt.IsZero() {
+			m.sweptAt = time.Now()
+		}
+	}
+	return m, nil
+}
+
+// OpenReadOnly loads the ban state without taking the lock, for commands
+// that inspect the state while the daemon may be running. Save fails on a
+// read-only manager.
+func OpenReadOnly(stateFile string, cfg *config.BanConfig) (*Manager, error) {
+	m, err := newManager(stateFile, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if m.store, err = openStore(stateFile, cfg, false); err != nil {
+		return nil, err
+	}
+	if err := m.Load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// newManager creates a manager with an empty state
+func newManager(stateFile string, cfg *config.BanConfig) (*Manager, error) {
 	m := &Manager{
 		stateFile: stateFile,
 		state:     models.NewBanState(),
+		dirty:     make(map[string]bool),
 	}
-	if err := m.Load(); err != nil {
-		// Log warning but continue with empty state
-		return m, nil
+	if cfg != nil {
+		decay, err := cfg.GetDecayInterval()
+		if err != nil {
+			return nil, fmt.Errorf("invalid decay interval: %w", err)
+		}
+		m.decayInterval = decay
 	}
 	return m, nil
 }
 
-// Load reads ban state from file
+// acquireLock takes the lock file next to the state file and records this
+// process's PID in it
+func (m *Manager) acquireLock() error {
+	path := m.stateFile + ".lock"
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := tryLock(f); err != nil {
+		f.Close()
+		if errors.Is(err, errLocked) {
+			owner, _ := os.ReadFile(path)
+			return fmt.Errorf("ban state %s is %w (pid %s)", m.stateFile, errLocked, strings.TrimSpace(string(owner)))
+		}
+		return fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	m.lock = f
+	return nil
+}
+
+// Close closes the store and releases the state file lock
+func (m *Manager) Close() error {
+	var err error
+	if m.store != nil {
+		err = m.store.Close()
+	}
+	if m.lock != nil {
+		if lerr := m.lock.Close(); err == nil {
+			err = lerr
+		}
+		m.lock = nil
+	}
+	return err
+}
+
+// Load reads the ban state from the store, replacing the entries in
+// memory. Older formats are upgraded, and rewritten unless the manager is
+// read-only; state from newer versions is refused.
 func (m *Manager) Load() error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	if err := m.store.Load(); err != nil {
+		return err
+	}
 
-	data, err := os.ReadFile(m.stateFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // No file yet, that's fine
+	state := models.NewBanState()
+	var ranges iptrie.Trie[string]
+	err := m.store.Iterate(func(b *models.BannedIP) error {
+		state.Bans[b.IP] = b
+		if network, ok := parseRange(b.IP); ok {
+			ranges.Insert(network, b.IP)
 		}
+		return nil
+	})
+	if err != nil {
 		return fmt.Errorf("failed to read ban state: %w", err)
 	}
 
-	var state models.BanState
-	if err := json.Unmarshal(data, &state); err != nil {
-		return fmt.Errorf("failed to parse ban state: %w", err)
+	m.mu.Lock()
+	// Expired bans are kept: they carry the IP's offence history
+	m.state = state
+	m.ranges = ranges
+	m.dirty = make(map[string]bool)
+	m.mu.Unlock()
+	return m.loadPardons()
+}
+
+// dropRange removes an entry keyed by a CIDR range from the range index
+func (m *Manager) dropRange(key string) {
+	if network, ok := parseRange(key); ok {
+		m.ranges.Delete(network)
 	}
+}
 
-	// Clean up expired bans during load
-	cleaned := 0
-	for ip, ban := range state.Bans {
-		if ban.IsExpired() {
-			delete(state.Bans, ip)
-			cleaned++
+// parseRange returns the network of an entry keyed by a CIDR range, false
+// for a single address
+func parseRange(key string) (netip.Prefix, bool) {
+	if !strings.Contains(key, "/") {
+		return netip.Prefix{}, false
+	}
+	network, err := netip.ParsePrefix(key)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return network, true
+}
+
+// Save passes the entries changed since the last Save to the store and
+// flushes it
+func (m *Manager) Save() error {
+	if m.lock == nil {
+		return fmt.Errorf("ban state %s was opened read-only", m.stateFile)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var upserts []*models.BannedIP
+	var deletes []string
+	for ip := range m.dirty {
+		if ban, ok := m.state.Bans[ip]; ok {
+			upserts = append(upserts, ban)
+		} else {
+			deletes = append(deletes, ip)
 		}
 	}
-	if cleaned > 0 {
-		state.LastUpdated = time.Now()
+	sort.Slice(upserts, func(i, j int) bool { return upserts[i].IP < upserts[j].IP })
+	sort.Strings(deletes)
+
+	if len(upserts) > 0 {
+		if err := m.store.Upsert(upserts); err != nil {
+			return fmt.Errorf("failed to save ban state: %w", err)
+		}
+	}
+	if len(deletes) > 0 {
+		if err := m.store.Delete(deletes); err != nil {
+			return fmt.Errorf("failed to save ban state: %w", err)
+		}
 	}
+	if err := m.store.Flush(); err != nil {
+		return fmt.Errorf("failed to save ban state: %w", err)
+	}
+	m.dirty = make(map[string]bool)
 
-	m.state = &state
+	if m.audit != nil {
+		if err := m.audit.Flush(); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
 	return nil
 }
 
-// Save writes ban state to file
-func (m *Manager) Save() error {
+// record adds an event to the audit log, if there is one
+func (m *Manager) record(typ string, ban *models.BannedIP, now time.Time, by string) {
+	if m.audit == nil {
+		return
+	}
+	e := audit.Event{
+		Time:      now,
+		Type:      typ,
+		IP:        ban.IP,
+		Rule:      ban.RuleName,
+		Reason:    ban.Reason,
+		By:        by,
+		BanCount:  ban.BanCount,
+		Permanent: ban.IsPermanentBan(),
+	}
+	if !e.Permanent && !ban.ExpiresAt.IsZero() {
+		expires := ban.ExpiresAt
+		e.ExpiresAt = &expires
+	}
+	m.audit.Record(e)
+}
+
+// IsBanned checks if an IP is currently banned and not expired, by its
+// own entry or by a range ban covering it
+func (m *Manager) IsBanned(ip string) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	// Ensure directory exists
-	dir := filepath.Dir(m.stateFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create state directory: %w", err)
+	if ban, exists := m.state.Bans[ip]; exists && !ban.IsExpired() {
+		return true
 	}
-
-	data, err := json.MarshalIndent(m.state, "", "  ")
+	if m.ranges.Len() == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
-		return fmt.Errorf("failed to marshal ban state: %w", err)
+		return false
 	}
+	banned := false
+	m.ranges.EachContaining(netip.PrefixFrom(addr, addr.BitLen()), func(_ netip.Prefix, key string) bool {
+		banned = !m.state.Bans[key].IsExpired()
+		return !banned
+	})
+	return banned
+}
 
-	if err := os.WriteFile(m.stateFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write ban state: %w", err)
+// RangesContaining returns copies of the range ban entries, active or
+// expired, that cover an IP
+func (m *Manager) RangesContaining(ip string) []*models.BannedIP {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
 	}
 
-	return nil
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var bans []*models.BannedIP
+	m.ranges.EachContaining(netip.PrefixFrom(addr, addr.BitLen()), func(_ netip.Prefix, key string) bool {
+		b := *m.state.Bans[key]
+		bans = append(bans, &b)
+		return true
+	})
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
 }
 
-// IsBanned checks if an IP is currently banned and not expired
-func (m *Manager) IsBanned(ip string) bool {
+// GetBan returns a copy of the ban entry for an IP
+func (m *Manager) GetBan(ip string) (*models.BannedIP, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	ban, exists := m.state.Bans[ip]
 	if !exists {
-		return false
+		return nil, false
 	}
-	return !ban.IsExpired()
+	b := *ban
+	return &b, true
 }
 
-// GetBan returns the ban entry for an IP
-func (m *Manager) GetBan(ip string) (*models.BannedIP, bool) {
+// Offence describes a rule violation to be recorded as a ban
+type Offence struct {
+	IP           string
+	Reason       string
+	RuleName     string
+	MatchedRules []string // All rules that matched, including RuleName
+	Penalty      Penalty
+	Evidence     *models.Evidence
+	By           string // Who added the ban by hand, empty for rules
+}
+
+// OffenceCount returns how many times an IP has been banned so far
+func (m *Manager) OffenceCount(ip string) int {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	ban, exists := m.state.Bans[ip]
-	return ban, exists
+	if ban, exists := m.state.Bans[ip]; exists {
+		return ban.BanCount
+	}
+	return 0
 }
 
-// AddBan adds or updates a ban for an IP
-func (m *Manager) AddBan(ip, reason, ruleName string, duration time.Duration, maxBanCount int) {
+// AddBan adds or updates a ban for an IP. The penalty decides the
+// duration from the IP's offence count, so repeat offenders can be given
+// progressively longer bans. An active ban is never shortened: a new
+// offence only takes effect if its ban is harsher than the one in force.
+// One that doesn't is ignored altogether, so it neither counts toward
+// BanCount nor replaces the rule and evidence of the ban in force. It
+// returns a copy of the entry afterwards and whether the offence took
+// effect.
+func (m *Manager) AddBan(o Offence) (models.BannedIP, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	now := time.Now()
-	existing, exists := m.state.Bans[ip]
+	ban, exists := m.state.Bans[o.IP]
+	active := exists && !ban.IsExpired()
+
+	count := 1
+	if exists {
+		count = ban.BanCount + 1
+	}
+	penalty := o.Penalty
+	duration, permanent := penalty.For(count)
+	expires := now.Add(duration)
+	if active && (ban.IsPermanent || !permanent && !expires.After(ban.ExpiresAt)) {
+		return *ban, false
+	}
 
 	if !exists {
-		// New ban
-		ban := &models.BannedIP{
-			IP:       ip,
-			Reason:   reason,
-			RuleName: ruleName,
-			BannedAt: now,
-			BanCount: 1,
+		ban = &models.BannedIP{IP: o.IP}
+		m.state.Bans[o.IP] = ban
+		if network, ok := parseRange(o.IP); ok {
+			m.ranges.Insert(network, o.IP)
 		}
+	}
+	if !active {
+		// A new ban starts, even on an entry kept as offence history
+		ban.BannedAt = now
+	}
 
-		// Check if should escalate to permanent
-		if maxBanCount > 0 && 1 >= maxBanCount {
-			ban.IsPermanent = true
-			ban.Reason = fmt.Sprintf("Escalated to permanent ban after %d violations", maxBanCount)
-		} else if duration > 0 {
-			ban.ExpiresAt = now.Add(duration)
+	m.dirty[o.IP] = true
+	ban.BanCount = count
+	ban.RuleName = o.RuleName
+	ban.Reason = o.Reason
+	ban.Evidence = o.Evidence
+	ban.MatchedRules = o.MatchedRules
+	ban.IsPermanent = permanent
+	if permanent {
+		ban.ExpiresAt = time.Time{} // Clear expiry
+		if penalty.escalated(count) {
+			ban.Reason = fmt.Sprintf("Escalated to permanent ban after %d violations", count)
 		}
-		// If duration == 0, it's a permanent ban (expires_at stays zero)
-
-		m.state.Bans[ip] = ban
 	} else {
-		// Update existing ban
-		existing.BanCount++
-		existing.RuleName = ruleName
+		ban.ExpiresAt = expires
+	}
 
-		// Check if should escalate to permanent
-		if existing.ShouldEscalate(maxBanCount) {
-			existing.IsPermanent = true
-			existing.ExpiresAt = time.Time{} // Clear expiry
-			existing.Reason = fmt.Sprintf("Escalated to permanent ban after %d violations", maxBanCount)
-		} else if duration > 0 {
-			existing.ExpiresAt = now.Add(duration)
-		}
-		existing.Reason = reason
+	switch {
+	case permanent && penalty.escalated(count):
+		m.record(audit.EventEscalate, ban, now, o.By)
+	case active:
+		m.record(audit.EventExtend, ban, now, o.By)
+	default:
+		m.record(audit.EventBan, ban, now, o.By)
 	}
 
 	m.state.LastUpdated = now
+	return *ban, true
 }
 
-// RemoveBan removes a ban explicitly
-func (m *Manager) RemoveBan(ip string) {
+// RemoveBan removes a ban explicitly, along with the IP's offence
+// history. by and reason say who lifted it and why, for the audit log. It
+// reports whether the IP had an entry.
+func (m *Manager) RemoveBan(ip, by, reason string) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	ban, exists := m.state.Bans[ip]
+	if !exists {
+		return false
+	}
+
+	now := time.Now()
+	if m.audit != nil {
+		m.audit.Record(audit.Event{
+			Time:     now,
+			Type:     audit.EventRemove,
+			IP:       ip,
+			Rule:     ban.RuleName,
+			Reason:   reason,
+			By:       by,
+			BanCount: ban.BanCount,
+		})
+	}
 	delete(m.state.Bans, ip)
-	m.state.LastUpdated = time.Now()
+	m.dropRange(ip)
+	m.dirty[ip] = true
+	m.state.LastUpdated = now
+	return true
+}
+
+// LiftBan ends an active ban early. Unlike RemoveBan it keeps the entry
+// and its offence history, so a later ban of the IP still escalates. by
+// and reason say who lifted it and why, for the audit log. It reports
+// whether the IP had an active ban.
+func (m *Manager) LiftBan(ip, by, reason string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ban, exists := m.state.Bans[ip]
+	if !exists || ban.IsExpired() {
+		return false
+	}
+
+	now := time.Now()
+	ban.IsPermanent = false
+	ban.ExpiresAt = now
+	if m.audit != nil {
+		m.audit.Record(audit.Event{
+			Time:     now,
+			Type:     audit.EventLift,
+			IP:       ip,
+			Rule:     ban.RuleName,
+			Reason:   reason,
+			By:       by,
+			BanCount: ban.BanCount,
+		})
+		if m.lifted == nil {
+			m.lifted = make(map[string]bool)
+		}
+		m.lifted[ip] = true
+	}
+	m.dirty[ip] = true
+	m.state.LastUpdated = now
+	return true
+}
+
+// Expire records an audit event for each temporary ban that ran out since
+// the last call. Expired entries stay in the state as offence history. It
+// returns the number of bans that expired.
+func (m *Manager) Expire() int {
+	if m.audit == nil {
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	expired := 0
+	for ip, ban := range m.state.Bans {
+		if ban.IsPermanentBan() || ban.ExpiresAt.IsZero() || m.lifted[ip] {
+			continue
+		}
+		if ban.ExpiresAt.After(m.sweptAt) && !ban.ExpiresAt.After(now) {
+			m.record(audit.EventExpire, ban, now, "")
+			expired++
+		}
+	}
+	m.sweptAt = now
+	m.lifted = nil
+	return expired
 }
 
-// CleanupExpired removes all expired bans
-func (m *Manager) CleanupExpired() int {
+// Decay forgives offences for IPs that have stayed clean. For every full
+// decay interval since an IP's ban expired (or since its last decay), its
+// BanCount drops by one; IPs reaching zero are forgotten. Active and
+// permanent bans never decay. It returns the number of entries whose count
+// was reduced and how many of those were forgotten.
+func (m *Manager) Decay() (decayed, forgotten int) {
+	if m.decayInterval <= 0 {
+		return 0, 0
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	cleaned := 0
+	now := time.Now()
 	for ip, ban := range m.state.Bans {
-		if ban.IsExpired() {
+		if ban.IsPermanentBan() || !ban.IsExpired() {
+			continue
+		}
+
+		anchor := ban.ExpiresAt
+		if ban.DecayedAt.After(anchor) {
+			anchor = ban.DecayedAt
+		}
+		steps := int(now.Sub(anchor) / m.decayInterval)
+		if steps <= 0 {
+			continue
+		}
+
+		decayed++
+		m.dirty[ip] = true
+		ban.BanCount -= steps
+		ban.DecayedAt = anchor.Add(time.Duration(steps) * m.decayInterval)
+		if ban.BanCount <= 0 {
+			ban.BanCount = 0
+			m.record(audit.EventForget, ban, now, "")
 			delete(m.state.Bans, ip)
-			cleaned++
+			m.dropRange(ip)
+			forgotten++
 		}
 	}
 
-	if cleaned > 0 {
-		m.state.LastUpdated = time.Now()
+	if decayed > 0 {
+		m.state.LastUpdated = now
 	}
 
-	return cleaned
+	return decayed, forgotten
 }
 
 // GetActiveBans returns all non-expired bans
@@ -0,0 +1,66 @@
+package ban
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddBanNeverShortens(t *testing.T) {
+	m, _ := newTestManager(t)
+
+	m.AddBan(Offence{IP: "10.0.0.1", RuleName: "first", Penalty: Penalty{Duration: 0}})
+	kept, applied := m.AddBan(Offence{IP: "10.0.0.1", RuleName: ManualRule, Penalty: Penalty{Duration: time.Hour}})
+	if applied || !kept.IsPermanent || kept.BanCount != 1 || kept.RuleName != "first" {
+		t.Errorf("permanent ban became %+v (applied %v)", kept, applied)
+	}
+
+	m.AddBan(Offence{IP: "10.0.0.2", RuleName: "long", Reason: "long ban", Penalty: Penalty{Duration: 7 * 24 * time.Hour}})
+	long, _ := m.GetBan("10.0.0.2")
+	expires := long.ExpiresAt
+	_, applied = m.AddBan(Offence{IP: "10.0.0.2", RuleName: "short", Reason: "short ban", Penalty: Penalty{Ladder: []time.Duration{time.Hour}}})
+	b, _ := m.GetBan("10.0.0.2")
+	if applied || !b.ExpiresAt.Equal(expires) {
+		t.Errorf("7d ban shortened to expire at %v (was %v)", b.ExpiresAt, expires)
+	}
+	// The ignored offence leaves the ban in force as it was
+	if b.BanCount != 1 || b.RuleName != "long" || b.Reason != "long ban" {
+		t.Errorf("ignored offence changed the entry: %+v", b)
+	}
+
+	// A harsher ban still replaces it
+	_, applied = m.AddBan(Offence{IP: "10.0.0.2", RuleName: "longer", Penalty: Penalty{Duration: 30 * 24 * time.Hour}})
+	b, _ = m.GetBan("10.0.0.2")
+	if !applied || !b.ExpiresAt.After(expires) || b.BanCount != 2 || b.RuleName != "longer" {
+		t.Errorf("a longer ban did not extend the entry: %+v", b)
+	}
+	m.AddBan(Offence{IP: "10.0.0.2", Penalty: Penalty{Duration: 0}})
+	if b, _ = m.GetBan("10.0.0.2"); !b.IsPermanent {
+		t.Error("a permanent ban did not replace the temporary one")
+	}
+}
+
+func TestAddBanAfterExpiry(t *testing.T) {
+	m, _ := newTestManager(t)
+
+	m.AddBan(Offence{IP: "10.0.0.1", Penalty: Penalty{Duration: 7 * 24 * time.Hour}})
+	b := m.state.Bans["10.0.0.1"]
+	b.BannedAt = time.Now().Add(-8 * 24 * time.Hour)
+	b.ExpiresAt = time.Now().Add(-time.Minute) // Expired
+
+	// An expired ban doesn't hold back a shorter new one
+	m.AddBan(Offence{IP: "10.0.0.1", Penalty: Penalty{Duration: time.Hour}})
+	b, _ = m.GetBan("10.0.0.1")
+	if b.IsExpired() || b.ExpiresAt.After(time.Now().Add(2*time.Hour)) || b.BanCount != 2 {
+		t.Errorf("re-ban after expiry: %+v", b)
+	}
+	if time.Since(b.BannedAt) > time.Minute {
+		t.Errorf("re-ban kept the first ban time %v", b.BannedAt)
+	}
+
+	// Extending an active ban keeps when it started
+	bannedAt := b.BannedAt
+	m.AddBan(Offence{IP: "10.0.0.1", Penalty: Penalty{Duration: 24 * time.Hour}})
+	if b, _ = m.GetBan("10.0.0.1"); !b.BannedAt.Equal(bannedAt) {
+		t.Errorf("extension moved BannedAt from %v to %v", bannedAt, b.BannedAt)
+	}
+}
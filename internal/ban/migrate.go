@@ -0,0 +1,129 @@
+package ban
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// migration upgrades a decoded state document by one version. Documents
+// are handled as generic JSON so that a step can read fields the current
+// models no longer have.
+type migration struct {
+	description string
+	apply       func(doc map[string]any) error
+}
+
+// migrations maps a state version to the step upgrading it to the next.
+// Bumping models.BanStateVersion requires adding the step from the old
+// version here.
+var migrations = map[int]migration{
+	1: {"record ban_count and is_permanent", migrateV1},
+	2: {"keep expired entries as history", migrateV2},
+}
+
+// errNewerVersion marks a state file written by a newer build
+type errNewerVersion struct {
+	path    string
+	version int
+}
+
+func (e *errNewerVersion) Error() string {
+	return fmt.Sprintf("ban state %s is version %d, newer than this build supports (%d); upgrade peer-banner or restore a backup",
+		e.path, e.version, models.BanStateVersion)
+}
+
+// decodeState parses a state file, upgrading older versions, and returns
+// the state with the version it was stored as
+func decodeState(path string, data []byte) (*models.BanState, int, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, 0, fmt.Errorf("%w in %s: %v", errCorrupt, path, err)
+	}
+
+	from, err := documentVersion(doc)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w in %s: %v", errCorrupt, path, err)
+	}
+	if from > models.BanStateVersion {
+		return nil, 0, &errNewerVersion{path: path, version: from}
+	}
+
+	if from < models.BanStateVersion {
+		for v := from; v < models.BanStateVersion; v++ {
+			step, ok := migrations[v]
+			if !ok {
+				return nil, 0, fmt.Errorf("ban state %s: no migration from version %d", path, v)
+			}
+			if err := step.apply(doc); err != nil {
+				return nil, 0, fmt.Errorf("ban state %s: migrating version %d (%s): %w", path, v, step.description, err)
+			}
+		}
+		doc["version"] = models.BanStateVersion
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, 0, fmt.Errorf("ban state %s: %w", path, err)
+		}
+	}
+
+	var state models.BanState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, 0, fmt.Errorf("%w in %s: %v", errCorrupt, path, err)
+	}
+	if state.Bans == nil {
+		state.Bans = make(map[string]*models.BannedIP)
+	}
+	return &state, from, nil
+}
+
+// documentVersion reads the version of a state document. Files written
+// before versioning have none and count as version 1.
+func documentVersion(doc map[string]any) (int, error) {
+	raw, ok := doc["version"]
+	if !ok || raw == nil {
+		return 1, nil
+	}
+	v, ok := raw.(float64)
+	if !ok || v != float64(int(v)) || v < 1 {
+		return 0, fmt.Errorf("invalid version %v", raw)
+	}
+	return int(v), nil
+}
+
+// entries returns the ban entries of a state document
+func entries(doc map[string]any) []map[string]any {
+	bans, _ := doc["bans"].(map[string]any)
+	list := make([]map[string]any, 0, len(bans))
+	for _, b := range bans {
+		if entry, ok := b.(map[string]any); ok {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// migrateV1 upgrades version 1, which had no offence count: every entry
+// was banned once, and a zero expiry meant a permanent ban
+func migrateV1(doc map[string]any) error {
+	for _, entry := range entries(doc) {
+		if _, ok := entry["ban_count"]; !ok {
+			entry["ban_count"] = 1
+		}
+		if _, ok := entry["is_permanent"]; !ok {
+			expires, _ := entry["expires_at"].(string)
+			t, err := time.Parse(time.RFC3339Nano, expires)
+			entry["is_permanent"] = expires == "" || err == nil && t.IsZero()
+		}
+	}
+	return nil
+}
+
+// migrateV2 upgrades version 2, which dropped expired entries on load.
+// Version 3 keeps them as offence history, with decayed_at, evidence and
+// matched_rules. The new fields are optional, and an expired entry left in
+// a version 2 file is kept as it is: an expired entry, counting toward the
+// IP's history like any other.
+func migrateV2(doc map[string]any) error {
+	return nil
+}
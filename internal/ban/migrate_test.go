@@ -0,0 +1,170 @@
+package ban
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// writeState writes a raw state file and returns its path
+func writeState(t *testing.T, data string) string {
+	t.Helper()
+	stateFile := filepath.Join(t.TempDir(), "bans.json")
+	if err := os.WriteFile(stateFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return stateFile
+}
+
+// fileVersion reads the version a state file was written as
+func fileVersion(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state models.BanState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state.Version
+}
+
+func TestMigrateV1(t *testing.T) {
+	future := time.Now().Add(time.Hour).Format(time.RFC3339Nano)
+	v1 := `{"bans": {
+		"10.0.0.1": {"ip": "10.0.0.1", "banned_at": "2020-01-01T00:00:00Z", "expires_at": "0001-01-01T00:00:00Z"},
+		"10.0.0.2": {"ip": "10.0.0.2", "banned_at": "2020-01-01T00:00:00Z", "expires_at": "` + future + `"}
+	}}`
+
+	for _, store := range []string{config.StoreJSON, config.StoreJournal} {
+		t.Run(store, func(t *testing.T) {
+			stateFile := writeState(t, v1)
+			m, err := NewManager(stateFile, &config.BanConfig{Store: store})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+
+			permanent, ok := m.GetBan("10.0.0.1")
+			if !ok || !permanent.IsPermanent || permanent.BanCount != 1 {
+				t.Errorf("10.0.0.1 = %+v, want a permanent ban counted once", permanent)
+			}
+			timed, ok := m.GetBan("10.0.0.2")
+			if !ok || timed.IsPermanent || timed.BanCount != 1 {
+				t.Errorf("10.0.0.2 = %+v, want a timed ban counted once", timed)
+			}
+
+			if v := fileVersion(t, stateFile); v != models.BanStateVersion {
+				t.Errorf("state file is version %d after upgrading, want %d", v, models.BanStateVersion)
+			}
+			// The original is kept byte for byte
+			backup, err := os.ReadFile(stateFile + ".v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(backup, []byte(v1)) {
+				t.Errorf("backup differs from the original:\n%s", backup)
+			}
+		})
+	}
+}
+
+func TestMigrateV2KeepsExpired(t *testing.T) {
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339Nano)
+	future := time.Now().Add(time.Hour).Format(time.RFC3339Nano)
+	stateFile := writeState(t, `{"version": 2, "bans": {
+		"10.0.0.1": {"ip": "10.0.0.1", "expires_at": "`+past+`", "ban_count": 3},
+		"10.0.0.2": {"ip": "10.0.0.2", "expires_at": "`+future+`", "ban_count": 1},
+		"10.0.0.3": {"ip": "10.0.0.3", "expires_at": "`+past+`", "ban_count": 2, "is_permanent": true}
+	}}`)
+
+	m, err := NewManager(stateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	expired, ok := m.GetBan("10.0.0.1")
+	if !ok || !expired.IsExpired() || expired.BanCount != 3 {
+		t.Errorf("expired version 2 entry: %+v, want it kept as an expired entry", expired)
+	}
+	if m.IsBanned("10.0.0.1") {
+		t.Error("an expired version 2 entry is banned again")
+	}
+	for _, ip := range []string{"10.0.0.2", "10.0.0.3"} {
+		if !m.IsBanned(ip) {
+			t.Errorf("%s is no longer banned", ip)
+		}
+	}
+	if _, err := os.Stat(stateFile + ".v2"); err != nil {
+		t.Errorf("no backup of the version 2 file: %v", err)
+	}
+}
+
+func TestMigrateRestoredBackup(t *testing.T) {
+	v1 := `{"bans": {"10.0.0.1": {"ip": "10.0.0.1", "banned_at": "2020-01-01T00:00:00Z", "expires_at": "0001-01-01T00:00:00Z"}}}`
+
+	for _, store := range []string{config.StoreJSON, config.StoreJournal} {
+		t.Run(store, func(t *testing.T) {
+			// A corrupt state file with an old backup next to it
+			stateFile := writeState(t, `{"version": 3, "bans": {`)
+			if err := os.WriteFile(backupPath(stateFile, 1), []byte(v1), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := NewManager(stateFile, &config.BanConfig{Store: store})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+
+			if !m.IsBanned("10.0.0.1") {
+				t.Error("the restored ban is missing")
+			}
+			if v := fileVersion(t, stateFile); v != models.BanStateVersion {
+				t.Errorf("state file is version %d after upgrading, want %d", v, models.BanStateVersion)
+			}
+			// The original kept is the backup that was restored
+			backup, err := os.ReadFile(stateFile + ".v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(backup, []byte(v1)) {
+				t.Errorf("backup differs from the restored file:\n%s", backup)
+			}
+			if corrupt, _ := filepath.Glob(stateFile + ".corrupt-*"); len(corrupt) != 1 {
+				t.Errorf("corrupt files kept: %v", corrupt)
+			}
+		})
+	}
+}
+
+func TestNewerVersionRefused(t *testing.T) {
+	newer := `{"version": 99, "bans": {}}`
+	stateFile := writeState(t, newer)
+
+	_, err := NewManager(stateFile, nil)
+	var newerErr *errNewerVersion
+	if !errors.As(err, &newerErr) || newerErr.version != 99 {
+		t.Fatalf("err = %v, want a newer version error", err)
+	}
+	if errors.Is(err, errCorrupt) {
+		t.Error("a newer version was treated as corruption")
+	}
+
+	// Neither rewritten nor backed up
+	if data, _ := os.ReadFile(stateFile); string(data) != newer {
+		t.Errorf("state file was changed:\n%s", data)
+	}
+	if _, err := os.Stat(stateFile + ".v99"); !os.IsNotExist(err) {
+		t.Errorf("backup was made of a newer file: %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package ban
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/iptrie"
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// Pardon exempts an IP or range from banning until it expires, like a
+// whitelist entry that reverts by itself
+type Pardon struct {
+	Target    string    `json:"target"` // IP or CIDR range, as normalized by ParseTarget
+	ExpiresAt time.Time `json:"expires_at"`
+	Note      string    `json:"note,omitempty"`
+	By        string    `json:"by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	network netip.Prefix
+}
+
+// Active reports whether the pardon is still in force at t
+func (p *Pardon) Active(t time.Time) bool {
+	return t.Before(p.ExpiresAt)
+}
+
+// Contains reports whether an IP falls within the pardon
+func (p *Pardon) Contains(ip netip.Addr) bool {
+	return p.network.Contains(ip.Unmap())
+}
+
+// pardonFile is the JSON form of the pardons file
+type pardonFile struct {
+	Pardons []*Pardon `json:"pardons"`
+}
+
+// PardonsPath returns the pardons file kept next to a state file
+func PardonsPath(stateFile string) string {
+	return filepath.Join(filepath.Dir(stateFile), "pardons.json")
+}
+
+// LoadPardons reads the pardons kept next to a state file, sorted by
+// target. A missing file has none.
+func LoadPardons(stateFile string) ([]*Pardon, error) {
+	data, err := os.ReadFile(PardonsPath(stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read pardons: %w", err)
+	}
+
+	var f pardonFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid pardons file %s: %w", PardonsPath(stateFile), err)
+	}
+	for _, p := range f.Pardons {
+		key, err := ParseTarget(p.Target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pardons file %s: %w", PardonsPath(stateFile), err)
+		}
+		p.Target = key
+		p.network = targetNetwork(key)
+	}
+	sort.Slice(f.Pardons, func(i, j int) bool { return f.Pardons[i].Target < f.Pardons[j].Target })
+	return f.Pardons, nil
+}
+
+// targetNetwork returns the network a ban or pardon target covers, an
+// invalid prefix if the target is neither an IP nor a CIDR range
+func targetNetwork(key string) netip.Prefix {
+	if network, ok := parseRange(key); ok {
+		return network.Masked()
+	}
+	addr, err := netip.ParseAddr(key)
+	if err != nil {
+		return netip.Prefix{}
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// UpdatePardons changes the pardons next to a state file. The file is
+// locked for the whole read-modify-write, and expired pardons are dropped.
+func UpdatePardons(stateFile string, update func([]*Pardon) ([]*Pardon, error)) error {
+	path := PardonsPath(stateFile)
+	return withFileLock(path, func() error {
+		pardons, err := LoadPardons(stateFile)
+		if err != nil {
+			return err
+		}
+		if pardons, err = update(pardons); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		f := pardonFile{Pardons: make([]*Pardon, 0, len(pardons))}
+		for _, p := range pardons {
+			if p.Active(now) {
+				f.Pardons = append(f.Pardons, p)
+			}
+		}
+		sort.Slice(f.Pardons, func(i, j int) bool { return f.Pardons[i].Target < f.Pardons[j].Target })
+
+		if err := writeJSONFile(path, &f); err != nil {
+			return fmt.Errorf("failed to write pardons: %w", err)
+		}
+		return nil
+	})
+}
+
+// NewPardon creates a pardon for an IP or CIDR range until the given time
+func NewPardon(target string, until time.Time, note, by string) (*Pardon, error) {
+	key, err := ParseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !until.After(now) {
+		return nil, fmt.Errorf("pardon for %s would already have expired", key)
+	}
+	return &Pardon{
+		Target:    key,
+		ExpiresAt: until,
+		Note:      note,
+		By:        by,
+		CreatedAt: now,
+		network:   targetNetwork(key),
+	}, nil
+}
+
+// Pardoned returns the pardon in force for an IP, nil if there is none
+func (m *Manager) Pardoned(ip string) *Pardon {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.pardonFor(targetNetwork(ip), time.Now())
+}
+
+// pardonFor returns a pardon in force at now that covers a whole network,
+// nil if there is none. The caller holds the lock.
+func (m *Manager) pardonFor(network netip.Prefix, now time.Time) *Pardon {
+	var found *Pardon
+	m.pardonIndex.EachContaining(network, func(_ netip.Prefix, pardons []*Pardon) bool {
+		for _, p := range pardons {
+			if p.Active(now) {
+				found = p
+				return false
+			}
+		}
+		return true
+	})
+	return found
+}
+
+// loadPardons reads the pardons file if it changed since it was last read
+func (m *Manager) loadPardons() error {
+	path := PardonsPath(m.stateFile)
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	if modTime.Equal(m.pardonsModTime) && m.pardonsLoaded {
+		return nil
+	}
+
+	pardons, err := LoadPardons(m.stateFile)
+	if err != nil {
+		return err
+	}
+	var index iptrie.Trie[[]*Pardon]
+	for _, p := range pardons {
+		same, _ := index.Get(p.network)
+		index.Insert(p.network, append(same, p))
+	}
+
+	m.mu.Lock()
+	m.pardons = pardons
+	m.pardonIndex = index
+	m.pardonsModTime = modTime
+	m.pardonsLoaded = true
+	m.mu.Unlock()
+	return nil
+}
+
+// RefreshPardons rereads the pardons file when it changed and lifts the
+// active bans that pardons in force cover. It returns the lifted entries.
+func (m *Manager) RefreshPardons() ([]string, error) {
+	if err := m.loadPardons(); err != nil {
+		return nil, err
+	}
+
+	type lift struct {
+		key    string
+		pardon *Pardon
+	}
+	var lifts []lift
+	now := time.Now()
+	m.mu.RLock()
+	for key, b := range m.state.Bans {
+		if b.IsExpired() {
+			continue
+		}
+		if p := m.pardonFor(targetNetwork(key), now); p != nil {
+			lifts = append(lifts, lift{key, p})
+		}
+	}
+	m.mu.RUnlock()
+
+	var lifted []string
+	for _, l := range lifts {
+		reason := "pardoned until " + l.pardon.ExpiresAt.Format(time.RFC3339)
+		if l.pardon.Note != "" {
+			reason += ": " + l.pardon.Note
+		}
+		if m.LiftBan(l.key, l.pardon.By, reason) {
+			lifted = append(lifted, l.key)
+		}
+	}
+	sort.Strings(lifted)
+	return lifted, nil
+}
+
+// PardonedNetworks returns the networks of the pardons in force, for
+// carving them out of what the output blocks
+func (m *Manager) PardonedNetworks() []netip.Prefix {
+	now := time.Now()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var networks []netip.Prefix
+	for _, p := range m.pardons {
+		if p.Active(now) {
+			networks = append(networks, p.network)
+		}
+	}
+	return networks
+}
+
+// OutputBans returns the active bans as the output file should enforce
+// them: range bans have the pardons in force carved out of them, so that a
+// range ban doesn't block a pardoned IP inside it. A carved range comes
+// back as one entry per remaining prefix, each a copy of the range's own.
+func (m *Manager) OutputBans() []*models.BannedIP {
+	bans := m.GetActiveBans()
+	holes := m.PardonedNetworks()
+	if len(holes) == 0 {
+		return bans
+	}
+
+	out := make([]*models.BannedIP, 0, len(bans))
+	for _, b := range bans {
+		network, ok := parseRange(b.IP)
+		if !ok {
+			out = append(out, b)
+			continue
+		}
+		network = network.Masked()
+		pieces := carve(network, holes)
+		if len(pieces) == 1 && pieces[0] == network {
+			out = append(out, b)
+			continue
+		}
+		for _, piece := range pieces {
+			entry := *b
+			entry.IP = piece.String()
+			if piece.IsSingleIP() {
+				entry.IP = piece.Addr().String()
+			}
+			out = append(out, &entry)
+		}
+	}
+	return out
+}
+
+// carve returns the fewest prefixes covering network minus the holes
+func carve(network netip.Prefix, holes []netip.Prefix) []netip.Prefix {
+	var inside []netip.Prefix
+	for _, h := range holes {
+		switch {
+		case h.Addr().BitLen() != network.Addr().BitLen():
+		case h.Bits() <= network.Bits() && h.Contains(network.Addr()):
+			return nil // Wholly pardoned
+		case network.Contains(h.Addr()):
+			inside = append(inside, h)
+		}
+	}
+	if len(inside) == 0 {
+		return []netip.Prefix{network}
+	}
+
+	// Split in halves and carve each
+	bits := network.Bits() + 1
+	b := network.Addr().AsSlice()
+	b[network.Bits()/8] |= 0x80 >> (network.Bits() % 8)
+	upper, _ := netip.AddrFromSlice(b)
+	return append(carve(netip.PrefixFrom(network.Addr(), bits), inside), carve(netip.PrefixFrom(upper, bits), inside)...)
+}
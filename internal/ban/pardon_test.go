@@ -0,0 +1,149 @@
+package ban
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/audit"
+	"github.com/philogag/peer-banner/internal/config"
+)
+
+func pardon(t *testing.T, stateFile string, targets ...string) {
+	t.Helper()
+	err := UpdatePardons(stateFile, func(pardons []*Pardon) ([]*Pardon, error) {
+		for _, target := range targets {
+			p, err := NewPardon(target, time.Now().Add(time.Hour), "", "admin")
+			if err != nil {
+				return nil, err
+			}
+			pardons = append(pardons, p)
+		}
+		return pardons, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshPardonsKeepsHistory(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "bans.json")
+	cfg := &config.BanConfig{}
+	m, err := NewManager(stateFile, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	escalate := Penalty{Duration: time.Hour, MaxBanCount: 3}
+	m.AddBan(Offence{IP: "10.0.0.1", Penalty: escalate})
+	m.AddBan(Offence{IP: "10.0.0.1", Penalty: escalate})
+	m.AddBan(Offence{IP: "10.0.1.0/24", Penalty: Penalty{}})
+
+	pardon(t, stateFile, "10.0.0.1", "10.0.1.0/24")
+	lifted, err := m.RefreshPardons()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lifted) != 2 {
+		t.Fatalf("lifted %v, want both bans", lifted)
+	}
+	b, ok := m.GetBan("10.0.0.1")
+	if !ok || !b.IsExpired() || b.BanCount != 2 {
+		t.Fatalf("pardoned entry: %+v, want an expired entry with 2 offences", b)
+	}
+	if r, _ := m.GetBan("10.0.1.0/24"); r.IsPermanentBan() || !r.IsExpired() || m.IsBanned("10.0.1.7") {
+		t.Errorf("permanent range ban was not lifted: %+v", r)
+	}
+
+	// The history still counts once the pardon is gone
+	m.AddBan(Offence{IP: "10.0.0.1", Penalty: escalate})
+	if b, _ := m.GetBan("10.0.0.1"); !b.IsPermanent || b.BanCount != 3 {
+		t.Errorf("third offence after a pardon: %+v, want permanent", b)
+	}
+
+	// A lift is reported once, not again as an expiry
+	if n := m.Expire(); n != 0 {
+		t.Errorf("Expire reported %d lifted bans", n)
+	}
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+	events, err := audit.Query(cfg.Audit.GetFile(stateFile), &audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lifts := 0
+	for _, e := range events {
+		if e.Type == audit.EventLift {
+			lifts++
+		}
+		if e.Type == audit.EventExpire || e.Type == audit.EventRemove {
+			t.Errorf("unexpected %s event for %s", e.Type, e.IP)
+		}
+	}
+	if lifts != 2 {
+		t.Errorf("%d lift events, want 2", lifts)
+	}
+}
+
+func TestOutputBansCarvesPardons(t *testing.T) {
+	m, stateFile := newTestManager(t)
+	m.AddBan(Offence{IP: "10.0.0.0/24", Penalty: Penalty{}})
+	m.AddBan(Offence{IP: "10.0.1.0/24", Penalty: Penalty{}})
+	m.AddBan(Offence{IP: "2001:db8::/32", Penalty: Penalty{}})
+
+	pardon(t, stateFile, "10.0.0.5", "2001:db8:1::/48", "192.168.0.0/16")
+	if _, err := m.RefreshPardons(); err != nil {
+		t.Fatal(err)
+	}
+
+	covered := make(map[netip.Prefix]bool)
+	for _, b := range m.OutputBans() {
+		p, err := netip.ParsePrefix(b.IP)
+		if err != nil {
+			addr := netip.MustParseAddr(b.IP)
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		covered[p] = true
+	}
+	contains := func(ip string) bool {
+		addr := netip.MustParseAddr(ip)
+		for p := range covered {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !covered[netip.MustParsePrefix("10.0.1.0/24")] {
+		t.Error("a range without pardons was changed")
+	}
+	for ip, want := range map[string]bool{
+		"10.0.0.5":        false,
+		"10.0.0.4":        true,
+		"10.0.0.6":        true,
+		"10.0.0.0":        true,
+		"10.0.0.255":      true,
+		"2001:db8:1::1":   false,
+		"2001:db8:2::1":   true,
+		"2001:db8:0::1":   true,
+		"2001:db8:ffff::": true,
+	} {
+		if got := contains(ip); got != want {
+			t.Errorf("output covers %s: %v, want %v", ip, got, want)
+		}
+	}
+	// 10.0.0.0/24 minus one address needs 8 prefixes
+	n := 0
+	for p := range covered {
+		if p.Addr().Is4() && netip.MustParsePrefix("10.0.0.0/24").Contains(p.Addr()) {
+			n++
+		}
+	}
+	if n != 8 {
+		t.Errorf("10.0.0.0/24 carved into %d prefixes, want 8", n)
+	}
+}
@@ -0,0 +1,99 @@
+package ban
+
+import (
+	"math"
+	"time"
+)
+
+// Penalty decides how long each successive ban of an IP lasts.
+//
+// Without a ladder or multiplier every offence gets Duration, and the
+// MaxBanCount-th offence becomes permanent, which is the original
+// ban_duration/max_ban_count behaviour.
+type Penalty struct {
+	Duration    time.Duration   // Base duration, 0 = permanent
+	MaxBanCount int             // Offence count that escalates to permanent, 0 = never
+	Ladder      []time.Duration // Duration per offence, 0 = permanent; the last step repeats
+	Multiplier  float64         // Growth factor applied per repeat offence
+	MaxDuration time.Duration   // Cap for multiplier growth, 0 = uncapped
+}
+
+// For returns the ban duration for the count-th offence (starting at 1)
+func (p Penalty) For(count int) (duration time.Duration, permanent bool) {
+	if count < 1 {
+		count = 1
+	}
+
+	if p.MaxBanCount > 0 && count >= p.MaxBanCount {
+		return 0, true
+	}
+
+	if len(p.Ladder) > 0 {
+		step := p.Ladder[min(count, len(p.Ladder))-1]
+		return step, step == 0
+	}
+
+	if p.Duration == 0 {
+		return 0, true
+	}
+
+	d := p.Duration
+	if p.Multiplier > 1 && count > 1 {
+		scaled := float64(p.Duration) * math.Pow(p.Multiplier, float64(count-1))
+		if scaled >= math.MaxInt64 {
+			d = time.Duration(math.MaxInt64)
+		} else {
+			d = time.Duration(scaled)
+		}
+		if p.MaxDuration > 0 && d > p.MaxDuration {
+			d = p.MaxDuration
+		}
+	}
+	return d, false
+}
+
+// Worst returns the harshest ban this penalty can ever hand out. An
+// uncapped multiplier grows without bound and reports the maximum duration.
+func (p Penalty) Worst() (duration time.Duration, permanent bool) {
+	if p.MaxBanCount > 0 {
+		return 0, true
+	}
+	if len(p.Ladder) > 0 {
+		for _, step := range p.Ladder {
+			if step == 0 {
+				return 0, true
+			}
+			duration = max(duration, step)
+		}
+		return duration, false
+	}
+	if p.Duration == 0 {
+		return 0, true
+	}
+	if p.Multiplier > 1 {
+		if p.MaxDuration > 0 {
+			return max(p.Duration, p.MaxDuration), false
+		}
+		return time.Duration(math.MaxInt64), false
+	}
+	return p.Duration, false
+}
+
+// Longer reports whether ban a is harsher than ban b, a permanent ban
+// being harsher than any temporary one
+func Longer(a time.Duration, aPermanent bool, b time.Duration, bPermanent bool) bool {
+	if aPermanent != bPermanent {
+		return aPermanent
+	}
+	return !aPermanent && a > b
+}
+
+// escalated reports whether the count-th offence is permanent only because
+// of repeat offences
+func (p Penalty) escalated(count int) bool {
+	if _, permanent := p.For(count); !permanent {
+		return false
+	}
+	_, firstPermanent := p.For(1)
+	return !firstPermanent || (p.MaxBanCount > 0 && count >= p.MaxBanCount)
+}
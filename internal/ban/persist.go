@@ -0,0 +1,169 @@
+package ban
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// backupInterval is the least age difference between path.1 and path.2
+// before older backups shift up. Backups past the first are thus spread
+// over time, and a run of bad saves can't push every good copy out.
+const backupInterval = time.Hour
+
+// backupPath returns the path of the n-th newest backup of a state file
+func backupPath(stateFile string, n int) string {
+	return fmt.Sprintf("%s.%d", stateFile, n)
+}
+
+// writeStateFile replaces path with data so that a crash or a full disk at
+// any point leaves either the old or the new file, never a partial one.
+// The data is written to a temp file in the same directory and synced
+// before it is renamed into place. With backups > 0 the previous file is
+// kept as path.1, and older copies up to path.<backups> (see
+// rotateBackups).
+func writeStateFile(path string, data []byte, backups int) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+
+	if backups > 0 {
+		if err := rotateBackups(path, backups); err != nil {
+			return fmt.Errorf("failed to rotate backups: %w", err)
+		}
+	}
+
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	syncDir(dir)
+	return nil
+}
+
+// writeJSONFile replaces a small side file, such as the pardons, with the
+// indented JSON of v. No backups are kept.
+func writeJSONFile(path string, v any) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to encode: %w", err)
+	}
+	return writeStateFile(path, buf.Bytes(), 0)
+}
+
+// withFileLock runs fn holding path.lock, so that read-modify-write
+// cycles of a side file by several processes do not lose changes
+func withFileLock(path string, fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s.lock: %w", filepath.Base(path), err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", filepath.Base(path), err)
+	}
+	return fn()
+}
+
+// rotateBackups keeps the current file as path.1. path.1 .. path.<n-1>
+// first shift up by one, dropping the oldest, but only once path.1 is
+// backupInterval newer than path.2; until then path.1 is replaced. Saves
+// every cycle thus keep at most one copy per interval past the first. The
+// current file stays in place throughout.
+func rotateBackups(path string, n int) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	first := backupPath(path, 1)
+	if n > 1 && shiftDue(first, backupPath(path, 2)) {
+		for i := n - 1; i >= 1; i-- {
+			err := os.Rename(backupPath(path, i), backupPath(path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	if err := os.Remove(first); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// A hard link is instant; copy where the filesystem has none
+	if err := os.Link(path, first); err == nil {
+		return nil
+	}
+	return copyFile(path, first)
+}
+
+// shiftDue reports whether the backup newer is backupInterval newer than
+// older, or older is missing
+func shiftDue(newer, older string) bool {
+	n, err := os.Stat(newer)
+	if err != nil {
+		return false
+	}
+	o, err := os.Stat(older)
+	if err != nil {
+		return true
+	}
+	return n.ModTime().Sub(o.ModTime()) >= backupInterval
+}
+
+// copyFile copies src to dst and syncs it
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir flushes a directory entry change such as a rename to disk. It is
+// best effort: not every platform can sync a directory.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,72 @@
+package ban
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readBackup returns the content of a backup, or "" if it is missing
+func readBackup(t *testing.T, path string, n int) string {
+	t.Helper()
+	data, err := os.ReadFile(backupPath(path, n))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotateBackupsSpreadsCopies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	save := func(i int) {
+		t.Helper()
+		if err := writeStateFile(path, []byte(fmt.Sprint(i)), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Saves within the interval only replace the first backup
+	for i := 1; i <= 10; i++ {
+		save(i)
+	}
+	if got := [3]string{readBackup(t, path, 1), readBackup(t, path, 2), readBackup(t, path, 3)}; got != [3]string{"9", "1", ""} {
+		t.Fatalf("backups = %q, want 9, 1 and none", got)
+	}
+
+	// Once the first backup is an interval newer, the older ones shift
+	old := time.Now().Add(-2 * backupInterval)
+	if err := os.Chtimes(backupPath(path, 2), old, old); err != nil {
+		t.Fatal(err)
+	}
+	save(11)
+	if got := [3]string{readBackup(t, path, 1), readBackup(t, path, 2), readBackup(t, path, 3)}; got != [3]string{"10", "9", "1"} {
+		t.Fatalf("backups = %q, want 10, 9 and 1", got)
+	}
+
+	for i := 12; i <= 20; i++ {
+		save(i)
+	}
+	if got := [3]string{readBackup(t, path, 1), readBackup(t, path, 2), readBackup(t, path, 3)}; got != [3]string{"19", "9", "1"} {
+		t.Errorf("backups = %q, want 19, 9 and 1", got)
+	}
+}
+
+func TestRotateBackupsSingle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	for i := 1; i <= 3; i++ {
+		if err := writeStateFile(path, []byte(fmt.Sprint(i)), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readBackup(t, path, 1); got != "2" {
+		t.Errorf("backup = %q, want 2", got)
+	}
+	if _, err := os.Stat(backupPath(path, 2)); !os.IsNotExist(err) {
+		t.Errorf("a second backup was kept: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package ban
+
+import (
+	"sort"
+
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// ReconcileBy is who lifts bans that no longer match the configuration,
+// for the audit log
+const ReconcileBy = "reconcile"
+
+// Lift is a ban lifted because the configuration no longer supports it
+type Lift struct {
+	Target string // IP or CIDR range
+	Rule   string // Rule that made the ban
+	Reason string // Why it was lifted
+}
+
+// Reconcile lifts the active bans the current configuration would not
+// make, keeping their offence history. check returns why a ban should be
+// lifted, or "" to keep it. It returns the lifted bans sorted by target.
+func (m *Manager) Reconcile(check func(key string, b *models.BannedIP) string) []Lift {
+	var lifts []Lift
+	m.mu.RLock()
+	for key, b := range m.state.Bans {
+		if b.IsExpired() {
+			continue
+		}
+		if reason := check(key, b); reason != "" {
+			lifts = append(lifts, Lift{Target: key, Rule: b.RuleName, Reason: reason})
+		}
+	}
+	m.mu.RUnlock()
+
+	lifted := lifts[:0]
+	for _, l := range lifts {
+		if m.LiftBan(l.Target, ReconcileBy, l.Reason) {
+			lifted = append(lifted, l)
+		}
+	}
+	sort.Slice(lifted, func(i, j int) bool { return lifted[i].Target < lifted[j].Target })
+	return lifted
+}
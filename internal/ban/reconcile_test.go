@@ -0,0 +1,37 @@
+package ban
+
+import (
+	"testing"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+func TestReconcileKeepsHistory(t *testing.T) {
+	m, _ := newTestManager(t)
+	m.AddBan(Offence{IP: "10.0.0.1", RuleName: "old_rule", Penalty: Penalty{Duration: time.Hour}})
+	m.AddBan(Offence{IP: "10.0.0.1", RuleName: "old_rule", Penalty: Penalty{Duration: time.Hour}})
+	m.AddBan(Offence{IP: "10.0.0.2", RuleName: "kept_rule", Penalty: Penalty{}})
+
+	lifted := m.Reconcile(func(key string, b *models.BannedIP) string {
+		if b.RuleName == "old_rule" {
+			return "rule old_rule was removed from the configuration"
+		}
+		return ""
+	})
+	if len(lifted) != 1 || lifted[0].Target != "10.0.0.1" || lifted[0].Rule != "old_rule" {
+		t.Fatalf("lifted %+v", lifted)
+	}
+	b, ok := m.GetBan("10.0.0.1")
+	if !ok || !b.IsExpired() || b.BanCount != 2 {
+		t.Errorf("reconciled entry: %+v, want an expired entry with 2 offences", b)
+	}
+	if !m.IsBanned("10.0.0.2") {
+		t.Error("a supported ban was lifted")
+	}
+
+	// Lifted bans are not lifted again
+	if again := m.Reconcile(func(string, *models.BannedIP) string { return "x" }); len(again) != 1 || again[0].Target != "10.0.0.2" {
+		t.Errorf("second reconcile lifted %+v", again)
+	}
+}
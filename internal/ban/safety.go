@@ -0,0 +1,84 @@
+package ban
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Trip records a safety limit that stopped enforcement
+type Trip struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Server string    `json:"server,omitempty"`
+	Bans   int       `json:"bans,omitempty"`  // Bans the run tried to make
+	Limit  int       `json:"limit,omitempty"` // The limit they exceeded
+	By     string    `json:"by,omitempty"`    // Who froze enforcement by hand
+}
+
+// Safety is the enforcement state the safety limits leave behind. A
+// tripped rule keeps matching peers without banning them, and a freeze
+// stops every new ban, until acknowledged.
+type Safety struct {
+	Frozen  *Trip            `json:"frozen,omitempty"`
+	Tripped map[string]*Trip `json:"tripped,omitempty"` // By rule name
+}
+
+// Enforcing reports whether a rule's bans take effect
+func (s *Safety) Enforcing(rule string) bool {
+	return s.Frozen == nil && s.Tripped[rule] == nil
+}
+
+// TrippedRules returns the names of the tripped rules, sorted
+func (s *Safety) TrippedRules() []string {
+	names := make([]string, 0, len(s.Tripped))
+	for name := range s.Tripped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SafetyPath returns the safety state file kept next to a state file,
+// named after it so that daemons sharing a directory keep apart
+func SafetyPath(stateFile string) string {
+	return stateFile + ".safety"
+}
+
+// LoadSafety reads the safety state kept next to a state file. A missing
+// file means nothing has tripped.
+func LoadSafety(stateFile string) (*Safety, error) {
+	s := &Safety{}
+	data, err := os.ReadFile(SafetyPath(stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read safety state: %w", err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid safety state %s: %w", SafetyPath(stateFile), err)
+	}
+	return s, nil
+}
+
+// UpdateSafety changes the safety state next to a state file, holding its
+// lock for the whole read-modify-write
+func UpdateSafety(stateFile string, update func(*Safety) error) error {
+	path := SafetyPath(stateFile)
+	return withFileLock(path, func() error {
+		s, err := LoadSafety(stateFile)
+		if err != nil {
+			return err
+		}
+		if err := update(s); err != nil {
+			return err
+		}
+		if err := writeJSONFile(path, s); err != nil {
+			return fmt.Errorf("failed to write safety state: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,167 @@
+package ban
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// snapshot is a complete state file: the whole of the JSON store, and the
+// base the journal store replays its journal onto. It keeps an image of
+// the stored entries so that a full rewrite needs nothing from the Manager.
+type snapshot struct {
+	path      string
+	backups   int
+	onCorrupt string
+	writable  bool
+	bans      map[string]*models.BannedIP
+	source    string // The file load read: path, or the backup restored in its place
+}
+
+// newSnapshot creates an empty snapshot for a state file
+func newSnapshot(path string, cfg *config.BanConfig, writable bool) snapshot {
+	s := snapshot{
+		path:      path,
+		backups:   config.DefaultBackups,
+		onCorrupt: config.CorruptRestore,
+		writable:  writable,
+		bans:      make(map[string]*models.BannedIP),
+	}
+	if cfg != nil {
+		s.backups = cfg.GetBackups()
+		s.onCorrupt = cfg.GetOnCorrupt()
+	}
+	return s
+}
+
+// load reads the state file and returns the version it was stored as, 0
+// when there is no file yet. A file that exists but cannot be parsed is
+// reported as corrupt rather than treated as empty; a writable snapshot
+// in restore mode falls back to the newest readable backup instead. Files
+// from newer versions are refused.
+func (s *snapshot) load() (int, error) {
+	state, from, err := readState(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil // No file yet, that's fine
+		}
+		if !errors.Is(err, errCorrupt) || !s.writable || s.onCorrupt != config.CorruptRestore {
+			return 0, err
+		}
+		if state, from, err = s.restore(err); err != nil {
+			return 0, err
+		}
+	} else {
+		s.source = s.path
+	}
+	// Expired bans are kept: they carry the IP's offence history
+	s.bans = state.Bans
+	return from, nil
+}
+
+// readState reads a state file, returning the state and the version it
+// was stored as
+func readState(path string) (*models.BanState, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, err
+		}
+		return nil, 0, fmt.Errorf("failed to read ban state: %w", err)
+	}
+	return decodeState(path, data)
+}
+
+// restore reads the newest readable backup in place of a corrupt state
+// file. The corrupt file is kept alongside for inspection.
+func (s *snapshot) restore(cause error) (*models.BanState, int, error) {
+	for i := 1; i <= s.backups; i++ {
+		path := backupPath(s.path, i)
+		state, from, err := readState(path)
+		if err != nil {
+			continue
+		}
+
+		kept := s.path + ".corrupt-" + time.Now().Format("20060102T150405")
+		if err := os.Rename(s.path, kept); err != nil {
+			return nil, 0, fmt.Errorf("%w; failed to move it aside: %v", cause, err)
+		}
+
+		log.Printf("Warning: %v; restored %d entries from %s (corrupt file kept as %s)", cause, len(state.Bans), path, kept)
+		s.source = path
+		return state, from, nil
+	}
+	return nil, 0, fmt.Errorf("%w; no readable backup found, fix or remove the file to start over", cause)
+}
+
+// keepOriginal copies the file a state was loaded from, when of an older
+// version, to <state file>.v<version> before it is rewritten. After a
+// restore that is the backup read, since the state file was moved aside.
+func (s *snapshot) keepOriginal(from int) (string, error) {
+	backup := fmt.Sprintf("%s.v%d", s.path, from)
+	if err := copyFile(s.source, backup); err != nil {
+		return "", fmt.Errorf("failed to back up ban state before upgrading: %w", err)
+	}
+	return backup, nil
+}
+
+// upsert copies entries into the image, so the Manager may keep changing
+// its own
+func (s *snapshot) upsert(bans []*models.BannedIP) {
+	for _, b := range bans {
+		entry := *b
+		s.bans[b.IP] = &entry
+	}
+}
+
+// remove drops entries from the image
+func (s *snapshot) remove(ips []string) {
+	for _, ip := range ips {
+		delete(s.bans, ip)
+	}
+}
+
+// Iterate calls fn for every stored entry, stopping at the first error
+func (s *snapshot) Iterate(fn func(*models.BannedIP) error) error {
+	for _, b := range s.bans {
+		entry := *b
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write replaces the state file with the image, atomically, keeping
+// rotated backups
+func (s *snapshot) write() error {
+	if !s.writable {
+		return fmt.Errorf("ban state %s was opened read-only", s.path)
+	}
+
+	state := &models.BanState{
+		Version:     models.BanStateVersion,
+		LastUpdated: time.Now(),
+		Bans:        s.bans,
+	}
+	// Keep operators in evidence readable ("<" rather than "\u003c")
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(state); err != nil {
+		return fmt.Errorf("failed to marshal ban state: %w", err)
+	}
+
+	if err := writeStateFile(s.path, buf.Bytes(), s.backups); err != nil {
+		return fmt.Errorf("failed to write ban state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package ban
+
+import (
+	"fmt"
+
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// Store persists ban entries. The Manager keeps the working set in memory
+// and hands the store only the entries that changed since the last Save,
+// so a store can write deltas instead of the whole state.
+type Store interface {
+	// Load reads the stored entries, upgrading older formats
+	Load() error
+	// Upsert records new or changed entries
+	Upsert(bans []*models.BannedIP) error
+	// Delete removes entries by IP
+	Delete(ips []string) error
+	// Flush makes the changes recorded since the last Flush durable
+	Flush() error
+	// Iterate calls fn for every stored entry, stopping at the first error
+	Iterate(fn func(*models.BannedIP) error) error
+	// Compact rewrites the stored state in its smallest form
+	Compact() error
+	// Close releases the store's resources
+	Close() error
+}
+
+// openStore creates the store configured for a state file. A read-only
+// store loads and iterates, but fails to flush or compact.
+func openStore(stateFile string, cfg *config.BanConfig, writable bool) (Store, error) {
+	backend := config.StoreJSON
+	if cfg != nil {
+		backend = cfg.GetStore()
+	}
+
+	switch backend {
+	case config.StoreJSON:
+		return newJSONStore(stateFile, cfg, writable), nil
+	case config.StoreJournal:
+		return newJournalStore(stateFile, cfg, writable)
+	}
+	return nil, fmt.Errorf("unknown ban store %q", backend)
+}
@@ -0,0 +1,318 @@
+package ban
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// journalStore appends the changes of each flush to <state file>.journal
+// and folds the journal into the state file, a regular snapshot, once per
+// snapshot interval. In between, a save writes only that cycle's deltas.
+type journalStore struct {
+	snapshot
+	journal    string
+	interval   time.Duration
+	pending    bytes.Buffer // Encoded records not yet flushed
+	unflushed  int          // Records in pending
+	records    int          // Records in the journal since the last snapshot
+	damaged    bool         // A failed append may have left part of a record
+	snapshotAt time.Time
+}
+
+// journalRecord is one line of the journal. Version is the state version
+// the entry is stored as, so that replay can upgrade records written by an
+// older build.
+type journalRecord struct {
+	Version int              `json:"version,omitempty"`
+	Op      string           `json:"op"`
+	IP      string           `json:"ip"`
+	Ban     *models.BannedIP `json:"ban,omitempty"`
+}
+
+// journalFirstVersion is the state version of journal records written
+// before records carried one
+const journalFirstVersion = 3
+
+// Journal operations
+const (
+	opUpsert = "upsert"
+	opDelete = "delete"
+)
+
+// journalPath returns the journal file of a state file
+func journalPath(stateFile string) string {
+	return stateFile + ".journal"
+}
+
+// newJournalStore creates a journal store
+func newJournalStore(stateFile string, cfg *config.BanConfig, writable bool) (*journalStore, error) {
+	interval := config.DefaultSnapshotInterval
+	if cfg != nil {
+		var err error
+		if interval, err = cfg.GetSnapshotInterval(); err != nil {
+			return nil, fmt.Errorf("invalid snapshot interval: %w", err)
+		}
+	}
+	return &journalStore{
+		snapshot: newSnapshot(stateFile, cfg, writable),
+		journal:  journalPath(stateFile),
+		interval: interval,
+	}, nil
+}
+
+// Load reads the snapshot and replays the journal onto it
+func (s *journalStore) Load() error {
+	from, err := s.load()
+	if err != nil {
+		return err
+	}
+	records, torn, err := replayJournal(s.journal, s.bans)
+	if err != nil {
+		return err
+	}
+	s.records = records
+	s.snapshotAt = time.Now()
+	if info, err := os.Stat(s.path); err == nil {
+		s.snapshotAt = info.ModTime()
+	}
+	if !s.writable {
+		return nil
+	}
+
+	switch {
+	case from > 0 && from < models.BanStateVersion:
+		backup, err := s.keepOriginal(from)
+		if err != nil {
+			return err
+		}
+		if err := s.Compact(); err != nil {
+			return fmt.Errorf("failed to upgrade ban state: %w", err)
+		}
+		log.Printf("Upgraded ban state %s from version %d to %d (original kept as %s)",
+			s.path, from, models.BanStateVersion, backup)
+	case torn:
+		// Appending after a partial line would corrupt the next record
+		return s.Compact()
+	}
+	return nil
+}
+
+// Upsert queues new or changed entries for the journal
+func (s *journalStore) Upsert(bans []*models.BannedIP) error {
+	s.upsert(bans)
+	for _, b := range bans {
+		if err := s.append(journalRecord{Op: opUpsert, IP: b.IP, Ban: b}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete queues removals for the journal
+func (s *journalStore) Delete(ips []string) error {
+	s.remove(ips)
+	for _, ip := range ips {
+		if err := s.append(journalRecord{Op: opDelete, IP: ip}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append encodes a record into the pending buffer
+func (s *journalStore) append(r journalRecord) error {
+	r.Version = models.BanStateVersion
+	enc := json.NewEncoder(&s.pending)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(r); err != nil {
+		return fmt.Errorf("failed to encode journal record for %s: %w", r.IP, err)
+	}
+	s.unflushed++
+	return nil
+}
+
+// journalWrite writes to the journal; replaced in tests to fail mid-write
+var journalWrite = (*os.File).Write
+
+// Flush appends the pending records to the journal in one write and syncs
+// it, then compacts when the snapshot interval has passed. A failed append
+// is cut back off the journal and the records stay pending for the next
+// Flush; if the journal cannot be cut back, the next Flush compacts.
+func (s *journalStore) Flush() error {
+	if !s.writable {
+		return fmt.Errorf("ban state %s was opened read-only", s.path)
+	}
+	if s.damaged {
+		return s.Compact()
+	}
+
+	if s.unflushed > 0 {
+		f, err := os.OpenFile(s.journal, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open ban journal: %w", err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to stat ban journal: %w", err)
+		}
+		if err := appendJournal(f, s.pending.Bytes()); err != nil {
+			if terr := f.Truncate(info.Size()); terr != nil {
+				s.damaged = true
+				err = fmt.Errorf("%w; failed to cut it back: %v", err, terr)
+			}
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to close ban journal: %w", err)
+		}
+		if s.records == 0 {
+			syncDir(filepath.Dir(s.journal)) // The journal was just created
+		}
+		s.records += s.unflushed
+		s.pending.Reset()
+		s.unflushed = 0
+	}
+
+	if s.records > 0 && time.Since(s.snapshotAt) >= s.interval {
+		return s.Compact()
+	}
+	return nil
+}
+
+// appendJournal writes records to the end of the journal and syncs it
+func appendJournal(f *os.File, data []byte) error {
+	n, err := journalWrite(f, data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return fmt.Errorf("failed to append to ban journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync ban journal: %w", err)
+	}
+	return nil
+}
+
+// Compact writes a snapshot of every entry, including pending changes, and
+// starts a new journal. A crash between the two steps is harmless: the old
+// journal replays onto the new snapshot to the same result.
+func (s *journalStore) Compact() error {
+	if err := s.write(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.journal); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove ban journal: %w", err)
+	}
+	syncDir(filepath.Dir(s.journal))
+
+	s.pending.Reset()
+	s.unflushed = 0
+	s.records = 0
+	s.damaged = false
+	s.snapshotAt = time.Now()
+	return nil
+}
+
+// Close does nothing: the journal is only open while being appended to
+func (s *journalStore) Close() error {
+	return nil
+}
+
+// replayJournal applies a journal's records to bans in order and returns
+// how many were applied. A record cut short at the end of the file, as a
+// crash mid-append leaves, is dropped and reported as torn; damage
+// anywhere else is corruption.
+func replayJournal(path string, bans map[string]*models.BannedIP) (int, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to read ban journal: %w", err)
+	}
+
+	records := 0
+	for line := 1; len(data) > 0; line++ {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			log.Printf("Warning: ban journal %s ends in an incomplete record, dropping it", path)
+			return records, true, nil
+		}
+		raw := bytes.TrimSpace(data[:i])
+		data = data[i+1:]
+		if len(raw) == 0 {
+			continue
+		}
+
+		r, err := decodeRecord(path, line, raw)
+		if err != nil {
+			return 0, false, err
+		}
+		switch {
+		case r.Op == opUpsert && r.Ban != nil:
+			bans[r.Ban.IP] = r.Ban
+		case r.Op == opDelete:
+			delete(bans, r.IP)
+		default:
+			return 0, false, fmt.Errorf("%w in %s: line %d: invalid %q record", errCorrupt, path, line, r.Op)
+		}
+		records++
+	}
+	return records, false, nil
+}
+
+// decodeRecord parses a journal line, upgrading the entry of a record
+// from an older version the way decodeState upgrades a state file
+func decodeRecord(path string, line int, raw []byte) (journalRecord, error) {
+	var r journalRecord
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return r, fmt.Errorf("%w in %s: line %d: %v", errCorrupt, path, line, err)
+	}
+	if r.Version == 0 {
+		r.Version = journalFirstVersion
+	}
+	if r.Version > models.BanStateVersion {
+		return r, &errNewerVersion{path: path, version: r.Version}
+	}
+	if r.Version == models.BanStateVersion || r.Op != opUpsert {
+		return r, nil
+	}
+
+	// Run the entry through the state migrations as a one-entry document
+	var rec struct {
+		Ban json.RawMessage `json:"ban"`
+	}
+	if err := json.Unmarshal(raw, &rec); err != nil || len(rec.Ban) == 0 {
+		return r, nil // Reported as an invalid record by the caller
+	}
+	doc, err := json.Marshal(map[string]any{
+		"version": r.Version,
+		"bans":    map[string]json.RawMessage{r.IP: rec.Ban},
+	})
+	if err != nil {
+		return r, err
+	}
+	state, _, err := decodeState(path, doc)
+	if err != nil {
+		return r, fmt.Errorf("line %d: %w", line, err)
+	}
+	if b, ok := state.Bans[r.IP]; ok {
+		r.Ban = b
+	} else {
+		// The migration dropped the entry
+		r.Op, r.Ban = opDelete, nil
+	}
+	return r, nil
+}
@@ -0,0 +1,193 @@
+package ban
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+func newTestJournal(t *testing.T, path string) *journalStore {
+	t.Helper()
+	s, err := newJournalStore(path, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testBan(ip string) *models.BannedIP {
+	return &models.BannedIP{IP: ip, BannedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour), BanCount: 1}
+}
+
+// failWrites makes journal writes write half of their data and fail until
+// the test ends
+func failWrites(t *testing.T) {
+	t.Helper()
+	journalWrite = func(f *os.File, b []byte) (int, error) {
+		n, _ := f.Write(b[:len(b)/2])
+		return n, errors.New("disk full")
+	}
+	t.Cleanup(func() { journalWrite = (*os.File).Write })
+}
+
+func TestJournalFailedFlushRetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	s := newTestJournal(t, path)
+
+	if err := s.Upsert([]*models.BannedIP{testBan("10.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Upsert([]*models.BannedIP{testBan("10.0.0.2")}); err != nil {
+		t.Fatal(err)
+	}
+	failWrites(t)
+	if err := s.Flush(); err == nil {
+		t.Fatal("Flush succeeded with a failing write")
+	}
+	journalWrite = (*os.File).Write
+
+	// The partial record was cut back off
+	bans := make(map[string]*models.BannedIP)
+	records, torn, err := replayJournal(journalPath(path), bans)
+	if err != nil || torn || records != 1 {
+		t.Fatalf("after failed flush: records=%d torn=%v err=%v", records, torn, err)
+	}
+
+	if err := s.Delete([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newTestJournal(t, path)
+	if reloaded.records != 3 {
+		t.Errorf("replayed %d records, want 3", reloaded.records)
+	}
+	if _, ok := reloaded.bans["10.0.0.1"]; ok {
+		t.Error("10.0.0.1 was not deleted")
+	}
+	if _, ok := reloaded.bans["10.0.0.2"]; !ok {
+		t.Error("10.0.0.2 from the retried flush is missing")
+	}
+}
+
+func TestJournalDamagedFlushCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	s := newTestJournal(t, path)
+
+	if err := s.Upsert([]*models.BannedIP{testBan("10.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+	// As left by an append that could not be cut back
+	s.damaged = true
+	if err := os.WriteFile(journalPath(path), []byte(`{"op":"ups`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journalPath(path)); !os.IsNotExist(err) {
+		t.Errorf("journal still exists after compacting: %v", err)
+	}
+
+	reloaded := newTestJournal(t, path)
+	if _, ok := reloaded.bans["10.0.0.1"]; !ok {
+		t.Error("10.0.0.1 is missing from the snapshot")
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json.journal")
+	upsert := `{"op":"upsert","ip":"10.0.0.1","ban":{"ip":"10.0.0.1"}}` + "\n"
+	remove := `{"op":"delete","ip":"10.0.0.1"}` + "\n"
+
+	tests := []struct {
+		name    string
+		data    string
+		records int
+		torn    bool
+		corrupt bool
+	}{
+		{"empty", "", 0, false, false},
+		{"records", upsert + remove + upsert, 3, false, false},
+		{"torn tail", upsert + `{"op":"ups`, 1, true, false},
+		{"torn middle", `{"op":"ups` + "\n" + upsert, 0, false, true},
+		{"unknown op", `{"op":"drop","ip":"10.0.0.1"}` + "\n", 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			records, torn, err := replayJournal(path, make(map[string]*models.BannedIP))
+			if tt.corrupt {
+				if !errors.Is(err, errCorrupt) {
+					t.Fatalf("err = %v, want corruption", err)
+				}
+				return
+			}
+			if err != nil || records != tt.records || torn != tt.torn {
+				t.Errorf("records=%d torn=%v err=%v, want %d %v", records, torn, err, tt.records, tt.torn)
+			}
+		})
+	}
+}
+
+func TestReplayJournalVersions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bans.json.journal")
+	v1 := `{"version":1,"op":"upsert","ip":"10.0.0.1","ban":{"ip":"10.0.0.1","banned_at":"2020-01-01T00:00:00Z","expires_at":"0001-01-01T00:00:00Z"}}` + "\n"
+	unversioned := `{"op":"upsert","ip":"10.0.0.2","ban":{"ip":"10.0.0.2","ban_count":2,"is_permanent":true}}` + "\n"
+	if err := os.WriteFile(path, []byte(v1+unversioned), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bans := make(map[string]*models.BannedIP)
+	if _, _, err := replayJournal(path, bans); err != nil {
+		t.Fatal(err)
+	}
+	if b := bans["10.0.0.1"]; b == nil || !b.IsPermanent || b.BanCount != 1 {
+		t.Errorf("version 1 record replayed as %+v, want it upgraded", b)
+	}
+	if b := bans["10.0.0.2"]; b == nil || !b.IsPermanent || b.BanCount != 2 {
+		t.Errorf("unversioned record replayed as %+v", b)
+	}
+
+	newer := `{"version":99,"op":"upsert","ip":"10.0.0.3","ban":{"ip":"10.0.0.3"}}` + "\n"
+	if err := os.WriteFile(path, []byte(newer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var errNewer *errNewerVersion
+	if _, _, err := replayJournal(path, bans); !errors.As(err, &errNewer) {
+		t.Errorf("err = %v, want a newer version error", err)
+	}
+
+	// Records are written with the current version
+	s := newTestJournal(t, filepath.Join(dir, "other.json"))
+	if err := s.Upsert([]*models.BannedIP{testBan("10.0.0.4")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(s.journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r journalRecord
+	if err := json.Unmarshal(data, &r); err != nil || r.Version != models.BanStateVersion {
+		t.Errorf("journal record %s, want version %d", data, models.BanStateVersion)
+	}
+}
@@ -0,0 +1,101 @@
+package ban
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// jsonStore keeps the whole state in one JSON file, rewritten in full on
+// every flush that has changes
+type jsonStore struct {
+	snapshot
+	dirty bool
+}
+
+// newJSONStore creates a JSON file store
+func newJSONStore(stateFile string, cfg *config.BanConfig, writable bool) *jsonStore {
+	return &jsonStore{snapshot: newSnapshot(stateFile, cfg, writable)}
+}
+
+// Load reads the state file. A journal left behind by the journal store is
+// replayed and folded into the file, so switching stores keeps every ban.
+func (s *jsonStore) Load() error {
+	from, err := s.load()
+	if err != nil {
+		return err
+	}
+	journal := journalPath(s.path)
+	records, torn, err := replayJournal(journal, s.bans)
+	if err != nil {
+		return err
+	}
+	if !s.writable {
+		return nil
+	}
+
+	if from > 0 && from < models.BanStateVersion {
+		backup, err := s.keepOriginal(from)
+		if err != nil {
+			return err
+		}
+		if err := s.write(); err != nil {
+			return fmt.Errorf("failed to upgrade ban state: %w", err)
+		}
+		log.Printf("Upgraded ban state %s from version %d to %d (original kept as %s)",
+			s.path, from, models.BanStateVersion, backup)
+	}
+	if records > 0 || torn {
+		if err := s.write(); err != nil {
+			return err
+		}
+		if err := os.Remove(journal); err != nil {
+			return fmt.Errorf("failed to remove ban journal: %w", err)
+		}
+		log.Printf("Folded %d journal records into %s", records, s.path)
+	}
+	return nil
+}
+
+// Upsert records new or changed entries
+func (s *jsonStore) Upsert(bans []*models.BannedIP) error {
+	s.upsert(bans)
+	s.dirty = true
+	return nil
+}
+
+// Delete removes entries by IP
+func (s *jsonStore) Delete(ips []string) error {
+	s.remove(ips)
+	s.dirty = true
+	return nil
+}
+
+// Flush rewrites the state file if anything changed
+func (s *jsonStore) Flush() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.write(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Compact rewrites the state file
+func (s *jsonStore) Compact() error {
+	if err := s.write(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Close does nothing: the file is only open while being written
+func (s *jsonStore) Close() error {
+	return nil
+}
@@ -0,0 +1,285 @@
+// Package blocklist imports third-party lists of ranges to block, such as
+// eMule ipfilter.dat and PeerGuardian P2P files. The lists are kept apart
+// from the ban state: they are enforced through the output file, and never
+// count as offences.
+package blocklist
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/iptrie"
+)
+
+// List is the current content of one blocklist
+type List struct {
+	Name      string
+	Source    string         // URL or file it was read from
+	Prefixes  []netip.Prefix // Ranges to block, minus the whitelist and pardons, sorted
+	UpdatedAt time.Time      // When the content last changed
+}
+
+// list is a configured blocklist and what was last read from it
+type list struct {
+	cfg     config.BlocklistConfig
+	refresh time.Duration
+	timeout time.Duration
+
+	ranges   []Range        // As parsed
+	prefixes []netip.Prefix // ranges minus the exempt ranges, as CIDR prefixes
+
+	loaded    bool
+	updatedAt time.Time // When ranges last changed
+	modTime   time.Time // File lists: modification time last read
+	checkedAt time.Time // URL lists: last successful fetch or revalidation
+	meta      *cacheMeta
+}
+
+// source returns where the list is read from
+func (l *list) source() string {
+	if l.cfg.URL != "" {
+		return l.cfg.URL
+	}
+	return l.cfg.File
+}
+
+// Set holds the configured blocklists. Lists are only read or fetched by
+// Refresh; lookups use what was last read.
+type Set struct {
+	cacheDir  string
+	whitelist []Range
+	pardons   []Range
+	exempt    []Range // whitelist and pardons, merged
+
+	mu    sync.RWMutex
+	lists []*list
+	index *iptrie.Trie[int] // Prefixes of every list, valued with the list's position
+}
+
+// NewSet creates the blocklists of a configuration. Downloads are cached
+// in a blocklists directory next to the state file.
+func NewSet(cfg *config.Config) (*Set, error) {
+	s := &Set{cacheDir: filepath.Join(filepath.Dir(cfg.App.GetStateFile()), "blocklists")}
+	if err := s.Configure(cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Configure applies the blocklists and whitelist of a new configuration.
+// Lists whose source and format are unchanged keep their content.
+// An invalid configuration leaves the set as it was.
+func (s *Set) Configure(cfg *config.Config) error {
+	whitelist := parseWhitelist(cfg.Whitelist.IPs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := make(map[string]*list, len(s.lists))
+	for _, l := range s.lists {
+		old[l.cfg.Name] = l
+	}
+
+	lists := make([]*list, 0, len(cfg.Blocklists))
+	for _, c := range cfg.Blocklists {
+		refresh, err := c.GetRefresh()
+		if err != nil {
+			return fmt.Errorf("blocklist %s: refresh: %w", c.Name, err)
+		}
+		timeout, err := c.GetTimeout()
+		if err != nil {
+			return fmt.Errorf("blocklist %s: timeout: %w", c.Name, err)
+		}
+		l := &list{cfg: c, refresh: refresh, timeout: timeout}
+		if prev := old[c.Name]; prev != nil && prev.source() == l.source() && prev.cfg.Format == c.Format {
+			l.ranges, l.loaded, l.updatedAt = prev.ranges, prev.loaded, prev.updatedAt
+			l.modTime, l.checkedAt, l.meta = prev.modTime, prev.checkedAt, prev.meta
+		}
+		lists = append(lists, l)
+	}
+	s.lists = lists
+	s.whitelist = whitelist
+	s.recarve()
+	return nil
+}
+
+// SetPardons exempts the networks of the pardons in force, as the output
+// of range bans does. Lists are only carved again when they changed.
+func (s *Set) SetPardons(networks []netip.Prefix) {
+	pardons := make([]Range, 0, len(networks))
+	for _, p := range networks {
+		pardons = append(pardons, Range{From: p.Masked().Addr(), To: lastAddr(p)})
+	}
+	pardons = merge(pardons)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.Equal(pardons, s.pardons) {
+		return
+	}
+	s.pardons = pardons
+	s.recarve()
+}
+
+// recarve removes the exempt ranges from every list and rebuilds the
+// index. The caller holds the write lock.
+func (s *Set) recarve() {
+	exempt := append(append([]Range(nil), s.whitelist...), s.pardons...)
+	s.exempt = merge(exempt)
+	for _, l := range s.lists {
+		l.carve(s.exempt)
+	}
+	s.reindex()
+}
+
+// reindex rebuilds the lookup index from the lists. A prefix in several
+// lists keeps the first one configured. The caller holds the write lock.
+func (s *Set) reindex() {
+	index := new(iptrie.Trie[int])
+	for i, l := range s.lists {
+		for _, p := range l.prefixes {
+			if _, exists := index.Get(p); !exists {
+				index.Insert(p, i)
+			}
+		}
+	}
+	s.index = index
+}
+
+// parseWhitelist reads whitelist entries as merged ranges. Invalid entries
+// are ignored, as the detector does.
+func parseWhitelist(entries []string) []Range {
+	var ranges []Range
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if rg, _, err := parseCIDR(entry); err == nil {
+			ranges = append(ranges, rg)
+		}
+	}
+	return merge(ranges)
+}
+
+// carve removes the exempt ranges from the list's ranges
+func (l *list) carve(exempt []Range) {
+	l.prefixes = l.prefixes[:0:0]
+	for _, rg := range subtract(l.ranges, exempt) {
+		l.prefixes = append(l.prefixes, rg.Prefixes()...)
+	}
+}
+
+// Refresh rereads the file lists that changed and fetches the URL lists
+// that are due. A list that fails keeps its previous content.
+func (s *Set) Refresh() {
+	s.refresh(true)
+}
+
+// LoadCached reads the file lists and the cached copies of the URL lists,
+// without fetching anything
+func (s *Set) LoadCached() {
+	s.refresh(false)
+}
+
+// refresh reads the lists, fetching URL lists that are due if fetch is set
+func (s *Set) refresh(fetch bool) {
+	s.mu.RLock()
+	lists := s.lists
+	exempt := s.exempt
+	s.mu.RUnlock()
+
+	now := time.Now()
+	changed := false
+	for _, l := range lists {
+		var ranges []Range
+		var skipped int
+		var err error
+		switch {
+		case l.cfg.URL != "" && fetch:
+			ranges, skipped, err = s.fetch(l, now)
+		case l.cfg.URL != "":
+			ranges, skipped = s.readCached(l)
+		default:
+			ranges, skipped, err = s.readFile(l)
+		}
+		if err != nil {
+			log.Printf("Blocklist %s: %v", l.cfg.Name, err)
+		}
+		if ranges == nil {
+			continue
+		}
+
+		blocked := &list{ranges: ranges}
+		blocked.carve(exempt)
+		s.mu.Lock()
+		l.ranges, l.prefixes = ranges, blocked.prefixes
+		l.loaded = true
+		l.updatedAt = now
+		s.mu.Unlock()
+		changed = true
+
+		msg := fmt.Sprintf("Blocklist %s: %d ranges, %d CIDR prefixes", l.cfg.Name, len(ranges), len(blocked.prefixes))
+		if skipped > 0 {
+			msg += fmt.Sprintf(" (%d unreadable lines skipped)", skipped)
+		}
+		log.Print(msg)
+	}
+
+	if changed {
+		s.mu.Lock()
+		s.reindex()
+		s.mu.Unlock()
+	}
+}
+
+// Contains returns the name of the first list that blocks an IP, "" if
+// none does
+func (s *Set) Contains(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	first := -1
+	s.index.EachContaining(netip.PrefixFrom(addr, addr.BitLen()), func(_ netip.Prefix, i int) bool {
+		if first < 0 || i < first {
+			first = i
+		}
+		return true
+	})
+	if first < 0 {
+		return ""
+	}
+	return s.lists[first].cfg.Name
+}
+
+// Lists returns the content of every list read so far, in configuration
+// order
+func (s *Set) Lists() []List {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lists := make([]List, 0, len(s.lists))
+	for _, l := range s.lists {
+		if !l.loaded {
+			continue
+		}
+		lists = append(lists, List{
+			Name:      l.cfg.Name,
+			Source:    l.source(),
+			Prefixes:  l.prefixes,
+			UpdatedAt: l.updatedAt,
+		})
+	}
+	return lists
+}
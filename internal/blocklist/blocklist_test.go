@@ -0,0 +1,133 @@
+package blocklist
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/philogag/peer-banner/internal/config"
+)
+
+// fileList writes a CIDR file list into dir
+func fileList(t *testing.T, dir, name, content string) config.BlocklistConfig {
+	t.Helper()
+	file := filepath.Join(dir, name+".txt")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return config.BlocklistConfig{Name: name, File: file, Format: config.BlocklistCIDR}
+}
+
+// testConfig is a configuration with a state file in dir
+func testConfig(dir string, whitelist []string, lists ...config.BlocklistConfig) *config.Config {
+	return &config.Config{
+		App:        config.AppConfig{StateFile: filepath.Join(dir, "bans.json")},
+		Whitelist:  config.WhitelistConfig{IPs: whitelist},
+		Blocklists: lists,
+	}
+}
+
+// newTestSet creates a set with one CIDR file list, read from disk
+func newTestSet(t *testing.T, content string, whitelist ...string) *Set {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := NewSet(testConfig(dir, whitelist, fileList(t, dir, "test", content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.LoadCached()
+	return s
+}
+
+func TestContains(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(dir, []string{"10.0.0.128/25", "bad entry"},
+		fileList(t, dir, "first", "10.0.0.0/24\n2001:db8::/32\n"),
+		fileList(t, dir, "second", "10.0.0.0/16\n10.0.0.0/24\n"),
+	)
+	s, err := NewSet(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Contains("10.0.0.1"); got != "" {
+		t.Errorf("Contains before reading = %q", got)
+	}
+	s.LoadCached()
+
+	for ip, want := range map[string]string{
+		"10.0.0.1":        "first",
+		"10.0.0.127":      "first",
+		"10.0.0.128":      "", // Whitelisted from both
+		"10.0.1.1":        "second",
+		"10.1.0.0":        "",
+		"2001:db8:ffff::": "first",
+		"2001:db9::":      "",
+		"::ffff:10.0.0.1": "first",
+		"not an ip":       "",
+	} {
+		if got := s.Contains(ip); got != want {
+			t.Errorf("Contains(%s) = %q, want %q", ip, got, want)
+		}
+	}
+
+	lists := s.Lists()
+	if len(lists) != 2 || lists[0].Name != "first" || lists[1].Name != "second" {
+		t.Fatalf("Lists = %+v", lists)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/25"), netip.MustParsePrefix("2001:db8::/32")}
+	if !slices.Equal(lists[0].Prefixes, want) {
+		t.Errorf("first list prefixes %v, want %v", lists[0].Prefixes, want)
+	}
+
+	// A reload keeps the content of unchanged lists and applies the new
+	// whitelist
+	cfg.Whitelist.IPs = nil
+	if err := s.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Contains("10.0.0.128"); got != "first" {
+		t.Errorf("Contains after dropping the whitelist = %q, want first", got)
+	}
+}
+
+func TestSetPardons(t *testing.T) {
+	s := newTestSet(t, "10.0.0.0/24\n2001:db8::/32\n", "10.0.0.200")
+
+	s.SetPardons([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.5/32"),
+		netip.MustParsePrefix("2001:db8:1::/48"),
+	})
+	for ip, want := range map[string]string{
+		"10.0.0.5":      "",
+		"10.0.0.200":    "",
+		"10.0.0.4":      "test",
+		"10.0.0.6":      "test",
+		"2001:db8:1::1": "",
+		"2001:db8:2::1": "test",
+	} {
+		if got := s.Contains(ip); got != want {
+			t.Errorf("Contains(%s) = %q, want %q", ip, got, want)
+		}
+	}
+	lists := s.Lists()
+	if len(lists) != 1 {
+		t.Fatalf("%d lists", len(lists))
+	}
+	for _, p := range lists[0].Prefixes {
+		if p.Contains(netip.MustParseAddr("10.0.0.5")) || p.Contains(netip.MustParseAddr("2001:db8:1::1")) {
+			t.Errorf("output prefix %s covers a pardoned address", p)
+		}
+	}
+
+	// Once the pardons end, the list blocks the addresses again but the
+	// whitelist stays carved out
+	s.SetPardons(nil)
+	if s.Contains("10.0.0.5") != "test" || s.Contains("2001:db8:1::1") != "test" {
+		t.Error("addresses of ended pardons are still let through")
+	}
+	if s.Contains("10.0.0.200") != "" {
+		t.Error("the whitelist was restored to the list")
+	}
+}
@@ -0,0 +1,211 @@
+package blocklist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxListSize bounds a downloaded list
+const maxListSize = 256 << 20
+
+// cacheMeta describes a cached download, kept as <name>.json next to the
+// cached <name>.dat
+type cacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	CheckedAt    time.Time `json:"checked_at"`
+}
+
+// readFile rereads a file list when it changed since it was last read. It
+// returns nil ranges when there is nothing new.
+func (s *Set) readFile(l *list) ([]Range, int, error) {
+	info, err := os.Stat(l.cfg.File)
+	if err != nil {
+		return nil, 0, err
+	}
+	if l.loaded && info.ModTime().Equal(l.modTime) {
+		return nil, 0, nil
+	}
+	data, err := os.ReadFile(l.cfg.File)
+	if err != nil {
+		return nil, 0, err
+	}
+	ranges, skipped, err := Parse(data, l.cfg.Format)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", l.cfg.File, err)
+	}
+	l.modTime = info.ModTime()
+	return ranges, skipped, nil
+}
+
+// fetch downloads a URL list when its refresh interval has passed since it
+// was last checked, sending the cache validators of the previous download.
+// Until the first successful check the cached copy, if any, is used. It
+// returns nil ranges when there is nothing new.
+func (s *Set) fetch(l *list, now time.Time) ([]Range, int, error) {
+	dataPath, metaPath := s.cachePaths(l)
+
+	// Start from the cache, even a stale one, so that a restart doesn't
+	// depend on the network
+	cached, cachedSkipped := s.readCached(l)
+	if now.Sub(l.checkedAt) < l.refresh {
+		return cached, cachedSkipped, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.cfg.URL, nil)
+	if err != nil {
+		return s.fetchFailed(cached, cachedSkipped, err)
+	}
+	req.Header.Set("User-Agent", "peer-banner")
+	if l.meta != nil && (l.loaded || cached != nil) {
+		if l.meta.ETag != "" {
+			req.Header.Set("If-None-Match", l.meta.ETag)
+		}
+		if l.meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", l.meta.LastModified)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return s.fetchFailed(cached, cachedSkipped, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if l.meta == nil {
+			return s.fetchFailed(cached, cachedSkipped, fmt.Errorf("%s: unexpected %s", l.cfg.URL, resp.Status))
+		}
+		l.checkedAt = now
+		l.meta.CheckedAt = now
+		if err := writeMeta(metaPath, l.meta); err != nil {
+			return s.fetchFailed(cached, cachedSkipped, err)
+		}
+		return cached, cachedSkipped, nil
+	case http.StatusOK:
+	default:
+		return s.fetchFailed(cached, cachedSkipped, fmt.Errorf("%s: %s", l.cfg.URL, resp.Status))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return s.fetchFailed(cached, cachedSkipped, fmt.Errorf("%s: %w", l.cfg.URL, err))
+	}
+	if len(data) > maxListSize {
+		return s.fetchFailed(cached, cachedSkipped, fmt.Errorf("%s: larger than %d MiB", l.cfg.URL, maxListSize>>20))
+	}
+	ranges, skipped, err := Parse(data, l.cfg.Format)
+	if err != nil {
+		return s.fetchFailed(cached, cachedSkipped, fmt.Errorf("%s: %w", l.cfg.URL, err))
+	}
+
+	meta := &cacheMeta{
+		URL:          l.cfg.URL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		CheckedAt:    now,
+	}
+	l.meta, l.checkedAt = meta, now
+	err = os.MkdirAll(s.cacheDir, 0755)
+	if err == nil {
+		err = writeFile(dataPath, data)
+	}
+	if err == nil {
+		err = writeMeta(metaPath, meta)
+	}
+	if err != nil {
+		// The list is used anyway; a restart fetches it again
+		return ranges, skipped, fmt.Errorf("failed to cache: %w", err)
+	}
+	return ranges, skipped, nil
+}
+
+// cachePaths returns where a URL list's download and its metadata are
+// cached
+func (s *Set) cachePaths(l *list) (dataPath, metaPath string) {
+	return filepath.Join(s.cacheDir, l.cfg.Name+".dat"), filepath.Join(s.cacheDir, l.cfg.Name+".json")
+}
+
+// readCached reads the cached copy of a URL list that has not been read
+// or fetched yet. It returns nil ranges when there is none or it is unusable.
+func (s *Set) readCached(l *list) ([]Range, int) {
+	if l.meta != nil {
+		return nil, 0
+	}
+	dataPath, metaPath := s.cachePaths(l)
+	meta, data, err := readCache(metaPath, dataPath)
+	if err != nil || meta.URL != l.cfg.URL {
+		return nil, 0
+	}
+	ranges, skipped, err := Parse(data, l.cfg.Format)
+	if err != nil {
+		return nil, 0
+	}
+	l.meta, l.checkedAt = meta, meta.CheckedAt
+	return ranges, skipped
+}
+
+// fetchFailed keeps the cached ranges, if any were just read, and reports
+// the failure. The list is tried again on the next refresh.
+func (s *Set) fetchFailed(cached []Range, skipped int, err error) ([]Range, int, error) {
+	if cached != nil {
+		return cached, skipped, fmt.Errorf("using the cached copy: %w", err)
+	}
+	return nil, 0, err
+}
+
+// readCache reads a cached download and its metadata
+func readCache(metaPath, dataPath string) (*cacheMeta, []byte, error) {
+	raw, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta cacheMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &meta, data, nil
+}
+
+// writeMeta replaces the metadata of a cached download
+func writeMeta(path string, meta *cacheMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(data, '\n'))
+}
+
+// writeFile replaces path through a temp file renamed into place
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,265 @@
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/philogag/peer-banner/internal/config"
+)
+
+// emuleAllowLevel is the access level from which eMule lets a range
+// through, as with its default filter level
+const emuleAllowLevel = 127
+
+// Range is an inclusive range of addresses of one family
+type Range struct {
+	From, To netip.Addr
+}
+
+// Parse reads a list in one of the blocklist formats, gzipped or not. It
+// returns the blocked ranges, sorted and merged, and the number of lines it
+// could not read. A list with unreadable lines and no valid entry is an
+// error, since it is more likely an error page than an empty list.
+func Parse(data []byte, format string) ([]Range, int, error) {
+	var r io.Reader = bytes.NewReader(data)
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid gzip data: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var parseLine func(string) (Range, bool, error)
+	switch format {
+	case config.BlocklistEmule:
+		parseLine = parseEmule
+	case config.BlocklistP2P:
+		parseLine = parseP2P
+	case config.BlocklistCIDR:
+		parseLine = parseCIDR
+	default:
+		return nil, 0, fmt.Errorf("unknown format %q", format)
+	}
+
+	var ranges []Range
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rg, blocked, err := parseLine(line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if blocked {
+			ranges = append(ranges, rg)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read list: %w", err)
+	}
+	if len(ranges) == 0 && skipped > 0 {
+		return nil, skipped, fmt.Errorf("no valid entries in %d lines", skipped)
+	}
+	if ranges == nil {
+		ranges = []Range{} // An empty list is still a list
+	}
+	return merge(ranges), skipped, nil
+}
+
+// parseEmule reads "start - end , level , description". Ranges at or above
+// eMule's default filter level are allowed rather than blocked.
+func parseEmule(line string) (Range, bool, error) {
+	fields := strings.SplitN(line, ",", 3)
+	rg, err := parseRange(fields[0])
+	if err != nil {
+		return Range{}, false, err
+	}
+	if len(fields) >= 2 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return Range{}, false, fmt.Errorf("invalid level %q", fields[1])
+		}
+		if level >= emuleAllowLevel {
+			return rg, false, nil
+		}
+	}
+	return rg, true, nil
+}
+
+// parseP2P reads "description:start-end". The description may itself
+// contain colons.
+func parseP2P(line string) (Range, bool, error) {
+	i := strings.LastIndexByte(line, ':')
+	if i < 0 {
+		return Range{}, false, fmt.Errorf("missing ':'")
+	}
+	rg, err := parseRange(line[i+1:])
+	return rg, err == nil, err
+}
+
+// parseCIDR reads an IP or a CIDR range, with an optional trailing comment
+func parseCIDR(line string) (Range, bool, error) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if strings.Contains(line, "/") {
+		p, err := netip.ParsePrefix(line)
+		if err != nil {
+			return Range{}, false, err
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		p = p.Masked()
+		return Range{p.Addr(), lastAddr(p)}, true, nil
+	}
+	ip, err := parseAddr(line)
+	if err != nil {
+		return Range{}, false, err
+	}
+	return Range{ip, ip}, true, nil
+}
+
+// parseRange reads "start - end"
+func parseRange(s string) (Range, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return Range{}, fmt.Errorf("missing '-' in range %q", s)
+	}
+	start, err := parseAddr(from)
+	if err != nil {
+		return Range{}, err
+	}
+	end, err := parseAddr(to)
+	if err != nil {
+		return Range{}, err
+	}
+	if start.BitLen() != end.BitLen() || end.Less(start) {
+		return Range{}, fmt.Errorf("invalid range %q", s)
+	}
+	return Range{start, end}, nil
+}
+
+// parseAddr parses an address, accepting the zero-padded IPv4 octets of
+// ipfilter.dat such as 001.009.096.105
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if ip, err := netip.ParseAddr(s); err == nil {
+		return ip.Unmap().WithZone(""), nil
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return netip.Addr{}, fmt.Errorf("invalid address %q", s)
+	}
+	var b [4]byte
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil || len(part) > 3 {
+			return netip.Addr{}, fmt.Errorf("invalid address %q", s)
+		}
+		b[i] = byte(n)
+	}
+	return netip.AddrFrom4(b), nil
+}
+
+// merge sorts ranges and joins those that overlap or touch
+func merge(ranges []Range) []Range {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].From.Less(ranges[j].From) })
+	merged := ranges[:0]
+	for _, rg := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next := last.To.Next()
+			if last.To.BitLen() == rg.From.BitLen() && (!next.IsValid() || !next.Less(rg.From)) {
+				if last.To.Less(rg.To) {
+					last.To = rg.To
+				}
+				continue
+			}
+		}
+		merged = append(merged, rg)
+	}
+	return merged
+}
+
+// subtract removes the ranges in cut from ranges. Both must be sorted and
+// merged.
+func subtract(ranges, cut []Range) []Range {
+	if len(cut) == 0 {
+		return ranges
+	}
+	out := make([]Range, 0, len(ranges))
+	j := 0
+	for _, rg := range ranges {
+		for j < len(cut) && cut[j].To.Less(rg.From) {
+			j++
+		}
+		for k := j; k < len(cut) && !rg.To.Less(cut[k].From); k++ {
+			c := cut[k]
+			if rg.From.Less(c.From) {
+				out = append(out, Range{rg.From, c.From.Prev()})
+			}
+			if !c.To.Less(rg.To) {
+				rg = Range{}
+				break
+			}
+			if c.To.Less(rg.From) {
+				continue
+			}
+			rg.From = c.To.Next()
+		}
+		if rg.From.IsValid() {
+			out = append(out, rg)
+		}
+	}
+	return out
+}
+
+// Prefixes returns the fewest CIDR prefixes covering exactly a range
+func (r Range) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	from := r.From
+	for {
+		// The shortest prefix starting at from that stays within the range
+		bits := from.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(from, bits-1)
+			if p.Masked().Addr() != from || r.To.Less(lastAddr(p)) {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(from, bits)
+		prefixes = append(prefixes, p)
+		last := lastAddr(p)
+		if last == r.To {
+			return prefixes
+		}
+		from = last.Next()
+	}
+}
+
+// lastAddr returns the last address of a prefix
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	ip, _ := netip.AddrFromSlice(b)
+	return ip
+}
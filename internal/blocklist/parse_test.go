@@ -0,0 +1,306 @@
+package blocklist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/philogag/peer-banner/internal/config"
+)
+
+// rg builds a range from two addresses
+func rg(from, to string) Range {
+	return Range{netip.MustParseAddr(from), netip.MustParseAddr(to)}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		want    []Range
+		skipped int
+		err     bool
+	}{
+		{
+			name:   "emule zero-padded",
+			format: config.BlocklistEmule,
+			data:   "001.009.096.105 - 001.009.096.105 , 000 , Some org\n",
+			want:   []Range{rg("1.9.96.105", "1.9.96.105")},
+		},
+		{
+			name:   "emule allow level",
+			format: config.BlocklistEmule,
+			data:   "1.0.0.0 - 1.0.0.255 , 100 , blocked\n2.0.0.0 - 2.0.0.255 , 127 , allowed\n3.0.0.0 - 3.0.0.255 , 200 , allowed\n",
+			want:   []Range{rg("1.0.0.0", "1.0.0.255")},
+		},
+		{
+			name:   "emule without level",
+			format: config.BlocklistEmule,
+			data:   "1.0.0.0 - 1.0.0.255\n",
+			want:   []Range{rg("1.0.0.0", "1.0.0.255")},
+		},
+		{
+			name:    "emule bad lines",
+			format:  config.BlocklistEmule,
+			data:    "# comment\n// comment\n\n1.0.0.0 - 1.0.0.255 , x , bad level\n1.0.0.9 - 1.0.0.1 , 0 , reversed\n1.0.0.0 - ::1 , 0 , mixed\n4.0.0.0 - 4.0.0.1 , 0 , ok\n",
+			want:    []Range{rg("4.0.0.0", "4.0.0.1")},
+			skipped: 3,
+		},
+		{
+			name:   "p2p",
+			format: config.BlocklistP2P,
+			data:   "Some org:1.2.3.0-1.2.3.255\nOrg: with: colons:5.6.7.8-5.6.7.8\n",
+			want:   []Range{rg("1.2.3.0", "1.2.3.255"), rg("5.6.7.8", "5.6.7.8")},
+		},
+		{
+			name:    "p2p missing colon",
+			format:  config.BlocklistP2P,
+			data:    "1.2.3.0-1.2.3.255\nok:9.9.9.9-9.9.9.9\n",
+			want:    []Range{rg("9.9.9.9", "9.9.9.9")},
+			skipped: 1,
+		},
+		{
+			name:   "cidr",
+			format: config.BlocklistCIDR,
+			data:   "10.0.0.0/8\n192.168.1.7 # a host\n2001:db8::/32\n",
+			want: []Range{
+				rg("10.0.0.0", "10.255.255.255"),
+				rg("192.168.1.7", "192.168.1.7"),
+				rg("2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"),
+			},
+		},
+		{
+			name:   "cidr unmasked and mapped",
+			format: config.BlocklistCIDR,
+			data:   "172.16.5.9/12\n::ffff:10.1.0.0/112\n::ffff:1.2.3.4\n",
+			want: []Range{
+				rg("1.2.3.4", "1.2.3.4"),
+				rg("10.1.0.0", "10.1.255.255"),
+				rg("172.16.0.0", "172.31.255.255"),
+			},
+		},
+		{
+			name:   "cidr whole spaces",
+			format: config.BlocklistCIDR,
+			data:   "0.0.0.0/0\n::/0\n",
+			want:   []Range{rg("0.0.0.0", "255.255.255.255"), rg("::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")},
+		},
+		{
+			name:   "empty",
+			format: config.BlocklistCIDR,
+			data:   "# nothing yet\n",
+			want:   []Range{},
+		},
+		{
+			name:   "error page",
+			format: config.BlocklistCIDR,
+			data:   "<html>\n<body>Not found</body>\n</html>\n",
+			err:    true,
+		},
+		{
+			name:   "unknown format",
+			format: "dat",
+			data:   "1.2.3.4\n",
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skipped, err := Parse([]byte(tt.data), tt.format)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("Parse = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) || skipped != tt.skipped {
+				t.Errorf("Parse = %v, %d skipped; want %v, %d skipped", got, skipped, tt.want, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestParseGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("Some org:1.2.3.0-1.2.3.255\n"))
+	gz.Close()
+
+	got, _, err := Parse(buf.Bytes(), config.BlocklistP2P)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Range{rg("1.2.3.0", "1.2.3.255")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse = %v, want %v", got, want)
+	}
+	if _, _, err := Parse([]byte{0x1f, 0x8b, 0}, config.BlocklistP2P); err == nil {
+		t.Error("truncated gzip data was accepted")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []Range
+		want []Range
+	}{
+		{"empty", nil, []Range{}},
+		{
+			"overlapping",
+			[]Range{rg("10.0.0.50", "10.0.0.200"), rg("10.0.0.0", "10.0.0.100")},
+			[]Range{rg("10.0.0.0", "10.0.0.200")},
+		},
+		{
+			"touching",
+			[]Range{rg("10.0.0.0", "10.0.0.9"), rg("10.0.0.10", "10.0.0.20")},
+			[]Range{rg("10.0.0.0", "10.0.0.20")},
+		},
+		{
+			"one apart",
+			[]Range{rg("10.0.0.0", "10.0.0.9"), rg("10.0.0.11", "10.0.0.20")},
+			[]Range{rg("10.0.0.0", "10.0.0.9"), rg("10.0.0.11", "10.0.0.20")},
+		},
+		{
+			"nested",
+			[]Range{rg("10.0.0.0", "10.0.0.255"), rg("10.0.0.5", "10.0.0.6")},
+			[]Range{rg("10.0.0.0", "10.0.0.255")},
+		},
+		{
+			"end of the address space",
+			[]Range{rg("255.255.255.0", "255.255.255.255"), rg("255.255.255.255", "255.255.255.255")},
+			[]Range{rg("255.255.255.0", "255.255.255.255")},
+		},
+		{
+			"families kept apart",
+			[]Range{rg("::", "::ffff"), rg("255.255.255.255", "255.255.255.255"), rg("0.0.0.0", "0.0.0.1")},
+			[]Range{rg("0.0.0.0", "0.0.0.1"), rg("255.255.255.255", "255.255.255.255"), rg("::", "::ffff")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := merge(append([]Range{}, tt.in...))
+			if len(got) != len(tt.want) || len(got) > 0 && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merge = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtract(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []Range
+		cut    []Range
+		want   []Range
+	}{
+		{
+			"no cut",
+			[]Range{rg("10.0.0.0", "10.0.0.255")},
+			nil,
+			[]Range{rg("10.0.0.0", "10.0.0.255")},
+		},
+		{
+			"middle",
+			[]Range{rg("10.0.0.0", "10.0.0.255")},
+			[]Range{rg("10.0.0.5", "10.0.0.5")},
+			[]Range{rg("10.0.0.0", "10.0.0.4"), rg("10.0.0.6", "10.0.0.255")},
+		},
+		{
+			"edges",
+			[]Range{rg("10.0.0.0", "10.0.0.255")},
+			[]Range{rg("9.0.0.0", "10.0.0.0"), rg("10.0.0.255", "11.0.0.0")},
+			[]Range{rg("10.0.0.1", "10.0.0.254")},
+		},
+		{
+			"whole range",
+			[]Range{rg("10.0.0.0", "10.0.0.255"), rg("10.0.2.0", "10.0.2.255")},
+			[]Range{rg("10.0.0.0", "10.0.1.255")},
+			[]Range{rg("10.0.2.0", "10.0.2.255")},
+		},
+		{
+			"several cuts in one range",
+			[]Range{rg("10.0.0.0", "10.0.0.255")},
+			[]Range{rg("10.0.0.10", "10.0.0.19"), rg("10.0.0.30", "10.0.0.39")},
+			[]Range{rg("10.0.0.0", "10.0.0.9"), rg("10.0.0.20", "10.0.0.29"), rg("10.0.0.40", "10.0.0.255")},
+		},
+		{
+			"one cut across two ranges",
+			[]Range{rg("10.0.0.0", "10.0.0.99"), rg("10.0.0.200", "10.0.0.255")},
+			[]Range{rg("10.0.0.50", "10.0.0.219")},
+			[]Range{rg("10.0.0.0", "10.0.0.49"), rg("10.0.0.220", "10.0.0.255")},
+		},
+		{
+			"disjoint",
+			[]Range{rg("10.0.0.0", "10.0.0.255")},
+			[]Range{rg("9.0.0.0", "9.255.255.255"), rg("11.0.0.0", "11.0.0.1")},
+			[]Range{rg("10.0.0.0", "10.0.0.255")},
+		},
+		{
+			"end of the address space",
+			[]Range{rg("255.255.255.0", "255.255.255.255")},
+			[]Range{rg("255.255.255.255", "255.255.255.255")},
+			[]Range{rg("255.255.255.0", "255.255.255.254")},
+		},
+		{
+			"ipv6",
+			[]Range{rg("10.0.0.0", "10.0.0.255"), rg("2001:db8::", "2001:db8::ffff")},
+			[]Range{rg("2001:db8::100", "2001:db8::1ff")},
+			[]Range{rg("10.0.0.0", "10.0.0.255"), rg("2001:db8::", "2001:db8::ff"), rg("2001:db8::200", "2001:db8::ffff")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := subtract(tt.ranges, tt.cut); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("subtract = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangePrefixes(t *testing.T) {
+	tests := []struct {
+		r    Range
+		want []string
+	}{
+		{rg("10.0.0.7", "10.0.0.7"), []string{"10.0.0.7/32"}},
+		{rg("10.0.0.0", "10.0.0.255"), []string{"10.0.0.0/24"}},
+		{rg("10.0.0.1", "10.0.0.6"), []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.6/32"}},
+		{rg("10.0.0.0", "10.0.1.0"), []string{"10.0.0.0/24", "10.0.1.0/32"}},
+		{rg("0.0.0.0", "255.255.255.255"), []string{"0.0.0.0/0"}},
+		{rg("255.255.255.254", "255.255.255.255"), []string{"255.255.255.254/31"}},
+		{rg("::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), []string{"::/0"}},
+		{rg("2001:db8::1", "2001:db8::3"), []string{"2001:db8::1/128", "2001:db8::2/127"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, p := range tt.r.Prefixes() {
+			got = append(got, p.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v.Prefixes() = %v, want %v", tt.r, got, tt.want)
+		}
+	}
+}
+
+// Splitting a range into prefixes covers exactly the range
+func TestRangePrefixesCover(t *testing.T) {
+	r := rg("10.0.0.3", "10.0.3.17")
+	prefixes := r.Prefixes()
+	for i, p := range prefixes {
+		if i > 0 && lastAddr(prefixes[i-1]).Next() != p.Addr() {
+			t.Fatalf("gap or overlap before %s", p)
+		}
+		if p.Masked() != p {
+			t.Errorf("%s is not masked", p)
+		}
+	}
+	if prefixes[0].Addr() != r.From || lastAddr(prefixes[len(prefixes)-1]) != r.To {
+		t.Errorf("prefixes %v don't span %v", prefixes, r)
+	}
+}
@@ -1,9 +1,14 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/philogag/peer-banner/internal/units"
 	"gopkg.in/yaml.v3"
 )
 
@@ -14,21 +19,33 @@ const (
 
 // Config represents the application configuration
 type Config struct {
-	App       AppConfig       `yaml:"app"`
-	Servers   []ServerConfig  `yaml:"servers"`
-	Whitelist WhitelistConfig `yaml:"whitelist"`
-	Output    OutputConfig    `yaml:"output"`
-	Rules     []RuleConfig    `yaml:"rules"`
+	App        AppConfig         `yaml:"app"`
+	Servers    []ServerConfig    `yaml:"servers"`
+	Whitelist  WhitelistConfig   `yaml:"whitelist"`
+	Ban        BanConfig         `yaml:"ban"`
+	Safety     SafetyConfig      `yaml:"safety"`
+	Blocklists []BlocklistConfig `yaml:"blocklists"`
+	Output     OutputConfig      `yaml:"output"`
+	Rules      []RuleConfig      `yaml:"rules"`
+	Include    []string          `yaml:"include"` // Rule files or globs, relative to this file
 }
 
 // AppConfig contains application-level settings
 type AppConfig struct {
-	Interval   int    `yaml:"interval"`
-	LogLevel   string `yaml:"log_level"`
-	DryRun     bool   `yaml:"dry_run"`
-	StateFile  string `yaml:"state_file"`
+	Interval       int    `yaml:"interval"`
+	LogLevel       string `yaml:"log_level"`
+	DryRun         bool   `yaml:"dry_run"`
+	StateFile      string `yaml:"state_file"`
+	RuleResolution string `yaml:"rule_resolution"` // How to pick a rule when several match
 }
 
+// Rule resolution strategies
+const (
+	ResolveFirstMatch      = "first-match"      // First match by priority, then file order (default)
+	ResolveMostSevere      = "most-severe"      // Rule with the harshest possible penalty
+	ResolveLongestDuration = "longest-duration" // Rule giving this offence the longest ban
+)
+
 // ServerConfig represents a qBittorrent server
 type ServerConfig struct {
 	Name     string `yaml:"name"`
@@ -42,27 +59,322 @@ type WhitelistConfig struct {
 	IPs []string `yaml:"ips"`
 }
 
+// BanConfig contains ban bookkeeping settings
+type BanConfig struct {
+	DecayInterval string `yaml:"decay_interval"` // Forgive one offence per clean interval, e.g. 30d
+	Backups       int    `yaml:"backups"`        // Rotated copies of the state file to keep (default 3, -1 = none)
+	OnCorrupt     string `yaml:"on_corrupt"`     // restore (default) or refuse
+	Store         string `yaml:"store"`          // json (default) or journal
+
+	SnapshotInterval string `yaml:"snapshot_interval"` // journal store: how often to compact into a snapshot (default 1h)
+
+	Audit AuditConfig `yaml:"audit"`
+
+	// Lift bans made by rules that were removed or disabled, at startup and
+	// on reload. Bans of whitelisted IPs are always lifted.
+	LiftOrphaned bool `yaml:"lift_orphaned"`
+}
+
+// AuditConfig controls the log of ban events
+type AuditConfig struct {
+	File      string `yaml:"file"`      // Default: the state file name plus .audit.jsonl
+	Retention string `yaml:"retention"` // How long events are kept (default 90d, 0 = forever)
+}
+
+// DefaultAuditRetention is how long audit events are kept by default
+const DefaultAuditRetention = 90 * units.Day
+
+// Ban state storage backends
+const (
+	StoreJSON    = "json"    // Rewrite the whole state file on every save
+	StoreJournal = "journal" // Append changes to a journal, snapshot periodically
+)
+
+// DefaultSnapshotInterval is how often the journal store compacts by default
+const DefaultSnapshotInterval = time.Hour
+
+// Corrupt state file handling
+const (
+	CorruptRestore = "restore" // Start from the newest readable backup
+	CorruptRefuse  = "refuse"  // Refuse to start until the file is fixed
+)
+
+// SafetyConfig limits how many bans a detection run may make, against
+// rules that misfire
+type SafetyConfig struct {
+	MaxBansPerCycle int         `yaml:"max_bans_per_cycle"` // New bans per cycle, across all servers, before enforcement freezes (0 = unlimited)
+	MaxBansPerRule  int         `yaml:"max_bans_per_rule"`  // New bans per rule and cycle, across all servers, before the rule trips (0 = unlimited)
+	Alert           AlertConfig `yaml:"alert"`
+}
+
+// AlertConfig configures the command told when a limit trips
+type AlertConfig struct {
+	Command []string `yaml:"command"` // Executable and arguments, run without a shell with the alert as JSON on stdin
+	Timeout string   `yaml:"timeout"` // e.g. "10s" (default 30s)
+}
+
+// GetTimeout returns the alert command timeout
+func (a *AlertConfig) GetTimeout() (time.Duration, error) {
+	if a.Timeout == "" {
+		return DefaultExternalTimeout, nil
+	}
+	return units.ParseDuration(a.Timeout)
+}
+
+// GetMaxBans returns how many bans a rule may make per cycle
+// before it trips, 0 meaning unlimited
+func (s *SafetyConfig) GetMaxBans(r *RuleConfig) int {
+	switch {
+	case r.MaxBans < 0:
+		return 0
+	case r.MaxBans > 0:
+		return r.MaxBans
+	}
+	return s.MaxBansPerRule
+}
+
+// BlocklistConfig is a third-party list of ranges to block, enforced
+// through the output file next to the bans
+type BlocklistConfig struct {
+	Name    string `yaml:"name"`    // Tags the list's entries; also names its cache file
+	URL     string `yaml:"url"`     // Fetch the list over HTTP(S)...
+	File    string `yaml:"file"`    // ...or read it from disk, relative to the config file
+	Format  string `yaml:"format"`  // emule, p2p or cidr
+	Refresh string `yaml:"refresh"` // How often to fetch a URL, e.g. 12h (default 24h)
+	Timeout string `yaml:"timeout"` // Download timeout (default 60s)
+}
+
+// Blocklist formats
+const (
+	BlocklistEmule = "emule" // eMule ipfilter.dat: "start - end , level , description"
+	BlocklistP2P   = "p2p"   // PeerGuardian text: "description:start-end"
+	BlocklistCIDR  = "cidr"  // One IP or CIDR range per line
+)
+
+// Blocklist defaults
+const (
+	DefaultBlocklistRefresh = 24 * time.Hour
+	DefaultBlocklistTimeout = time.Minute
+)
+
+// GetRefresh returns how often a URL list is fetched
+func (b *BlocklistConfig) GetRefresh() (time.Duration, error) {
+	if strings.TrimSpace(b.Refresh) == "" {
+		return DefaultBlocklistRefresh, nil
+	}
+	d, err := units.ParseDuration(b.Refresh)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return d, nil
+}
+
+// GetTimeout returns the download timeout of a URL list
+func (b *BlocklistConfig) GetTimeout() (time.Duration, error) {
+	if strings.TrimSpace(b.Timeout) == "" {
+		return DefaultBlocklistTimeout, nil
+	}
+	return units.ParseDuration(b.Timeout)
+}
+
+// validate checks a blocklist entry
+func (b *BlocklistConfig) validate() error {
+	// The name becomes a file name in the cache directory
+	if strings.HasPrefix(b.Name, ".") {
+		return fmt.Errorf("name must not start with '.'")
+	}
+	for _, c := range b.Name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("name may only use letters, digits, '-', '_' and '.'")
+		}
+	}
+	if (b.URL == "") == (b.File == "") {
+		return fmt.Errorf("needs exactly one of url or file")
+	}
+	switch b.Format {
+	case BlocklistEmule, BlocklistP2P, BlocklistCIDR:
+	default:
+		return fmt.Errorf("unknown format %q (use %s, %s or %s)", b.Format, BlocklistEmule, BlocklistP2P, BlocklistCIDR)
+	}
+	if _, err := b.GetRefresh(); err != nil {
+		return fmt.Errorf("refresh: %w", err)
+	}
+	if _, err := b.GetTimeout(); err != nil {
+		return fmt.Errorf("timeout: %w", err)
+	}
+	return nil
+}
+
+// DefaultBackups is the number of state file backups kept by default
+const DefaultBackups = 3
+
 // OutputConfig defines DAT output settings
 type OutputConfig struct {
 	DATFile string `yaml:"dat_file"`
 	Format  string `yaml:"format"`
 }
 
+// Rule types
+const (
+	RuleTypeAll      = "all"      // Every filter must match (default)
+	RuleTypeScoring  = "scoring"  // Weights of matched filters are summed against a threshold
+	RuleTypeExternal = "external" // Peers matching the filters are sent to a command that decides
+)
+
+// External rule failure handling
+const (
+	FailOpen   = "open"   // Ban nobody when the command fails (default)
+	FailClosed = "closed" // Ban every candidate when the command fails
+)
+
+// DefaultExternalTimeout bounds how long an external command may run
+const DefaultExternalTimeout = 30 * time.Second
+
+// ExternalConfig configures the command behind an external rule
+type ExternalConfig struct {
+	Command   []string `yaml:"command"`    // Executable and arguments, run without a shell
+	Timeout   string   `yaml:"timeout"`    // e.g. "10s" (default 30s)
+	OnFailure string   `yaml:"on_failure"` // open (default) or closed
+}
+
+// GetTimeout returns the command timeout
+func (e *ExternalConfig) GetTimeout() (time.Duration, error) {
+	if e.Timeout == "" {
+		return DefaultExternalTimeout, nil
+	}
+	return units.ParseDuration(e.Timeout)
+}
+
+// GetOnFailure returns the failure mode, defaulting to open
+func (e *ExternalConfig) GetOnFailure() string {
+	if e.OnFailure == "" {
+		return FailOpen
+	}
+	return e.OnFailure
+}
+
 // RuleConfig represents a leecher detection rule
 type RuleConfig struct {
-	Name         string        `yaml:"name"`
-	Enabled      bool          `yaml:"enabled"`
-	Action       string        `yaml:"action"`
-	BanDuration  string        `yaml:"ban_duration"`
-	MaxBanCount  int           `yaml:"max_ban_count"`
-	Filters      []FilterConfig `yaml:"filter"`
+	Name        string           `yaml:"name"`
+	Enabled     bool             `yaml:"enabled"`
+	Priority    int              `yaml:"priority"`  // Higher priorities are evaluated first
+	Type        string           `yaml:"type"`      // all (default), scoring or external
+	Threshold   float64          `yaml:"threshold"` // Score needed to ban, for scoring rules
+	Action      string           `yaml:"action"`
+	BanDuration string           `yaml:"ban_duration"`
+	MaxBanCount int              `yaml:"max_ban_count"`
+	MaxBans     int              `yaml:"max_bans_per_cycle"` // Overrides safety.max_bans_per_rule (0 = that, -1 = unlimited)
+	Escalation  EscalationConfig `yaml:"escalation"`
+	Servers     []string         `yaml:"servers"`    // Only apply on these servers (empty = all)
+	Categories  []string         `yaml:"categories"` // Only apply to torrents in these categories (empty = all)
+	Tags        []string         `yaml:"tags"`       // Only apply to torrents with any of these tags (empty = all)
+	Schedule    *ScheduleConfig  `yaml:"schedule"`   // Only active inside these windows (nil = always)
+	Filters     []FilterConfig   `yaml:"filter"`
+	External    *ExternalConfig  `yaml:"external"` // Command deciding external rules
+	Examples    []ExampleConfig  `yaml:"examples"` // Fixtures the rule must classify correctly
+
+	// A preset entry expands into the preset's rules instead of being a rule
+	Preset        string               `yaml:"preset"`         // Built-in preset name, e.g. known_leechers
+	PresetVersion int                  `yaml:"preset_version"` // Fail to load if the preset is another version (0 = any)
+	Overrides     map[string]yaml.Node `yaml:"overrides"`      // Per-rule fields replacing the preset's
+
+	Source string `yaml:"-"` // File the rule was defined in
+
+	keys []string // Keys set in the YAML, kept for preset entries
+}
+
+// UnmarshalYAML decodes a rule, noting the keys a preset entry sets so
+// that keys it can't take are reported rather than ignored
+func (r *RuleConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain RuleConfig
+	if err := node.Decode((*plain)(r)); err != nil {
+		return err
+	}
+	if r.Preset != "" && node.Kind == yaml.MappingNode {
+		r.keys = r.keys[:0]
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			r.keys = append(r.keys, node.Content[i].Value)
+		}
+	}
+	return nil
+}
+
+// Label names the rule and the file it came from, for error messages
+func (r *RuleConfig) Label() string {
+	if r.Source == "" {
+		return strconv.Quote(r.Name)
+	}
+	return fmt.Sprintf("%q (%s)", r.Name, r.Source)
+}
+
+// Example expectations
+const (
+	ExpectMatch   = "match"
+	ExpectNoMatch = "no_match"
+)
+
+// ExampleConfig is a peer and torrent fixture with the verdict a rule is
+// expected to reach. Sizes and durations use the same grammar as filters.
+type ExampleConfig struct {
+	Name    string         `yaml:"name"`
+	Expect  string         `yaml:"expect"` // match or no_match
+	Peer    PeerFixture    `yaml:"peer"`
+	Torrent TorrentFixture `yaml:"torrent"`
+}
+
+// PeerFixture describes a peer in a rule example
+type PeerFixture struct {
+	IP         string `yaml:"ip"`
+	Port       int    `yaml:"port"`
+	Client     string `yaml:"client"`
+	PeerID     string `yaml:"peer_id"` // e.g. "-XL0019-"
+	Flags      string `yaml:"flags"`
+	Progress   string `yaml:"progress"`    // 0-100, e.g. "99.5" or "99.5%"
+	Uploaded   string `yaml:"uploaded"`    // e.g. "10MiB"
+	Downloaded string `yaml:"downloaded"`  // e.g. "2GiB"
+	Relevance  string `yaml:"relevance"`   // 0-1
+	ActiveTime string `yaml:"active_time"` // e.g. "25h"
+}
+
+// TorrentFixture describes a torrent in a rule example
+type TorrentFixture struct {
+	Name     string `yaml:"name"`
+	Size     string `yaml:"size"` // e.g. "4GiB"
+	Category string `yaml:"category"`
+	Tags     string `yaml:"tags"` // Comma separated, as qBittorrent reports them
+}
+
+// ScheduleConfig limits a rule to time windows
+type ScheduleConfig struct {
+	Timezone string         `yaml:"timezone"` // IANA name, e.g. Asia/Shanghai (default: local time)
+	Windows  []WindowConfig `yaml:"windows"`
+}
+
+// WindowConfig is a daily time range on selected weekdays. A range whose
+// end is before its start runs past midnight into the next day.
+type WindowConfig struct {
+	Days  []string `yaml:"days"`  // mon, tue, ... sun (empty = every day)
+	Start string   `yaml:"start"` // HH:MM, inclusive
+	End   string   `yaml:"end"`   // HH:MM, exclusive
+}
+
+// EscalationConfig defines graduated ban durations for repeat offences.
+// Either a ladder or a multiplier may be set, not both.
+type EscalationConfig struct {
+	Ladder      []string `yaml:"ladder"`       // Duration per offence, e.g. [1h, 6h, 1d, 7d, permanent]
+	Multiplier  float64  `yaml:"multiplier"`   // Each repeat offence multiplies ban_duration
+	MaxDuration string   `yaml:"max_duration"` // Cap for multiplier growth
 }
 
 // FilterConfig defines a single filter condition
 type FilterConfig struct {
-	Field    string `yaml:"field"`
-	Operator string `yaml:"operator"` // <, >, <=, >=, include, exclude
-	Value    string `yaml:"value"`
+	Field    string   `yaml:"field"`
+	Operator string   `yaml:"operator"` // <, >, <=, >=, include, exclude
+	Value    string   `yaml:"value"`
+	Weight   *float64 `yaml:"weight"` // Score contribution in scoring rules, default 1; 0 is allowed
 }
 
 // GetInterval returns the check interval as a duration
@@ -73,6 +385,14 @@ func (a *AppConfig) GetInterval() time.Duration {
 	return time.Duration(a.Interval) * time.Minute
 }
 
+// GetRuleResolution returns the rule resolution strategy
+func (a *AppConfig) GetRuleResolution() string {
+	if a.RuleResolution == "" {
+		return ResolveFirstMatch
+	}
+	return a.RuleResolution
+}
+
 // GetStateFile returns the state file path
 func (a *AppConfig) GetStateFile() string {
 	if a.StateFile == "" {
@@ -81,12 +401,179 @@ func (a *AppConfig) GetStateFile() string {
 	return a.StateFile
 }
 
-// GetBanDuration returns the ban duration as a duration
+// GetType returns the rule type, defaulting to all
+func (r *RuleConfig) GetType() string {
+	if r.Type == "" {
+		return RuleTypeAll
+	}
+	return r.Type
+}
+
+// GetWeight returns the filter weight, defaulting to 1 when unset. An
+// explicit 0 is kept, so a filter can be matched without scoring.
+func (f *FilterConfig) GetWeight() float64 {
+	if f.Weight == nil {
+		return 1
+	}
+	return *f.Weight
+}
+
+// GetDecayInterval returns how long an IP must stay clean to have one
+// offence forgiven, 0 meaning offences are never forgiven
+func (b *BanConfig) GetDecayInterval() (time.Duration, error) {
+	if strings.TrimSpace(b.DecayInterval) == "" {
+		return 0, nil
+	}
+	return units.ParseDuration(b.DecayInterval)
+}
+
+// GetBackups returns how many state file backups to keep
+func (b *BanConfig) GetBackups() int {
+	switch {
+	case b.Backups == 0:
+		return DefaultBackups
+	case b.Backups < 0:
+		return 0
+	}
+	return b.Backups
+}
+
+// GetOnCorrupt returns how to handle a corrupt state file
+func (b *BanConfig) GetOnCorrupt() string {
+	if b.OnCorrupt == "" {
+		return CorruptRestore
+	}
+	return b.OnCorrupt
+}
+
+// GetStore returns the ban state storage backend
+func (b *BanConfig) GetStore() string {
+	if b.Store == "" {
+		return StoreJSON
+	}
+	return b.Store
+}
+
+// GetSnapshotInterval returns how often the journal store compacts its
+// journal into a snapshot
+func (b *BanConfig) GetSnapshotInterval() (time.Duration, error) {
+	if strings.TrimSpace(b.SnapshotInterval) == "" {
+		return DefaultSnapshotInterval, nil
+	}
+	d, err := units.ParseDuration(b.SnapshotInterval)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return d, nil
+}
+
+// GetFile returns the audit log path for a state file
+func (a *AuditConfig) GetFile(stateFile string) string {
+	if a.File == "" {
+		return stateFile + ".audit.jsonl"
+	}
+	return a.File
+}
+
+// GetRetention returns how long audit events are kept, 0 meaning forever
+func (a *AuditConfig) GetRetention() (time.Duration, error) {
+	if strings.TrimSpace(a.Retention) == "" {
+		return DefaultAuditRetention, nil
+	}
+	return units.ParseDuration(a.Retention)
+}
+
+// GetBanDuration returns the ban duration as a duration.
+// An empty value, "0" or "permanent" means a permanent ban.
 func (r *RuleConfig) GetBanDuration() (time.Duration, error) {
-	if r.BanDuration == "" || r.BanDuration == "0" {
-		return 0, nil // Permanent ban
+	return ParseBanDuration(r.BanDuration)
+}
+
+// GetLadder returns the escalation ladder, 0 entries being permanent
+func (e *EscalationConfig) GetLadder() ([]time.Duration, error) {
+	ladder := make([]time.Duration, 0, len(e.Ladder))
+	for i, step := range e.Ladder {
+		d, err := ParseBanDuration(step)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		ladder = append(ladder, d)
 	}
-	return time.ParseDuration(r.BanDuration)
+	return ladder, nil
+}
+
+// GetMaxDuration returns the multiplier cap, 0 meaning uncapped
+func (e *EscalationConfig) GetMaxDuration() (time.Duration, error) {
+	if strings.TrimSpace(e.MaxDuration) == "" {
+		return 0, nil
+	}
+	return units.ParseDuration(e.MaxDuration)
+}
+
+// ParseBanDuration parses a ban duration, where "", "0" and "permanent"
+// all mean a permanent ban
+func ParseBanDuration(s string) (time.Duration, error) {
+	switch strings.TrimSpace(s) {
+	case "", "permanent":
+		return 0, nil
+	}
+	return units.ParseDuration(s)
+}
+
+// validate checks an external rule's command settings
+func (e *ExternalConfig) validate(filters int) error {
+	if e == nil || len(e.Command) == 0 || e.Command[0] == "" {
+		return fmt.Errorf("command is required")
+	}
+	timeout, err := e.GetTimeout()
+	if err != nil {
+		return fmt.Errorf("timeout: %w", err)
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	switch e.GetOnFailure() {
+	case FailOpen:
+	case FailClosed:
+		// Without filters every peer is a candidate, and a failing command
+		// would ban the whole swarm
+		if filters == 0 {
+			return fmt.Errorf("on_failure: closed needs filters to narrow the candidates")
+		}
+	default:
+		return fmt.Errorf("unknown on_failure %q (use open or closed)", e.OnFailure)
+	}
+	return nil
+}
+
+// validate checks the escalation settings against the rule's base duration
+func (e *EscalationConfig) validate(banDuration time.Duration) error {
+	if len(e.Ladder) > 0 && e.Multiplier != 0 {
+		return fmt.Errorf("set either ladder or multiplier, not both")
+	}
+	if _, err := e.GetLadder(); err != nil {
+		return fmt.Errorf("ladder: %w", err)
+	}
+	if e.Multiplier != 0 {
+		if e.Multiplier < 1 {
+			return fmt.Errorf("multiplier must be at least 1, got %g", e.Multiplier)
+		}
+		if banDuration == 0 {
+			return fmt.Errorf("multiplier needs a non-permanent ban_duration to grow from")
+		}
+	}
+	maxDuration, err := e.GetMaxDuration()
+	if err != nil {
+		return fmt.Errorf("max_duration: %w", err)
+	}
+	// A cap below the first ban would shorten repeat offenders' bans
+	if maxDuration > 0 && banDuration > 0 && maxDuration < banDuration {
+		return fmt.Errorf("max_duration %s is shorter than ban_duration %s", e.MaxDuration, units.FormatDuration(banDuration))
+	}
+	return nil
 }
 
 // Load loads configuration from a YAML file
@@ -112,5 +599,125 @@ func Load(path string) (*Config, error) {
 		cfg.Output.Format = "peerbanana"
 	}
 
+	for i := range cfg.Rules {
+		cfg.Rules[i].Source = path
+	}
+	if err := cfg.loadIncludes(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.expandPresets(); err != nil {
+		return nil, err
+	}
+
+	for i := range cfg.Blocklists {
+		if f := cfg.Blocklists[i].File; f != "" && !filepath.IsAbs(f) {
+			cfg.Blocklists[i].File = filepath.Join(filepath.Dir(path), f)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
 	return &cfg, nil
 }
+
+// Validate checks values that would otherwise be misread at runtime
+func (c *Config) Validate() error {
+	switch c.App.GetRuleResolution() {
+	case ResolveFirstMatch, ResolveMostSevere, ResolveLongestDuration:
+	default:
+		return fmt.Errorf("app: unknown rule_resolution %q (use %s, %s or %s)", c.App.RuleResolution,
+			ResolveFirstMatch, ResolveMostSevere, ResolveLongestDuration)
+	}
+	if _, err := c.Ban.GetDecayInterval(); err != nil {
+		return fmt.Errorf("ban: decay_interval: %w", err)
+	}
+	switch c.Ban.GetOnCorrupt() {
+	case CorruptRestore, CorruptRefuse:
+	default:
+		return fmt.Errorf("ban: unknown on_corrupt %q (use %s or %s)", c.Ban.OnCorrupt, CorruptRestore, CorruptRefuse)
+	}
+	switch c.Ban.GetStore() {
+	case StoreJSON, StoreJournal:
+	default:
+		return fmt.Errorf("ban: unknown store %q (use %s or %s)", c.Ban.Store, StoreJSON, StoreJournal)
+	}
+	if _, err := c.Ban.GetSnapshotInterval(); err != nil {
+		return fmt.Errorf("ban: snapshot_interval: %w", err)
+	}
+	if _, err := c.Ban.Audit.GetRetention(); err != nil {
+		return fmt.Errorf("ban: audit: retention: %w", err)
+	}
+	if c.Safety.MaxBansPerCycle < 0 {
+		return fmt.Errorf("safety: max_bans_per_cycle must not be negative")
+	}
+	if c.Safety.MaxBansPerRule < 0 {
+		return fmt.Errorf("safety: max_bans_per_rule must not be negative")
+	}
+	if _, err := c.Safety.Alert.GetTimeout(); err != nil {
+		return fmt.Errorf("safety: alert: timeout: %w", err)
+	}
+	lists := make(map[string]bool, len(c.Blocklists))
+	for i := range c.Blocklists {
+		b := &c.Blocklists[i]
+		if b.Name == "" {
+			return fmt.Errorf("blocklists: entry %d has no name", i+1)
+		}
+		if lists[b.Name] {
+			return fmt.Errorf("blocklists: name %q is used twice", b.Name)
+		}
+		lists[b.Name] = true
+		if err := b.validate(); err != nil {
+			return fmt.Errorf("blocklist %q: %w", b.Name, err)
+		}
+	}
+	servers := make(map[string]bool, len(c.Servers))
+	for _, s := range c.Servers {
+		servers[s.Name] = true
+	}
+
+	defined := make(map[string]*RuleConfig, len(c.Rules))
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if prev, ok := defined[r.Name]; ok && r.Name != "" {
+			return fmt.Errorf("rule %s: name is already used by rule %s", r.Label(), prev.Label())
+		}
+		defined[r.Name] = r
+		for _, name := range r.Servers {
+			if !servers[name] {
+				return fmt.Errorf("rule %s: servers: no server named %q", r.Label(), name)
+			}
+		}
+		switch r.GetType() {
+		case RuleTypeAll:
+		case RuleTypeScoring:
+			if r.Threshold <= 0 {
+				return fmt.Errorf("rule %s: scoring rules need a positive threshold", r.Label())
+			}
+		case RuleTypeExternal:
+			if err := r.External.validate(len(r.Filters)); err != nil {
+				return fmt.Errorf("rule %s: external: %w", r.Label(), err)
+			}
+		default:
+			return fmt.Errorf("rule %s: unknown type %q (use all, scoring or external)", r.Label(), r.Type)
+		}
+		for j, f := range r.Filters {
+			if f.Weight != nil && *f.Weight < 0 {
+				return fmt.Errorf("rule %s: filter %d: weight must not be negative", r.Label(), j+1)
+			}
+		}
+		if r.MaxBans < -1 {
+			return fmt.Errorf("rule %s: max_bans_per_cycle must be -1 (unlimited) or more", r.Label())
+		}
+		banDuration, err := r.GetBanDuration()
+		if err != nil {
+			return fmt.Errorf("rule %s: ban_duration: %w", r.Label(), err)
+		}
+		if err := r.Escalation.validate(banDuration); err != nil {
+			return fmt.Errorf("rule %s: escalation: %w", r.Label(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestEscalationValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		esc         EscalationConfig
+		banDuration time.Duration
+		wantErr     string
+	}{
+		{"none", EscalationConfig{}, time.Hour, ""},
+		{"ladder", EscalationConfig{Ladder: []string{"1h", "1d", "permanent"}}, time.Hour, ""},
+		{"capped multiplier", EscalationConfig{Multiplier: 4, MaxDuration: "7d"}, time.Hour, ""},
+		{"cap equal to the first ban", EscalationConfig{Multiplier: 2, MaxDuration: "1h"}, time.Hour, ""},
+		{"cap below the first ban", EscalationConfig{Multiplier: 2, MaxDuration: "30m"}, time.Hour, "shorter than ban_duration"},
+		{"both", EscalationConfig{Ladder: []string{"1h"}, Multiplier: 2}, time.Hour, "not both"},
+		{"multiplier below 1", EscalationConfig{Multiplier: 0.5}, time.Hour, "at least 1"},
+		{"multiplier on a permanent ban", EscalationConfig{Multiplier: 2}, 0, "non-permanent"},
+		{"bad ladder step", EscalationConfig{Ladder: []string{"1h", "1x"}}, time.Hour, "step 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.esc.validate(tt.banDuration)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBlocklistValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    BlocklistConfig
+		wantErr string
+	}{
+		{"url", BlocklistConfig{Name: "level1", URL: "https://example.com/level1.gz", Format: BlocklistP2P}, ""},
+		{"file", BlocklistConfig{Name: "my-list_2.v4", File: "/etc/list.txt", Format: BlocklistCIDR}, ""},
+		{"parent directory", BlocklistConfig{Name: "x/../y", File: "/etc/list.txt", Format: BlocklistCIDR}, "may only use"},
+		{"leading parent directory", BlocklistConfig{Name: "../x", File: "/etc/list.txt", Format: BlocklistCIDR}, "must not start"},
+		{"dot dot", BlocklistConfig{Name: "..", File: "/etc/list.txt", Format: BlocklistCIDR}, "must not start"},
+		{"hidden", BlocklistConfig{Name: ".list", File: "/etc/list.txt", Format: BlocklistCIDR}, "must not start"},
+		{"path separator", BlocklistConfig{Name: `a\b`, File: "/etc/list.txt", Format: BlocklistCIDR}, "may only use"},
+		{"space", BlocklistConfig{Name: "my list", File: "/etc/list.txt", Format: BlocklistCIDR}, "may only use"},
+		{"both sources", BlocklistConfig{Name: "x", URL: "https://example.com", File: "/etc/list.txt", Format: BlocklistCIDR}, "exactly one"},
+		{"no source", BlocklistConfig{Name: "x", Format: BlocklistCIDR}, "exactly one"},
+		{"bad format", BlocklistConfig{Name: "x", File: "/etc/list.txt", Format: "dat"}, "unknown format"},
+		{"bad refresh", BlocklistConfig{Name: "x", URL: "https://example.com", Format: BlocklistCIDR, Refresh: "0s"}, "refresh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.list.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFilterWeight(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    float64
+		wantErr string
+	}{
+		{"unset", "field: progress", 1, ""},
+		{"explicit zero", "field: progress\nweight: 0", 0, ""},
+		{"fraction", "field: progress\nweight: 0.5", 0.5, ""},
+		{"negative", "field: progress\nweight: -1", 0, "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f FilterConfig
+			if err := yaml.Unmarshal([]byte(tt.yaml), &f); err != nil {
+				t.Fatal(err)
+			}
+			cfg := Config{Rules: []RuleConfig{{Name: "r", Type: RuleTypeScoring, Threshold: 1, BanDuration: "1h", Filters: []FilterConfig{f}}}}
+			err := cfg.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.GetWeight(); got != tt.want {
+				t.Errorf("GetWeight() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
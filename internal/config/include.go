@@ -0,0 +1,69 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ruleFile is the layout of an included rules file
+type ruleFile struct {
+	Rules []RuleConfig `yaml:"rules"`
+}
+
+// loadIncludes appends the rules of every included file, in include order.
+// Relative patterns are resolved against dir, the main config's directory.
+func (c *Config) loadIncludes(dir string) error {
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		paths := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			// An empty glob such as an empty rules.d is not an error
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return fmt.Errorf("include %q: %w", pattern, err)
+			}
+			paths = matches
+		}
+
+		for _, path := range paths {
+			rules, err := loadRuleFile(path)
+			if err != nil {
+				return err
+			}
+			c.Rules = append(c.Rules, rules...)
+		}
+	}
+	return nil
+}
+
+// loadRuleFile reads the rules of an included file. Unknown keys are
+// rejected so that settings meant for the main config are not silently
+// dropped.
+func loadRuleFile(path string) ([]RuleConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("include: %w", err)
+	}
+
+	var f ruleFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i := range f.Rules {
+		f.Rules[i].Source = path
+	}
+	return f.Rules, nil
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// presetFS holds the rule presets shipped with the binary
+//
+//go:embed presets/*.yaml
+var presetFS embed.FS
+
+// Preset is a named, versioned set of rules shipped with the binary
+type Preset struct {
+	Name    string       `yaml:"-"`
+	Version int          `yaml:"version"`
+	Rules   []RuleConfig `yaml:"rules"`
+}
+
+// LoadPreset reads a built-in preset by name
+func LoadPreset(name string) (*Preset, error) {
+	data, err := presetFS.ReadFile("presets/" + name + ".yaml")
+	if err != nil {
+		return nil, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(PresetNames(), ", "))
+	}
+	p := &Preset{Name: name}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("preset %q: %w", name, err)
+	}
+	return p, nil
+}
+
+// PresetNames lists the built-in presets
+func PresetNames() []string {
+	entries, _ := fs.ReadDir(presetFS, "presets")
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), path.Ext(e.Name())))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expandPresets replaces each preset entry in the rule list with the
+// preset's rules, named "<preset>/<rule>", after applying its overrides
+func (c *Config) expandPresets() error {
+	var expanded []RuleConfig
+	for _, r := range c.Rules {
+		if r.Preset == "" {
+			expanded = append(expanded, r)
+			continue
+		}
+		rules, err := r.expandPreset()
+		if err != nil {
+			if r.Source != "" {
+				return fmt.Errorf("%s: %w", r.Source, err)
+			}
+			return err
+		}
+		expanded = append(expanded, rules...)
+	}
+	c.Rules = expanded
+	return nil
+}
+
+// presetEntryKeys are the keys a preset entry may set. Anything else
+// would apply to no rule, so it is rejected.
+var presetEntryKeys = map[string]bool{"preset": true, "preset_version": true, "overrides": true}
+
+// expandPreset returns the rules of the preset this entry names
+func (r *RuleConfig) expandPreset() ([]RuleConfig, error) {
+	for _, key := range r.keys {
+		switch {
+		case presetEntryKeys[key]:
+		case key == "enabled":
+			return nil, fmt.Errorf("preset %q: enabled can't be set on a preset entry; remove the entry to disable the preset, or set enabled per rule under overrides", r.Preset)
+		default:
+			return nil, fmt.Errorf("preset %q: %s can't be set on a preset entry, only preset, preset_version and overrides; set it per rule under overrides", r.Preset, key)
+		}
+	}
+
+	p, err := LoadPreset(r.Preset)
+	if err != nil {
+		return nil, err
+	}
+	if r.PresetVersion != 0 && r.PresetVersion != p.Version {
+		return nil, fmt.Errorf("preset %q is version %d, but the config pins preset_version %d; review the changes and update the pin",
+			p.Name, p.Version, r.PresetVersion)
+	}
+
+	byName := make(map[string]*RuleConfig, len(p.Rules))
+	names := make([]string, 0, len(p.Rules))
+	for i := range p.Rules {
+		byName[p.Rules[i].Name] = &p.Rules[i]
+		names = append(names, p.Rules[i].Name)
+	}
+
+	overridden := make([]string, 0, len(r.Overrides))
+	for name := range r.Overrides {
+		overridden = append(overridden, name)
+	}
+	sort.Strings(overridden)
+	for _, name := range overridden {
+		override := r.Overrides[name]
+		rule, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("preset %q: override for unknown rule %q (rules: %s)", p.Name, name, strings.Join(names, ", "))
+		}
+		// Fields set in the override replace the preset's, the rest are kept
+		if err := override.Decode(rule); err != nil {
+			return nil, fmt.Errorf("preset %q: override for %q: %w", p.Name, name, err)
+		}
+		rule.Name = name
+	}
+
+	for i := range p.Rules {
+		p.Rules[i].Name = p.Name + "/" + p.Rules[i].Name
+		p.Rules[i].Source = r.Source
+	}
+	return p.Rules, nil
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPresetEntryKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{"preset only", "- preset: known_leechers\n", ""},
+		{"pinned with overrides", "- preset: known_leechers\n  preset_version: 1\n  overrides:\n    xfplay:\n      enabled: false\n", ""},
+		{"disabled", "- preset: known_leechers\n  enabled: false\n", "remove the entry"},
+		{"enabled", "- preset: known_leechers\n  enabled: true\n", "enabled can't be set"},
+		{"scoped", "- preset: known_leechers\n  servers: [Main]\n", "servers can't be set"},
+		{"filters", "- preset: known_leechers\n  filter:\n    - field: progress\n      operator: '>'\n      value: '0'\n", "filter can't be set"},
+		{"plain rule", "- name: r\n  enabled: false\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			if err := yaml.Unmarshal([]byte("rules:\n"+indent(tt.yaml)), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			err := cfg.expandPresets()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPresetOverrides(t *testing.T) {
+	var cfg Config
+	data := "rules:\n  - preset: known_leechers\n    overrides:\n      xfplay:\n        enabled: false\n"
+	if err := yaml.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.expandPresets(); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, r := range cfg.Rules {
+		if r.Name == "known_leechers/xfplay" {
+			found = true
+			if r.Enabled {
+				t.Error("override did not disable xfplay")
+			}
+		}
+	}
+	if !found {
+		t.Fatal("known_leechers/xfplay not expanded")
+	}
+}
+
+// indent nests a YAML list under a key
+func indent(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, l := range lines {
+		if l != "" {
+			lines[i] = "  " + l
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -3,14 +3,17 @@ package detector
 import (
 	"fmt"
 	"log"
-	"net"
+	"net/netip"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/philogag/peer-banner/internal/api"
 	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/blocklist"
 	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/iptrie"
 	"github.com/philogag/peer-banner/internal/models"
 	"github.com/philogag/peer-banner/internal/rules"
 )
@@ -19,84 +22,227 @@ import (
 type Detector struct {
 	client     *api.Client
 	rules      []*rules.Rule
+	external   []*rules.Rule // Rules decided by a command, run after the others
+	resolution string
 	whitelist  Whitelist
 	banManager *ban.Manager
+	blocklists *blocklist.Set
+
+	stateFile    string
+	safety       config.SafetyConfig
+	maxBans      map[string]int // Per-cycle ban limit of each rule, 0 = unlimited
+	alertTimeout time.Duration
 }
 
 // Whitelist represents an IP whitelist
 type Whitelist struct {
 	IPs []string
+
+	entries iptrie.Trie[string] // Parsed IPs, each valued with its entry as configured
 }
 
 // NewDetector creates a new detection engine
-func NewDetector(client *api.Client, ruleConfigs []config.RuleConfig, whitelistCfg config.WhitelistConfig, banManager *ban.Manager) (*Detector, error) {
+func NewDetector(client *api.Client, cfg *config.Config, banManager *ban.Manager) (*Detector, error) {
+	d := &Detector{client: client, banManager: banManager}
+	if err := d.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Settings is the part of a configuration a detector applies: its rules,
+// whitelist and rule resolution. It is prepared apart from the detector so
+// that a reload can check every detector before changing any.
+type Settings struct {
+	rules        []*rules.Rule
+	external     []*rules.Rule
+	resolution   string
+	whitelist    Whitelist
+	stateFile    string
+	safety       config.SafetyConfig
+	maxBans      map[string]int
+	alertTimeout time.Duration
+}
+
+// Reload applies the rules, whitelist and rule resolution of a new
+// configuration. The server connection is kept as is.
+func (d *Detector) Reload(cfg *config.Config) error {
+	s, err := d.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	d.Apply(s)
+	return nil
+}
+
+// Prepare reads the settings of a configuration for this detector without
+// applying them
+func (d *Detector) Prepare(cfg *config.Config) (*Settings, error) {
 	// Parse rules
-	var parsedRules []*rules.Rule
-	for _, rc := range ruleConfigs {
-		rule, err := rules.ParseRule(&rc)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse rule %s: %w", rc.Name, err)
-		}
-		if rule != nil {
-			parsedRules = append(parsedRules, rule)
+	parsedRules, err := rules.ParseRules(cfg.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %w", err)
+	}
+
+	alertTimeout, err := cfg.Safety.Alert.GetTimeout()
+	if err != nil {
+		return nil, fmt.Errorf("safety: alert: timeout: %w", err)
+	}
+	maxBans := make(map[string]int, len(cfg.Rules))
+	for i := range cfg.Rules {
+		maxBans[cfg.Rules[i].Name] = cfg.Safety.GetMaxBans(&cfg.Rules[i])
+	}
+
+	// Keep only the rules that run on this server
+	scoped := rules.ForServer(parsedRules, d.client.Name())
+	if len(scoped) < len(parsedRules) {
+		log.Printf("[%s] %d of %d rules apply to this server", d.client.Name(), len(scoped), len(parsedRules))
+	}
+
+	// External rules are batched after the in-process rules
+	var inProcess, external []*rules.Rule
+	for _, rule := range scoped {
+		if rule.Type == config.RuleTypeExternal {
+			external = append(external, rule)
+		} else {
+			inProcess = append(inProcess, rule)
 		}
 	}
 
-	return &Detector{
-		client:     client,
-		rules:      parsedRules,
-		whitelist:  parseWhitelist(whitelistCfg.IPs),
-		banManager: banManager,
+	return &Settings{
+		rules:        inProcess,
+		external:     external,
+		resolution:   cfg.App.GetRuleResolution(),
+		whitelist:    parseWhitelist(cfg.Whitelist.IPs),
+		stateFile:    cfg.App.GetStateFile(),
+		safety:       cfg.Safety,
+		maxBans:      maxBans,
+		alertTimeout: alertTimeout,
 	}, nil
 }
 
-// parseWhitelist parses whitelist CIDR and IP ranges
+// Apply switches the detector to prepared settings
+func (d *Detector) Apply(s *Settings) {
+	d.rules = s.rules
+	d.external = s.external
+	d.resolution = s.resolution
+	d.whitelist = s.whitelist
+	d.stateFile = s.stateFile
+	d.safety = s.safety
+	d.maxBans = s.maxBans
+	d.alertTimeout = s.alertTimeout
+}
+
+// UseBlocklists makes the detector leave peers in imported blocklists to
+// the output file, so that they never add to offence counts
+func (d *Detector) UseBlocklists(set *blocklist.Set) {
+	d.blocklists = set
+}
+
+// parseWhitelist parses whitelist CIDR and IP ranges. Invalid entries are
+// kept in IPs but never match.
 func parseWhitelist(ips []string) Whitelist {
 	var whitelist Whitelist
 	for _, ip := range ips {
 		ip = strings.TrimSpace(ip)
-		if ip != "" {
-			whitelist.IPs = append(whitelist.IPs, ip)
+		if ip == "" {
+			continue
+		}
+		whitelist.IPs = append(whitelist.IPs, ip)
+		network, ok := parseEntry(ip)
+		if !ok {
+			continue
+		}
+		// The first of duplicate entries is the one reported
+		if _, exists := whitelist.entries.Get(network); !exists {
+			whitelist.entries.Insert(network, ip)
 		}
 	}
 	return whitelist
 }
 
+// parseEntry parses a whitelist entry or ban target, a CIDR range or a
+// plain IP, as a prefix
+func parseEntry(s string) (netip.Prefix, bool) {
+	if strings.Contains(s, "/") {
+		network, err := netip.ParsePrefix(s)
+		return network, err == nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
 // IsWhitelisted checks if an IP is in the whitelist
 func (w *Whitelist) IsWhitelisted(ip string) bool {
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
 		return false
 	}
+	return w.entries.Contains(addr)
+}
 
-	for _, cidr := range w.IPs {
-		_, network, err := net.ParseCIDR(cidr)
-		if err != nil {
-			// Try as a plain IP
-			if ip == cidr {
-				return true
-			}
-			continue
-		}
-		if network.Contains(parsedIP) {
-			return true
-		}
-	}
+// Run is a detection run whose bans are decided but not yet made.
+// Enforce makes the bans of all runs of a cycle together, so that the
+// safety limits see the whole cycle before any ban is made.
+type Run struct {
+	Result *models.DetectionResult
 
-	return false
+	detector  *Detector
+	decisions []decision
 }
 
-// Detect performs the leecher detection
+// decision is a ban decided during a run
+type decision struct {
+	offence   ban.Offence
+	detail    string // How the rule matched, for the log
+	duplicate bool   // Decided by an earlier run of the cycle too
+}
+
+// Detect performs the leecher detection on this server alone and makes
+// its bans
 func (d *Detector) Detect() (*models.DetectionResult, error) {
+	run, err := d.Evaluate()
+	if err != nil {
+		return nil, err
+	}
+	Enforce([]*Run{run})
+	return run.Result, nil
+}
+
+// Evaluate performs the leecher detection and decides which peers to ban,
+// without banning them
+func (d *Detector) Evaluate() (*Run, error) {
 	result := models.NewDetectionResult()
 	result.ServerName = d.client.Name()
 	result.Timestamp = time.Now()
+	run := &Run{Result: result, detector: d}
 
-	// Cleanup expired bans before detection
+	// Apply changes queued from the command line and new pardons, note
+	// bans that ran out, then forgive offences for IPs that have stayed
+	// clean
 	if d.banManager != nil {
-		cleaned := d.banManager.CleanupExpired()
-		if cleaned > 0 {
-			log.Printf("[%s] Cleaned up %d expired bans", d.client.Name(), cleaned)
+		if applied, err := d.banManager.ApplyQueued(); err != nil {
+			log.Printf("[%s] Failed to apply queued ban changes: %v", d.client.Name(), err)
+		} else if applied > 0 {
+			log.Printf("[%s] Applied %d queued ban changes", d.client.Name(), applied)
+		}
+		if lifted, err := d.banManager.RefreshPardons(); err != nil {
+			log.Printf("[%s] Failed to read pardons: %v", d.client.Name(), err)
+		} else if len(lifted) > 0 {
+			log.Printf("[%s] Lifted bans of pardoned %s", d.client.Name(), strings.Join(lifted, ", "))
+		}
+		if d.blocklists != nil {
+			d.blocklists.SetPardons(d.banManager.PardonedNetworks())
+		}
+		if expired := d.banManager.Expire(); expired > 0 {
+			log.Printf("[%s] %d bans expired", d.client.Name(), expired)
+		}
+		decayed, forgotten := d.banManager.Decay()
+		if decayed > 0 {
+			log.Printf("[%s] Decayed offence count of %d IPs (%d forgotten)", d.client.Name(), decayed, forgotten)
 		}
 	}
 
@@ -108,8 +254,20 @@ func (d *Detector) Detect() (*models.DetectionResult, error) {
 
 	log.Printf("[%s] Checking %d torrents...", d.client.Name(), len(torrents))
 
-	// Track seen IPs to avoid duplicates
+	// Only rules inside their schedule take part in this run
+	activeRules, inactive := activeAt(d.rules, result.Timestamp)
+	activeExternal, inactiveExternal := activeAt(d.external, result.Timestamp)
+	inactive = append(inactive, inactiveExternal...)
+	if len(inactive) > 0 {
+		log.Printf("[%s] Rules outside their schedule: %s", d.client.Name(), strings.Join(inactive, ", "))
+	}
+
+	// Track seen IPs for stats, and IPs banned during this run so that each
+	// IP is banned at most once. An IP seen on several torrents is checked on
+	// each of them, since rules may be scoped to some torrents only.
 	seenIPs := make(map[string]bool)
+	bannedIPs := make(map[string]bool)
+	candidates := newCandidates()
 
 	var mu sync.Mutex
 	var wg sync.WaitGroup
@@ -126,73 +284,144 @@ func (d *Detector) Detect() (*models.DetectionResult, error) {
 				return
 			}
 
+			// Rules scoped to this torrent's category and tags
+			torrentRules := rules.ForTorrent(activeRules, &t)
+			torrentExternal := rules.ForTorrent(activeExternal, &t)
+
 			for _, peer := range peers {
+				ip := peer.IP
 				mu.Lock()
 				result.TotalPeers++
-				ip := peer.IP
+				firstSeen := !seenIPs[ip]
+				seenIPs[ip] = true
+				done := bannedIPs[ip]
 				mu.Unlock()
 
-				// Skip if already processed
-				mu.Lock()
-				if seenIPs[ip] {
-					mu.Unlock()
+				// Skip if already banned during this run
+				if done {
 					continue
 				}
-				seenIPs[ip] = true
-				mu.Unlock()
 
-				// Check whitelist
+				// Check whitelist and pardons
 				if d.whitelist.IsWhitelisted(ip) {
 					continue
 				}
+				if d.banManager != nil && d.banManager.Pardoned(ip) != nil {
+					continue
+				}
 
-				// Check if already banned (and not expired)
-				if d.banManager != nil && d.banManager.IsBanned(ip) {
-					mu.Lock()
-					result.TotalAlreadyBanned++
-					mu.Unlock()
+				// Check if already banned (and not expired) or blocklisted
+				if d.banManager != nil && d.banManager.IsBanned(ip) || d.blocklists != nil && d.blocklists.Contains(ip) != "" {
+					if firstSeen {
+						mu.Lock()
+						result.TotalAlreadyBanned++
+						mu.Unlock()
+					}
 					continue
 				}
 
 				// Check against all rules
-				for _, rule := range d.rules {
-					if rule.Match(&peer, &t) {
-						reason := "Matched rule: " + rule.Name
-
-						// Add ban with duration
-						if d.banManager != nil {
-							duration := rule.GetBanDuration()
-							d.banManager.AddBan(ip, reason, rule.Name, duration, rule.GetMaxBanCount())
+				var matches []rules.Match
+				var matched []string
+				for _, rule := range torrentRules {
+					if verdict := rule.Evaluate(&peer, &t); verdict.Matched {
+						matches = append(matches, rules.Match{Rule: rule, Verdict: verdict})
+						matched = append(matched, rule.Name)
+					}
+				}
+				if len(matches) == 0 {
+					// Left for external rules to decide after this pass
+					for _, rule := range torrentExternal {
+						if rule.Evaluate(&peer, &t).Matched {
+							mu.Lock()
+							candidates.add(rule, &peer, &t)
+							mu.Unlock()
 						}
-
-						mu.Lock()
-						result.AddBannedIP(ip, reason, rule.Name)
-						result.TotalBanned++
-						log.Printf("[%s] Banned %s (rule: %s, progress: %.1f%%, uploaded: %d)",
-							d.client.Name(), ip, rule.Name, peer.Progress*100, peer.Uploaded)
-						mu.Unlock()
-						break // Only ban once per IP
 					}
+					continue
+				}
+
+				// Claim the IP so another torrent's peers don't ban it twice
+				mu.Lock()
+				if bannedIPs[ip] {
+					mu.Unlock()
+					continue
+				}
+				bannedIPs[ip] = true
+				mu.Unlock()
+
+				// Pick the rule that decides the ban
+				winner, _ := d.resolve(ip, matches)
+				rule, verdict := winner.Rule, winner.Verdict
+				reason := "Matched rule: " + rule.Name
+				evidence := rule.Evidence(&peer, &t, verdict)
+
+				var detail string
+				if rule.Type == config.RuleTypeScoring {
+					detail = fmt.Sprintf("score: %g/%g, matched: %s", verdict.Score, rule.Threshold, strings.Join(matched, ", "))
+				} else {
+					detail = fmt.Sprintf("progress: %.1f%%, uploaded: %d, matched: %s", peer.Progress*100, peer.Uploaded, strings.Join(matched, ", "))
 				}
+
+				mu.Lock()
+				run.decisions = append(run.decisions, decision{
+					offence: ban.Offence{
+						IP:           ip,
+						Reason:       reason,
+						RuleName:     rule.Name,
+						MatchedRules: matched,
+						Penalty:      rule.GetPenalty(),
+						Evidence:     evidence,
+					},
+					detail: detail,
+				})
+				mu.Unlock()
 			}
 		}(torrent)
 	}
 
 	wg.Wait()
 
-	// Save ban state after detection
-	if d.banManager != nil {
-		if err := d.banManager.Save(); err != nil {
-			log.Printf("[%s] Failed to save ban state: %v", d.client.Name(), err)
+	// Batch the remaining candidates through the external rules
+	for _, rule := range activeExternal {
+		d.runExternal(run, rule, candidates.forRule(rule, bannedIPs), bannedIPs)
+	}
+
+	// Torrents are checked concurrently; order the bans by IP so that the
+	// log and the result don't depend on it
+	sort.Slice(run.decisions, func(i, j int) bool {
+		return run.decisions[i].offence.IP < run.decisions[j].offence.IP
+	})
+	return run, nil
+}
+
+// activeAt splits rules into those inside their schedule at t and the
+// names of those outside it
+func activeAt(list []*rules.Rule, t time.Time) (active []*rules.Rule, inactive []string) {
+	active = make([]*rules.Rule, 0, len(list))
+	for _, rule := range list {
+		if rule.ActiveAt(t) {
+			active = append(active, rule)
+		} else {
+			inactive = append(inactive, rule.Name)
 		}
 	}
+	return active, inactive
+}
 
-	return result, nil
+// resolve picks the match that decides a ban on ip, and returns it with the
+// offence number the ban would be
+func (d *Detector) resolve(ip string, matches []rules.Match) (rules.Match, int) {
+	count := 1
+	if d.banManager != nil {
+		count = d.banManager.OffenceCount(ip) + 1
+	}
+	return rules.Resolve(d.resolution, matches, count), count
 }
 
 // GetRuleCount returns the number of enabled rules
 func (d *Detector) GetRuleCount() int {
-	return len(d.rules)
+	return len(d.rules) + len(d.external)
 }
 
 // Name returns the server name (for logging)
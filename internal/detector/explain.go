@@ -0,0 +1,111 @@
+package detector
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/models"
+	"github.com/philogag/peer-banner/internal/rules"
+)
+
+// Explanation shows how the detector would treat one peer on one torrent
+type Explanation struct {
+	Server      string
+	Resolution  string
+	Peer        models.Peer
+	Torrent     models.Torrent
+	Whitelisted bool
+	Pardon      *ban.Pardon      // Pardon in force, nil if none
+	Blocklist   string           // Imported blocklist containing the IP, "" if none
+	Ban         *models.BannedIP // Existing ban record, nil if none
+	Banned      bool             // The existing ban is still in force
+	Rules       []rules.RuleTrace
+	Decision    *rules.Match // The match that would decide a ban, nil if no rule matched
+	Count       int          // The offence number a ban would be
+	Shadowed    string       // Why the decision would not be enforced, "" if it would
+}
+
+// Explain finds every torrent the IP is a peer of on the server and
+// explains each. It returns an empty slice when the IP is not connected.
+func (d *Detector) Explain(ip string) ([]*Explanation, error) {
+	target := net.ParseIP(ip)
+	if target == nil {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+
+	torrents, err := d.client.GetTorrents()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get torrents: %w", err)
+	}
+
+	now := time.Now()
+	var explanations []*Explanation
+	for i := range torrents {
+		peers, err := d.client.GetTorrentPeers(torrents[i].Hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get peers for torrent %s: %w", torrents[i].Name, err)
+		}
+		for j := range peers {
+			if target.Equal(net.ParseIP(peers[j].IP)) {
+				explanations = append(explanations, d.ExplainPeer(&peers[j], &torrents[i], now))
+			}
+		}
+	}
+	return explanations, nil
+}
+
+// ExplainPeer traces every rule of this server against a peer as Detect
+// would at time now, without banning it
+func (d *Detector) ExplainPeer(peer *models.Peer, torrent *models.Torrent, now time.Time) *Explanation {
+	e := &Explanation{
+		Server:      d.client.Name(),
+		Resolution:  d.resolution,
+		Peer:        *peer,
+		Torrent:     *torrent,
+		Whitelisted: d.whitelist.IsWhitelisted(peer.IP),
+	}
+	if d.banManager != nil {
+		if ban, ok := d.banManager.GetBan(peer.IP); ok {
+			e.Ban = ban
+			e.Banned = d.banManager.IsBanned(peer.IP)
+		}
+		e.Pardon = d.banManager.Pardoned(peer.IP)
+	}
+	if d.blocklists != nil {
+		e.Blocklist = d.blocklists.Contains(peer.IP)
+	}
+
+	// Rules that Detect would run, in the same order
+	var matches []rules.Match
+	for _, rule := range d.rules {
+		trace := rule.Trace(peer, torrent, now)
+		e.Rules = append(e.Rules, trace)
+		if trace.Skipped == "" && trace.Verdict.Matched {
+			matches = append(matches, rules.Match{Rule: rule, Verdict: trace.Verdict})
+		}
+	}
+	// External rules only pick candidates here; their command decides later
+	for _, rule := range d.external {
+		trace := rule.Trace(peer, torrent, now)
+		if trace.Skipped == "" {
+			trace.Skipped = "external rule, its command decides during detection"
+		}
+		e.Rules = append(e.Rules, trace)
+	}
+	if len(matches) > 0 {
+		winner, count := d.resolve(peer.IP, matches)
+		e.Decision = &winner
+		e.Count = count
+		if s, err := ban.LoadSafety(d.stateFile); err == nil {
+			switch {
+			case s.Frozen != nil:
+				e.Shadowed = "enforcement is frozen"
+			case s.Tripped[winner.Rule.Name] != nil:
+				e.Shadowed = "rule " + winner.Rule.Name + " is tripped and in shadow mode"
+			}
+		}
+	}
+	return e
+}
@@ -0,0 +1,100 @@
+package detector
+
+import (
+	"log"
+
+	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/models"
+	"github.com/philogag/peer-banner/internal/rules"
+)
+
+// candidates collects the peers each external rule should be asked about
+// during a detection run. An IP is sent at most once per rule, with the
+// first torrent it was seen on.
+type candidates struct {
+	peers map[*rules.Rule][]*rules.ExternalPeer
+	seen  map[*rules.Rule]map[string]bool
+}
+
+// newCandidates creates an empty candidate set
+func newCandidates() *candidates {
+	return &candidates{
+		peers: make(map[*rules.Rule][]*rules.ExternalPeer),
+		seen:  make(map[*rules.Rule]map[string]bool),
+	}
+}
+
+// add records a peer as a candidate for an external rule
+func (c *candidates) add(rule *rules.Rule, peer *models.Peer, torrent *models.Torrent) {
+	seen := c.seen[rule]
+	if seen == nil {
+		seen = make(map[string]bool)
+		c.seen[rule] = seen
+	}
+	if seen[peer.IP] {
+		return
+	}
+	seen[peer.IP] = true
+	c.peers[rule] = append(c.peers[rule], &rules.ExternalPeer{Peer: *peer, Torrent: torrent})
+}
+
+// forRule returns a rule's candidates that have not been banned meanwhile
+func (c *candidates) forRule(rule *rules.Rule, banned map[string]bool) []*rules.ExternalPeer {
+	var peers []*rules.ExternalPeer
+	for _, p := range c.peers[rule] {
+		if !banned[p.IP] {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// runExternal asks an external rule's command about its candidates and
+// decides bans on the peers it picks. When the command fails, nobody is banned
+// unless the rule fails closed, in which case every candidate is.
+func (d *Detector) runExternal(run *Run, rule *rules.Rule, peers []*rules.ExternalPeer, banned map[string]bool) {
+	if len(peers) == 0 {
+		return
+	}
+
+	verdicts, err := rule.External.Decide(&rules.ExternalRequest{
+		Rule:   rule.Name,
+		Server: d.client.Name(),
+		Peers:  peers,
+	})
+	if err != nil {
+		if !rule.External.FailClosed {
+			log.Printf("[%s] External rule %s failed, banning nobody: %v", d.client.Name(), rule.Name, err)
+			return
+		}
+		log.Printf("[%s] External rule %s failed, banning all %d candidates: %v", d.client.Name(), rule.Name, len(peers), err)
+		verdicts = make(map[string]rules.ExternalVerdict, len(peers))
+		for _, p := range peers {
+			verdicts[p.IP] = rules.ExternalVerdict{IP: p.IP, Ban: true, Reason: "external command failed"}
+		}
+	}
+
+	for _, p := range peers {
+		v, ok := verdicts[p.IP]
+		if !ok || !v.Ban {
+			continue
+		}
+		banned[p.IP] = true
+
+		reason := "Matched rule: " + rule.Name
+		if v.Reason != "" {
+			reason += " (" + v.Reason + ")"
+		}
+		run.decisions = append(run.decisions, decision{
+			offence: ban.Offence{
+				IP:           p.IP,
+				Reason:       reason,
+				RuleName:     rule.Name,
+				MatchedRules: []string{rule.Name},
+				Penalty:      rule.PenaltyFor(v),
+				Evidence:     rule.Evidence(&p.Peer, p.Torrent, rules.Verdict{Matched: true}),
+			},
+			detail: "external: " + v.Reason,
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package detector
+
+import (
+	"net/netip"
+
+	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// Reconcile lifts the active bans that the configuration no longer
+// supports: bans of whitelisted IPs and ranges and, with
+// ban.lift_orphaned, bans made by rules that were removed or disabled.
+// Manual bans are only lifted when whitelisted. It returns the lifted bans.
+func Reconcile(cfg *config.Config, banManager *ban.Manager) []ban.Lift {
+	whitelist := parseWhitelist(cfg.Whitelist.IPs)
+	enabled := make(map[string]bool, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		enabled[r.Name] = r.Enabled
+	}
+
+	return banManager.Reconcile(func(key string, b *models.BannedIP) string {
+		if entry := whitelist.covering(key); entry != "" {
+			return "whitelisted by " + entry
+		}
+		// Bans from before rule names were recorded have no rule to check
+		if !cfg.Ban.LiftOrphaned || b.RuleName == "" || b.RuleName == ban.ManualRule {
+			return ""
+		}
+		on, exists := enabled[b.RuleName]
+		switch {
+		case !exists:
+			return "rule " + b.RuleName + " was removed from the configuration"
+		case !on:
+			return "rule " + b.RuleName + " is disabled"
+		}
+		return ""
+	})
+}
+
+// covering returns the whitelist entry that covers a ban target, an IP or
+// a CIDR range, or "" if none does. A range is covered only when it lies
+// entirely within one entry.
+func (w *Whitelist) covering(target string) string {
+	banned, ok := parseEntry(target)
+	if !ok {
+		return ""
+	}
+	entry := ""
+	w.entries.EachContaining(banned, func(_ netip.Prefix, e string) bool {
+		entry = e
+		return false
+	})
+	return entry
+}
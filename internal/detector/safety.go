@@ -0,0 +1,285 @@
+package detector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/ban"
+)
+
+// Alert types
+const (
+	AlertRuleTripped = "rule_tripped" // A rule went over its limit and stopped banning
+	AlertFrozen      = "frozen"       // A cycle went over the overall limit and enforcement froze
+)
+
+// Alert is sent to the alert command, as JSON on stdin, when a safety
+// limit trips
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Server  string    `json:"server"`
+	Rule    string    `json:"rule,omitempty"`
+	Bans    int       `json:"bans"`
+	Limit   int       `json:"limit"`
+	Message string    `json:"message"`
+}
+
+// guard applies the safety limits to the bans of one detection cycle,
+// counted across all servers. The limits are checked before any ban is
+// made: a rule over its limit makes none of its bans, and if the bans left
+// are over the overall limit, none are made. A limit that is exceeded
+// trips: the rule is put in shadow mode, or all enforcement freezes.
+type guard struct {
+	state      *ban.Safety
+	maxTotal   int
+	maxPerRule map[string]int
+
+	bans    map[string]int      // Bans decided by rule
+	servers map[string][]string // Servers each rule decided bans on
+	all     []string            // Servers that decided bans
+	total   int                 // Bans decided by rules that may enforce
+	trips   map[string]int      // Rules tripped during this cycle, with their limit
+	frozen  bool                // The overall limit tripped during this cycle
+}
+
+// newGuard starts the safety checks of a detection cycle. Enforcement
+// stays frozen for the cycle if the safety state can't be read.
+func (d *Detector) newGuard() *guard {
+	state, err := ban.LoadSafety(d.stateFile)
+	if err != nil {
+		log.Printf("Not banning during this cycle: %v", err)
+		state = &ban.Safety{Frozen: &ban.Trip{Reason: "unreadable safety state"}}
+	}
+	return &guard{
+		state:      state,
+		maxTotal:   d.safety.MaxBansPerCycle,
+		maxPerRule: d.maxBans,
+		bans:       make(map[string]int),
+		servers:    make(map[string][]string),
+		trips:      make(map[string]int),
+	}
+}
+
+// count adds a ban a rule decided on a server
+func (g *guard) count(rule, server string) {
+	g.bans[rule]++
+	if s := g.servers[rule]; len(s) == 0 || s[len(s)-1] != server {
+		g.servers[rule] = append(s, server)
+	}
+	if len(g.all) == 0 || g.all[len(g.all)-1] != server {
+		g.all = append(g.all, server)
+	}
+}
+
+// check trips the limits the counted bans exceed
+func (g *guard) check() {
+	for rule, n := range g.bans {
+		if limit := g.maxPerRule[rule]; limit > 0 && n > limit && g.state.Enforcing(rule) {
+			g.trips[rule] = limit
+		}
+	}
+	for rule, n := range g.bans {
+		if g.enforcing(rule) {
+			g.total += n
+		}
+	}
+	if g.maxTotal > 0 && g.total > g.maxTotal {
+		g.frozen = true
+	}
+}
+
+// enforcing reports whether the bans of a rule are made this cycle
+func (g *guard) enforcing(rule string) bool {
+	_, tripped := g.trips[rule]
+	return !tripped && !g.frozen && g.state.Enforcing(rule)
+}
+
+// Enforce makes the bans decided by the runs of one cycle that are within
+// the safety limits, then saves the ban state. An IP decided on several
+// servers is banned once, by the first run.
+func Enforce(runs []*Run) {
+	if len(runs) == 0 {
+		return
+	}
+	// Every detector is loaded from the same configuration
+	d := runs[0].detector
+	g := d.newGuard()
+
+	decided := make(map[string]bool)
+	for _, run := range runs {
+		for i := range run.decisions {
+			dec := &run.decisions[i]
+			if decided[dec.offence.IP] {
+				dec.duplicate = true
+				continue
+			}
+			decided[dec.offence.IP] = true
+			g.count(dec.offence.RuleName, run.detector.Name())
+		}
+	}
+	g.check()
+
+	banned := make(map[string]bool)
+	for _, run := range runs {
+		server := run.detector.Name()
+		shadowed := make(map[string]int)
+		for _, dec := range run.decisions {
+			o := dec.offence
+			switch {
+			case dec.duplicate && banned[o.IP]:
+				run.Result.TotalAlreadyBanned++
+				continue
+			case dec.duplicate:
+				run.Result.TotalShadowed++
+				continue
+			case !g.enforcing(o.RuleName):
+				// Tripped rules and frozen enforcement only count the ban
+				shadowed[o.RuleName]++
+				run.Result.TotalShadowed++
+				continue
+			}
+
+			// Add ban, escalating with the IP's offence count
+			if run.detector.banManager != nil {
+				run.detector.banManager.AddBan(o)
+			}
+			banned[o.IP] = true
+			run.Result.AddBannedIP(o.IP, o.Reason, o.RuleName, o.Evidence)
+			run.Result.TotalBanned++
+			log.Printf("[%s] Banned %s (rule: %s, %s)", server, o.IP, o.RuleName, dec.detail)
+		}
+
+		for _, rule := range sortedKeys(shadowed) {
+			if g.frozen || g.state.Frozen != nil {
+				log.Printf("[%s] Enforcement is frozen: %d bans by rule %s not enforced", server, shadowed[rule], rule)
+			} else {
+				log.Printf("[%s] Rule %s is in shadow mode: %d bans not enforced", server, rule, shadowed[rule])
+			}
+		}
+	}
+	d.finish(g, time.Now())
+
+	// Save ban state after detection, once per manager
+	saved := make(map[*ban.Manager]bool)
+	for _, run := range runs {
+		m := run.detector.banManager
+		if m == nil || saved[m] {
+			continue
+		}
+		saved[m] = true
+		if err := m.Save(); err != nil {
+			log.Printf("[%s] Failed to save ban state: %v", run.detector.Name(), err)
+		}
+	}
+}
+
+// finish saves and alerts on the limits that tripped during the cycle
+func (d *Detector) finish(g *guard, now time.Time) {
+	var alerts []*Alert
+	for _, rule := range sortedKeys(g.trips) {
+		limit := g.trips[rule]
+		servers := strings.Join(g.servers[rule], ", ")
+		alerts = append(alerts, &Alert{
+			Time:   now,
+			Type:   AlertRuleTripped,
+			Server: servers,
+			Rule:   rule,
+			Bans:   g.bans[rule],
+			Limit:  limit,
+			Message: fmt.Sprintf("rule %s tried to make %d bans on %s in one cycle, over its limit of %d; it is in shadow mode until acknowledged",
+				rule, g.bans[rule], servers, limit),
+		})
+	}
+	if g.frozen {
+		servers := strings.Join(g.all, ", ")
+		alerts = append(alerts, &Alert{
+			Time:   now,
+			Type:   AlertFrozen,
+			Server: servers,
+			Bans:   g.total,
+			Limit:  g.maxTotal,
+			Message: fmt.Sprintf("%d new bans on %s in one cycle, over the limit of %d; enforcement is frozen until acknowledged",
+				g.total, servers, g.maxTotal),
+		})
+	}
+	if len(alerts) == 0 {
+		return
+	}
+
+	err := ban.UpdateSafety(d.stateFile, func(s *ban.Safety) error {
+		for _, a := range alerts {
+			trip := &ban.Trip{Time: a.Time, Reason: a.Message, Server: a.Server, Bans: a.Bans, Limit: a.Limit}
+			switch {
+			case a.Type == AlertFrozen && s.Frozen == nil:
+				s.Frozen = trip
+			case a.Type == AlertRuleTripped && s.Tripped[a.Rule] == nil:
+				if s.Tripped == nil {
+					s.Tripped = make(map[string]*ban.Trip)
+				}
+				s.Tripped[a.Rule] = trip
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to save safety state, limits apply to this cycle only: %v", err)
+	}
+
+	for _, a := range alerts {
+		log.Printf("ALERT: %s", a.Message)
+		if len(d.safety.Alert.Command) == 0 {
+			continue
+		}
+		if err := d.sendAlert(a); err != nil {
+			log.Printf("Failed to send alert: %v", err)
+		}
+	}
+}
+
+// sendAlert runs the alert command with an alert on stdin
+func (d *Detector) sendAlert(a *Alert) error {
+	input, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %w", err)
+	}
+
+	command := d.safety.Alert.Command
+	ctx, cancel := context.WithTimeout(context.Background(), d.alertTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%s timed out after %s", command[0], d.alertTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", command[0], err, msg)
+		}
+		return fmt.Errorf("%s: %w", command[0], err)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a count map, sorted
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,120 @@
+package detector
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/philogag/peer-banner/internal/api"
+	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// newTestRuns returns a run per server, sharing a ban manager and the
+// safety settings
+func newTestRuns(t *testing.T, safety config.SafetyConfig, maxBans map[string]int, servers ...string) ([]*Run, *ban.Manager, string) {
+	t.Helper()
+	stateFile := filepath.Join(t.TempDir(), "bans.json")
+	m, err := ban.NewManager(stateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	var runs []*Run
+	for _, name := range servers {
+		d := &Detector{
+			client:     api.NewClient(&config.ServerConfig{Name: name}),
+			banManager: m,
+			stateFile:  stateFile,
+			safety:     safety,
+			maxBans:    maxBans,
+		}
+		result := models.NewDetectionResult()
+		result.ServerName = name
+		runs = append(runs, &Run{Result: result, detector: d})
+	}
+	return runs, m, stateFile
+}
+
+// decide adds n bans by a rule to a run, on IPs starting at 10.0.<net>.1
+func decide(run *Run, rule string, net, n int) {
+	for i := 1; i <= n; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", net, i)
+		run.decisions = append(run.decisions, decision{offence: ban.Offence{IP: ip, Reason: "Matched rule: " + rule, RuleName: rule}})
+	}
+}
+
+func TestEnforceCountsWholeCycle(t *testing.T) {
+	runs, m, stateFile := newTestRuns(t, config.SafetyConfig{MaxBansPerCycle: 5}, nil, "A", "B")
+	// Each server is under the limit, the cycle is over it
+	decide(runs[0], "low_share", 1, 3)
+	decide(runs[1], "low_share", 2, 3)
+	Enforce(runs)
+
+	for _, run := range runs {
+		if run.Result.TotalBanned != 0 || run.Result.TotalShadowed != 3 {
+			t.Errorf("%s: banned %d, shadowed %d, want 0 and 3", run.Result.ServerName, run.Result.TotalBanned, run.Result.TotalShadowed)
+		}
+	}
+	if m.IsBanned("10.0.1.1") {
+		t.Error("a ban was made over the cycle limit")
+	}
+	state, err := ban.LoadSafety(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Frozen == nil || state.Frozen.Bans != 6 || state.Frozen.Server != "A, B" {
+		t.Errorf("frozen = %+v, want 6 bans on A, B", state.Frozen)
+	}
+}
+
+func TestEnforceTripsRuleAcrossServers(t *testing.T) {
+	maxBans := map[string]int{"low_share": 2}
+	runs, m, stateFile := newTestRuns(t, config.SafetyConfig{}, maxBans, "A", "B")
+	decide(runs[0], "low_share", 1, 2)
+	decide(runs[1], "low_share", 2, 1)
+	decide(runs[1], "fake_progress", 3, 1)
+	Enforce(runs)
+
+	// None of the tripped rule's bans are made, the other rule's are
+	for _, ip := range []string{"10.0.1.1", "10.0.1.2", "10.0.2.1"} {
+		if m.IsBanned(ip) {
+			t.Errorf("%s was banned by a tripped rule", ip)
+		}
+	}
+	if !m.IsBanned("10.0.3.1") {
+		t.Error("10.0.3.1 was not banned by a rule within its limit")
+	}
+	state, err := ban.LoadSafety(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trip := state.Tripped["low_share"]; trip == nil || trip.Bans != 3 {
+		t.Errorf("low_share trip = %+v, want 3 bans", trip)
+	}
+	if state.Frozen != nil {
+		t.Error("enforcement froze with no overall limit")
+	}
+}
+
+func TestEnforceBansDuplicateOnce(t *testing.T) {
+	runs, m, stateFile := newTestRuns(t, config.SafetyConfig{MaxBansPerCycle: 2}, nil, "A", "B")
+	decide(runs[0], "low_share", 1, 2)
+	decide(runs[1], "low_share", 1, 2)
+	Enforce(runs)
+
+	if runs[0].Result.TotalBanned != 2 {
+		t.Errorf("A banned %d, want 2", runs[0].Result.TotalBanned)
+	}
+	if runs[1].Result.TotalBanned != 0 || runs[1].Result.TotalAlreadyBanned != 2 {
+		t.Errorf("B banned %d with %d already banned, want 0 and 2", runs[1].Result.TotalBanned, runs[1].Result.TotalAlreadyBanned)
+	}
+	if n := m.OffenceCount("10.0.1.1"); n != 1 {
+		t.Errorf("10.0.1.1 has %d offences, want 1", n)
+	}
+	if state, err := ban.LoadSafety(stateFile); err != nil || state.Frozen != nil {
+		t.Errorf("froze on bans decided twice: %+v, %v", state, err)
+	}
+}
@@ -0,0 +1,45 @@
+package detector
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchWhitelist returns n entries: /24 ranges, with every tenth entry a
+// plain IP
+func benchWhitelist(n int) []string {
+	entries := make([]string, n)
+	for i := range entries {
+		if i%10 == 9 {
+			entries[i] = fmt.Sprintf("172.%d.%d.%d", 16+i>>16&0xf, i>>8&0xff, i&0xff)
+			continue
+		}
+		entries[i] = fmt.Sprintf("%d.%d.%d.0/24", 10+i>>16, i>>8&0xff, i&0xff)
+	}
+	return entries
+}
+
+func BenchmarkParseWhitelist(b *testing.B) {
+	entries := benchWhitelist(100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parseWhitelist(entries)
+	}
+}
+
+func BenchmarkIsWhitelisted(b *testing.B) {
+	w := parseWhitelist(benchWhitelist(100000))
+	// Half of the peers are whitelisted
+	ips := make([]string, 1024)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("%d.%d.%d.7", 10+i%2*182, i>>8&0xff, i&0xff)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.IsWhitelisted(ips[i%len(ips)])
+	}
+}
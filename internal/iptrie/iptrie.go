@@ -0,0 +1,281 @@
+// Package iptrie maps IP prefixes to values in a binary radix trie, for
+// containment lookups that stay fast with hundreds of thousands of
+// prefixes: whitelists, range bans, pardons and imported blocklists.
+package iptrie
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+)
+
+// key is an address as a 128-bit number. IPv4 addresses take the top 32
+// bits and live in their own tree.
+type key struct {
+	hi, lo uint64
+}
+
+// keyOf converts an address; IPv4-mapped IPv6 addresses count as IPv4
+func keyOf(addr netip.Addr) key {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		b := addr.As4()
+		return key{hi: uint64(binary.BigEndian.Uint32(b[:])) << 32}
+	}
+	b := addr.As16()
+	return key{hi: binary.BigEndian.Uint64(b[:8]), lo: binary.BigEndian.Uint64(b[8:])}
+}
+
+// bit returns bit i of the key, counting from the most significant
+func (k key) bit(i int) int {
+	if i < 64 {
+		return int(k.hi >> (63 - i) & 1)
+	}
+	return int(k.lo >> (127 - i) & 1)
+}
+
+// mask clears every bit after the first n
+func (k key) mask(n int) key {
+	switch {
+	case n <= 0:
+		return key{}
+	case n < 64:
+		return key{hi: k.hi &^ (^uint64(0) >> n)}
+	case n < 128:
+		return key{hi: k.hi, lo: k.lo &^ (^uint64(0) >> (n - 64))}
+	}
+	return k
+}
+
+// commonBits returns how many leading bits a and b share, at most n
+func commonBits(a, b key, n int) int {
+	c := bits.LeadingZeros64(a.hi ^ b.hi)
+	if c == 64 {
+		c += bits.LeadingZeros64(a.lo ^ b.lo)
+	}
+	return min(c, n)
+}
+
+// node is a prefix in the trie. Nodes without a value only join two
+// branches.
+type node[V any] struct {
+	key   key
+	bits  int
+	set   bool
+	value V
+	child [2]*node[V]
+}
+
+// Trie maps IP prefixes to values. The zero value is an empty trie. It is
+// not safe for concurrent writes.
+type Trie[V any] struct {
+	v4, v6 *node[V]
+	size   int
+}
+
+// root returns the tree an address family lives in
+func (t *Trie[V]) root(addr netip.Addr) **node[V] {
+	if addr.Unmap().Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// prefixKey returns the key and length of a prefix, with IPv4-mapped IPv6
+// prefixes converted to IPv4
+func prefixKey(p netip.Prefix) (key, int) {
+	n := p.Bits()
+	if p.Addr().Is4In6() {
+		n -= 96
+	}
+	return keyOf(p.Addr()).mask(n), n
+}
+
+// Len returns the number of prefixes in the trie
+func (t *Trie[V]) Len() int {
+	return t.size
+}
+
+// Insert sets the value of a prefix, replacing any previous value. Host
+// bits of the prefix are ignored. Invalid prefixes are not inserted.
+func (t *Trie[V]) Insert(p netip.Prefix, value V) {
+	if !p.IsValid() || p.Addr().Is4In6() && p.Bits() < 96 {
+		return
+	}
+	k, n := prefixKey(p)
+	link := t.root(p.Addr())
+	for {
+		cur := *link
+		if cur == nil {
+			*link = &node[V]{key: k, bits: n, set: true, value: value}
+			t.size++
+			return
+		}
+
+		common := commonBits(cur.key, k, min(cur.bits, n))
+		switch {
+		case common == cur.bits && common == n:
+			// The prefix itself
+			if !cur.set {
+				t.size++
+			}
+			cur.set, cur.value = true, value
+			return
+		case common == cur.bits:
+			// Below the current node
+			link = &cur.child[k.bit(cur.bits)]
+			continue
+		case common == n:
+			// Above the current node
+			added := &node[V]{key: k, bits: n, set: true, value: value}
+			added.child[cur.key.bit(n)] = cur
+			*link = added
+		default:
+			// Beside the current node, under a new branch
+			branch := &node[V]{key: k.mask(common), bits: common}
+			branch.child[k.bit(common)] = &node[V]{key: k, bits: n, set: true, value: value}
+			branch.child[cur.key.bit(common)] = cur
+			*link = branch
+		}
+		t.size++
+		return
+	}
+}
+
+// Delete removes a prefix and reports whether it was in the trie
+func (t *Trie[V]) Delete(p netip.Prefix) bool {
+	if !p.IsValid() || p.Addr().Is4In6() && p.Bits() < 96 {
+		return false
+	}
+	k, n := prefixKey(p)
+	link := t.root(p.Addr())
+	var parent **node[V]
+	for {
+		cur := *link
+		if cur == nil || cur.bits > n || commonBits(cur.key, k, cur.bits) < cur.bits {
+			return false
+		}
+		if cur.bits < n {
+			parent, link = link, &cur.child[k.bit(cur.bits)]
+			continue
+		}
+		if !cur.set {
+			return false
+		}
+
+		var zero V
+		cur.set, cur.value = false, zero
+		t.size--
+		t.prune(link)
+		if parent != nil {
+			t.prune(parent)
+		}
+		return true
+	}
+}
+
+// prune removes a node without a value that no longer joins two branches
+func (t *Trie[V]) prune(link **node[V]) {
+	cur := *link
+	if cur == nil || cur.set {
+		return
+	}
+	switch {
+	case cur.child[0] == nil:
+		*link = cur.child[1]
+	case cur.child[1] == nil:
+		*link = cur.child[0]
+	}
+}
+
+// Get returns the value of exactly a prefix
+func (t *Trie[V]) Get(p netip.Prefix) (V, bool) {
+	var found V
+	ok := false
+	_, n := prefixKey(p)
+	t.EachContaining(p, func(q netip.Prefix, v V) bool {
+		if q.Bits() == n {
+			found, ok = v, true
+			return false
+		}
+		return true
+	})
+	return found, ok
+}
+
+// Lookup returns the longest prefix containing an address, with its value
+func (t *Trie[V]) Lookup(addr netip.Addr) (netip.Prefix, V, bool) {
+	var found netip.Prefix
+	var value V
+	ok := false
+	t.EachContaining(netip.PrefixFrom(addr, addr.BitLen()), func(p netip.Prefix, v V) bool {
+		found, value, ok = p, v, true
+		return true
+	})
+	return found, value, ok
+}
+
+// Contains reports whether any prefix contains an address
+func (t *Trie[V]) Contains(addr netip.Addr) bool {
+	found := false
+	t.EachContaining(netip.PrefixFrom(addr, addr.BitLen()), func(netip.Prefix, V) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// EachContaining calls fn for every prefix that contains p, itself
+// included, from the shortest to the longest, until fn returns false.
+// Addresses are looked up as single-address prefixes.
+func (t *Trie[V]) EachContaining(p netip.Prefix, fn func(netip.Prefix, V) bool) {
+	if !p.IsValid() || p.Addr().Is4In6() && p.Bits() < 96 {
+		return
+	}
+	k, n := prefixKey(p)
+	is4 := p.Addr().Unmap().Is4()
+	for cur := *t.root(p.Addr()); cur != nil && cur.bits <= n; {
+		if commonBits(cur.key, k, cur.bits) < cur.bits {
+			return
+		}
+		if cur.set && !fn(cur.prefix(is4), cur.value) {
+			return
+		}
+		if cur.bits == n {
+			return
+		}
+		cur = cur.child[k.bit(cur.bits)]
+	}
+}
+
+// Walk calls fn for every prefix in the trie, in address order with
+// shorter prefixes first, until fn returns false
+func (t *Trie[V]) Walk(fn func(netip.Prefix, V) bool) {
+	if walk(t.v4, true, fn) {
+		walk(t.v6, false, fn)
+	}
+}
+
+// walk visits a subtree, reporting whether to go on
+func walk[V any](n *node[V], is4 bool, fn func(netip.Prefix, V) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.set && !fn(n.prefix(is4), n.value) {
+		return false
+	}
+	return walk(n.child[0], is4, fn) && walk(n.child[1], is4, fn)
+}
+
+// prefix converts a node back to a prefix
+func (n *node[V]) prefix(is4 bool) netip.Prefix {
+	if is4 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(n.key.hi>>32))
+		return netip.PrefixFrom(netip.AddrFrom4(b), n.bits)
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], n.key.hi)
+	binary.BigEndian.PutUint64(b[8:], n.key.lo)
+	return netip.PrefixFrom(netip.AddrFrom16(b), n.bits)
+}
@@ -0,0 +1,120 @@
+package iptrie
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+// benchPrefixes returns n random prefixes, a quarter of them IPv6, sized
+// like blocklist and whitelist entries: /8 to /32 for IPv4, /32 to /128
+// for IPv6.
+func benchPrefixes(n int) []netip.Prefix {
+	r := rand.New(rand.NewSource(1))
+	prefixes := make([]netip.Prefix, n)
+	for i := range prefixes {
+		if i%4 == 3 {
+			var b [16]byte
+			r.Read(b[:])
+			prefixes[i] = netip.PrefixFrom(netip.AddrFrom16(b), 32+r.Intn(97)).Masked()
+			continue
+		}
+		var b [4]byte
+		r.Read(b[:])
+		prefixes[i] = netip.PrefixFrom(netip.AddrFrom4(b), 8+r.Intn(25)).Masked()
+	}
+	return prefixes
+}
+
+// benchAddrs returns n random addresses in the same family mix, most of
+// them outside the benchmark prefixes
+func benchAddrs(n int) []netip.Addr {
+	r := rand.New(rand.NewSource(2))
+	addrs := make([]netip.Addr, n)
+	for i := range addrs {
+		if i%4 == 3 {
+			var b [16]byte
+			r.Read(b[:])
+			addrs[i] = netip.AddrFrom16(b)
+			continue
+		}
+		var b [4]byte
+		r.Read(b[:])
+		addrs[i] = netip.AddrFrom4(b)
+	}
+	return addrs
+}
+
+func benchTrie(prefixes []netip.Prefix) *Trie[int] {
+	t := new(Trie[int])
+	for i, p := range prefixes {
+		t.Insert(p, i)
+	}
+	return t
+}
+
+func BenchmarkInsert(b *testing.B) {
+	prefixes := benchPrefixes(100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchTrie(prefixes)
+	}
+}
+
+func BenchmarkContains(b *testing.B) {
+	t := benchTrie(benchPrefixes(100000))
+	addrs := benchAddrs(1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t.Contains(addrs[i%len(addrs)])
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	prefixes := benchPrefixes(100000)
+	t := benchTrie(prefixes)
+	// Addresses inside the prefixes, so every lookup walks to a match
+	addrs := make([]netip.Addr, 1024)
+	for i := range addrs {
+		addrs[i] = prefixes[i*97%len(prefixes)].Addr()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t.Lookup(addrs[i%len(addrs)])
+	}
+}
+
+func BenchmarkEachContaining(b *testing.B) {
+	prefixes := benchPrefixes(100000)
+	t := benchTrie(prefixes)
+	targets := prefixes[:1024]
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t.EachContaining(targets[i%len(targets)], func(netip.Prefix, int) bool { return true })
+	}
+}
+
+// BenchmarkLinearScan is the scan the trie replaces, for comparison
+func BenchmarkLinearScan(b *testing.B) {
+	prefixes := benchPrefixes(100000)
+	addrs := benchAddrs(1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		addr := addrs[i%len(addrs)]
+		for _, p := range prefixes {
+			if p.Contains(addr) {
+				break
+			}
+		}
+	}
+}
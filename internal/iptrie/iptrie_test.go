@@ -0,0 +1,354 @@
+package iptrie
+
+import (
+	"math/rand"
+	"net/netip"
+	"sort"
+	"testing"
+)
+
+// reference is the linear scan the trie must agree with
+type reference map[netip.Prefix]int
+
+// norm converts a prefix to the form the trie stores it in
+func norm(p netip.Prefix) netip.Prefix {
+	if p.Addr().Is4In6() {
+		return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96).Masked()
+	}
+	return p.Masked()
+}
+
+func (r reference) lookup(addr netip.Addr) (netip.Prefix, int, bool) {
+	addr = addr.Unmap()
+	var best netip.Prefix
+	found := false
+	for p := range r {
+		if p.Contains(addr) && (!found || p.Bits() > best.Bits()) {
+			best, found = p, true
+		}
+	}
+	return best, r[best], found
+}
+
+// sorted returns the prefixes in the order Walk visits them
+func (r reference) sorted() []netip.Prefix {
+	list := make([]netip.Prefix, 0, len(r))
+	for p := range r {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Addr().Is4() != b.Addr().Is4() {
+			return a.Addr().Is4()
+		}
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c < 0
+		}
+		return a.Bits() < b.Bits()
+	})
+	return list
+}
+
+// randomPool returns prefixes clustered under a few networks, so that they
+// nest, overlap and share branch nodes
+func randomPool(r *rand.Rand, n int) []netip.Prefix {
+	bases := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("::ffff:172.16.0.0/108"),
+	}
+	pool := make([]netip.Prefix, n)
+	for i := range pool {
+		pool[i] = randomWithin(r, bases[r.Intn(len(bases))], true)
+	}
+	return pool
+}
+
+// randomWithin returns a random prefix inside base, or a random address in
+// it as a full-length prefix if sub is false
+func randomWithin(r *rand.Rand, base netip.Prefix, sub bool) netip.Prefix {
+	b := base.Addr().As16()
+	offset := 0
+	if base.Addr().Is4() {
+		offset = 96
+	}
+	bits := base.Bits() + offset
+	for i := bits; i < 128; i++ {
+		if r.Intn(2) == 1 {
+			b[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	addr := netip.AddrFrom16(b)
+	if base.Addr().Is4() {
+		addr = addr.Unmap()
+	}
+	n := addr.BitLen()
+	if sub {
+		n = base.Bits() + r.Intn(addr.BitLen()-base.Bits()+1)
+	}
+	return netip.PrefixFrom(addr, n).Masked()
+}
+
+// check compares every query of the trie with the reference
+func check(t *testing.T, tr *Trie[int], ref reference, addrs []netip.Addr) {
+	t.Helper()
+	if tr.Len() != len(ref) {
+		t.Fatalf("Len = %d, want %d", tr.Len(), len(ref))
+	}
+	for _, addr := range addrs {
+		wantP, wantV, wantOK := ref.lookup(addr)
+		p, v, ok := tr.Lookup(addr)
+		if ok != wantOK || ok && (p != wantP || v != wantV) {
+			t.Fatalf("Lookup(%s) = %s %d %v, want %s %d %v", addr, p, v, ok, wantP, wantV, wantOK)
+		}
+		if tr.Contains(addr) != wantOK {
+			t.Fatalf("Contains(%s) = %v, want %v", addr, !wantOK, wantOK)
+		}
+	}
+	var walked []netip.Prefix
+	tr.Walk(func(p netip.Prefix, v int) bool {
+		if ref[p] != v {
+			t.Errorf("Walk: %s = %d, want %d", p, v, ref[p])
+		}
+		walked = append(walked, p)
+		return true
+	})
+	want := ref.sorted()
+	if len(walked) != len(want) {
+		t.Fatalf("Walk visited %d prefixes, want %d", len(walked), len(want))
+	}
+	for i := range want {
+		if walked[i] != want[i] {
+			t.Fatalf("Walk[%d] = %s, want %s", i, walked[i], want[i])
+		}
+	}
+}
+
+func TestRandomAgainstLinearScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	pool := randomPool(r, 200)
+	bases := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("::ffff:172.16.0.0/108"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+	}
+	addrs := make([]netip.Addr, 500)
+	for i := range addrs {
+		addrs[i] = randomWithin(r, bases[r.Intn(len(bases))], false).Addr()
+	}
+
+	tr := new(Trie[int])
+	ref := make(reference)
+	for step := 0; step < 3000; step++ {
+		p := pool[r.Intn(len(pool))]
+		if r.Intn(3) == 0 {
+			_, want := ref[norm(p)]
+			if got := tr.Delete(p); got != want {
+				t.Fatalf("step %d: Delete(%s) = %v, want %v", step, p, got, want)
+			}
+			delete(ref, norm(p))
+		} else {
+			tr.Insert(p, step)
+			ref[norm(p)] = step
+		}
+		if step%100 == 0 {
+			check(t, tr, ref, addrs)
+		}
+	}
+	check(t, tr, ref, addrs)
+
+	// Removing everything leaves an empty trie
+	for p := range ref {
+		if !tr.Delete(p) {
+			t.Fatalf("Delete(%s) = false", p)
+		}
+		delete(ref, p)
+	}
+	check(t, tr, ref, addrs)
+	if tr.v4 != nil || tr.v6 != nil {
+		t.Error("nodes left after deleting every prefix")
+	}
+}
+
+func TestDeletePrunesSharedNodes(t *testing.T) {
+	tr := new(Trie[int])
+	a := netip.MustParsePrefix("10.0.0.0/24")
+	b := netip.MustParsePrefix("10.0.1.0/24")
+	c := netip.MustParsePrefix("10.0.2.0/24")
+	tr.Insert(a, 1)
+	tr.Insert(b, 2)
+	tr.Insert(c, 3)
+
+	// a and b hang under a branch node, which hangs beside c
+	if !tr.Delete(a) {
+		t.Fatal("Delete(a) = false")
+	}
+	if tr.Delete(a) {
+		t.Error("Delete(a) twice = true")
+	}
+	// The branch that joined a and b is gone
+	if tr.v4.bits != 22 || tr.v4.child[0].bits != 24 || tr.v4.child[0].child != [2]*node[int]{} {
+		t.Errorf("branch of a and b was not pruned")
+	}
+	if _, _, ok := tr.Lookup(netip.MustParseAddr("10.0.0.1")); ok {
+		t.Error("10.0.0.1 still matches after deleting a")
+	}
+	for addr, want := range map[string]int{"10.0.1.1": 2, "10.0.2.1": 3} {
+		if _, v, ok := tr.Lookup(netip.MustParseAddr(addr)); !ok || v != want {
+			t.Errorf("Lookup(%s) = %d, %v, want %d", addr, v, ok, want)
+		}
+	}
+
+	// A branch node is not a prefix of its own
+	if tr.Delete(netip.MustParsePrefix("10.0.0.0/22")) {
+		t.Error("deleted a branch node")
+	}
+
+	// Deleting a prefix with children keeps them
+	tr.Insert(netip.MustParsePrefix("10.0.0.0/8"), 4)
+	if !tr.Delete(netip.MustParsePrefix("10.0.0.0/8")) {
+		t.Fatal("Delete(10.0.0.0/8) = false")
+	}
+	if tr.Len() != 2 || !tr.Contains(netip.MustParseAddr("10.0.1.1")) || tr.Contains(netip.MustParseAddr("10.9.0.1")) {
+		t.Error("children were lost with their parent")
+	}
+
+	tr.Delete(b)
+	tr.Delete(c)
+	if tr.Len() != 0 || tr.v4 != nil {
+		t.Errorf("Len = %d, root = %v after deleting everything", tr.Len(), tr.v4)
+	}
+}
+
+func TestMappedIPv4(t *testing.T) {
+	tr := new(Trie[string])
+	tr.Insert(netip.MustParsePrefix("::ffff:10.0.0.0/104"), "mapped")
+	tr.Insert(netip.MustParsePrefix("192.168.0.0/16"), "plain")
+	// Too short to be an IPv4 range
+	tr.Insert(netip.MustParsePrefix("::ffff:0.0.0.0/95"), "invalid")
+
+	if tr.Len() != 2 {
+		t.Errorf("Len = %d, want 2", tr.Len())
+	}
+	// Stored, and found, as IPv4
+	if v, ok := tr.Get(netip.MustParsePrefix("10.0.0.0/8")); !ok || v != "mapped" {
+		t.Errorf("Get(10.0.0.0/8) = %q, %v", v, ok)
+	}
+	p, v, ok := tr.Lookup(netip.MustParseAddr("::ffff:192.168.1.1"))
+	if !ok || v != "plain" || p != netip.MustParsePrefix("192.168.0.0/16") {
+		t.Errorf("Lookup(::ffff:192.168.1.1) = %s %q %v", p, v, ok)
+	}
+	if !tr.Contains(netip.MustParseAddr("10.1.2.3")) {
+		t.Error("10.1.2.3 is not in the mapped range")
+	}
+	// Native IPv6 never matches IPv4 ranges
+	if tr.Contains(netip.MustParseAddr("::a01:203")) {
+		t.Error("IPv6 ::a01:203 matched an IPv4 range")
+	}
+	if !tr.Delete(netip.MustParsePrefix("10.0.0.0/8")) || tr.Contains(netip.MustParseAddr("::ffff:10.1.2.3")) {
+		t.Error("mapped range not deleted through its IPv4 form")
+	}
+	if tr.Delete(netip.MustParsePrefix("::ffff:0.0.0.0/95")) {
+		t.Error("deleted an invalid mapped prefix")
+	}
+}
+
+func TestZeroPrefix(t *testing.T) {
+	tr := new(Trie[int])
+	tr.Insert(netip.MustParsePrefix("0.0.0.0/0"), 4)
+	tr.Insert(netip.MustParsePrefix("10.0.0.0/8"), 8)
+
+	if _, v, ok := tr.Lookup(netip.MustParseAddr("1.2.3.4")); !ok || v != 4 {
+		t.Errorf("Lookup(1.2.3.4) = %d, %v, want the /0", v, ok)
+	}
+	if _, v, ok := tr.Lookup(netip.MustParseAddr("10.1.1.1")); !ok || v != 8 {
+		t.Errorf("Lookup(10.1.1.1) = %d, %v, want the /8", v, ok)
+	}
+	// IPv4 /0 covers IPv4 only
+	if tr.Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("0.0.0.0/0 contains an IPv6 address")
+	}
+
+	tr.Insert(netip.MustParsePrefix("::/0"), 6)
+	if _, v, ok := tr.Lookup(netip.MustParseAddr("2001:db8::1")); !ok || v != 6 {
+		t.Errorf("Lookup(2001:db8::1) = %d, %v, want ::/0", v, ok)
+	}
+
+	var got []int
+	tr.EachContaining(netip.MustParsePrefix("10.2.0.0/16"), func(_ netip.Prefix, v int) bool {
+		got = append(got, v)
+		return true
+	})
+	if len(got) != 2 || got[0] != 4 || got[1] != 8 {
+		t.Errorf("EachContaining(10.2.0.0/16) = %v, want [4 8]", got)
+	}
+
+	if !tr.Delete(netip.MustParsePrefix("0.0.0.0/0")) || tr.Contains(netip.MustParseAddr("1.2.3.4")) {
+		t.Error("0.0.0.0/0 not deleted")
+	}
+	if !tr.Contains(netip.MustParseAddr("10.1.1.1")) {
+		t.Error("10.0.0.0/8 lost with the /0")
+	}
+}
+
+func TestOverlappingPrefixes(t *testing.T) {
+	tr := new(Trie[int])
+	for i, s := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32", "10.1.128.0/17"} {
+		tr.Insert(netip.MustParsePrefix(s), i)
+	}
+	// Host bits are ignored, and a second insert replaces the value
+	tr.Insert(netip.MustParsePrefix("10.1.2.99/24"), 20)
+	if tr.Len() != 5 {
+		t.Errorf("Len = %d, want 5", tr.Len())
+	}
+
+	tests := []struct {
+		addr string
+		want int
+	}{
+		{"10.9.9.9", 0},
+		{"10.1.9.9", 1},
+		{"10.1.2.4", 20},
+		{"10.1.2.3", 3},
+		{"10.1.200.1", 4},
+	}
+	for _, tt := range tests {
+		if _, v, ok := tr.Lookup(netip.MustParseAddr(tt.addr)); !ok || v != tt.want {
+			t.Errorf("Lookup(%s) = %d, %v, want %d", tt.addr, v, ok, tt.want)
+		}
+	}
+
+	var chain []string
+	tr.EachContaining(netip.MustParsePrefix("10.1.2.3/32"), func(p netip.Prefix, _ int) bool {
+		chain = append(chain, p.String())
+		return true
+	})
+	want := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32"}
+	if len(chain) != len(want) {
+		t.Fatalf("EachContaining = %v, want %v", chain, want)
+	}
+	for i := range want {
+		if chain[i] != want[i] {
+			t.Errorf("EachContaining = %v, want %v", chain, want)
+			break
+		}
+	}
+
+	// Stopping early
+	n := 0
+	tr.EachContaining(netip.MustParsePrefix("10.1.2.3/32"), func(netip.Prefix, int) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Errorf("EachContaining went on after fn returned false: %d calls", n)
+	}
+
+	if _, ok := tr.Get(netip.MustParsePrefix("10.1.0.0/15")); ok {
+		t.Error("Get found a prefix that was never inserted")
+	}
+}
@@ -6,13 +6,13 @@ import (
 
 const (
 	// BanStateVersion is the current version of the ban state file
-	BanStateVersion = 2
+	BanStateVersion = 3
 )
 
 // BanState represents the persisted ban state
 type BanState struct {
-	Version     int                `json:"version"`
-	LastUpdated time.Time          `json:"last_updated"`
+	Version     int                  `json:"version"`
+	LastUpdated time.Time            `json:"last_updated"`
 	Bans        map[string]*BannedIP `json:"bans"`
 }
 
@@ -31,9 +31,12 @@ type BannedIP struct {
 	Reason       string    `json:"reason,omitempty"`
 	RuleName     string    `json:"rule_name,omitempty"`
 	BannedAt     time.Time `json:"banned_at"`
-	ExpiresAt    time.Time `json:"expires_at"`    // Zero value = never expires
-	BanCount     int       `json:"ban_count"`     // Number of times this IP has been banned
-	IsPermanent  bool      `json:"is_permanent"` // True if escalated to permanent ban
+	ExpiresAt    time.Time `json:"expires_at"`              // Zero value = never expires
+	BanCount     int       `json:"ban_count"`               // Number of times this IP has been banned
+	IsPermanent  bool      `json:"is_permanent"`            // True if escalated to permanent ban
+	DecayedAt    time.Time `json:"decayed_at"`              // Last time BanCount was reduced for staying clean
+	Evidence     *Evidence `json:"evidence,omitempty"`      // What the peer matched when last banned
+	MatchedRules []string  `json:"matched_rules,omitempty"` // Every rule the peer matched when last banned
 }
 
 // IsExpired checks if the ban has expired
@@ -0,0 +1,32 @@
+package models
+
+// Evidence is a snapshot of what a peer looked like when it was banned, so
+// that a disputed ban can be checked later
+type Evidence struct {
+	TorrentHash   string               `json:"torrent_hash,omitempty"`
+	TorrentName   string               `json:"torrent_name,omitempty"`
+	Port          int                  `json:"port,omitempty"`
+	Client        string               `json:"client,omitempty"`
+	PeerID        string               `json:"peer_id,omitempty"`
+	Flags         string               `json:"flags,omitempty"`
+	Progress      float64              `json:"progress"` // 0-1, as reported by qBittorrent
+	Uploaded      int64                `json:"uploaded"`
+	Downloaded    int64                `json:"downloaded"`
+	Filters       []FilterObservation  `json:"filters,omitempty"`       // Every filter of the deciding rule
+	Score         float64              `json:"score,omitempty"`         // Total score for scoring rules
+	Threshold     float64              `json:"threshold,omitempty"`     // Score needed to ban
+	Contributions []FilterContribution `json:"contributions,omitempty"` // Matched filters and their weights
+}
+
+// FilterObservation is the value a filter saw when the ban was issued
+type FilterObservation struct {
+	Filter   string `json:"filter"`   // The filter as written, e.g. "uploaded < 50%"
+	Observed string `json:"observed"` // The peer's value, e.g. "0.00%"
+	Passed   bool   `json:"passed"`
+}
+
+// FilterContribution is one matched filter's share of a score
+type FilterContribution struct {
+	Filter string  `json:"filter"` // The filter as written, e.g. "uploaded < 50%"
+	Weight float64 `json:"weight"`
+}
@@ -1,38 +1,61 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"github.com/philogag/peer-banner/internal/peerid"
+)
 
 // Peer represents a peer in a torrent
 type Peer struct {
-	IP          string    `json:"ip"`
-	Port        int       `json:"port"`
-	Progress    float64   `json:"progress"`
-	Downloaded  int64     `json:"downloaded"`
-	Uploaded     int64     `json:"uploaded"`
-	Flags       string    `json:"flags"`
-	Relevance   float64   `json:"relevance"`
-	ActiveTime  int       `json:"active_time"` // in seconds
-	Client      string    `json:"client,omitempty"`
-	IsConnected bool      `json:"is_connected,omitempty"`
+	IP          string  `json:"ip"`
+	Port        int     `json:"port"`
+	Progress    float64 `json:"progress"`
+	Downloaded  int64   `json:"downloaded"`
+	Uploaded    int64   `json:"uploaded"`
+	Flags       string  `json:"flags"`
+	Relevance   float64 `json:"relevance"`
+	ActiveTime  int     `json:"active_time"` // in seconds
+	Client      string  `json:"client,omitempty"`
+	PeerID      string  `json:"peer_id_client,omitempty"` // First 8 bytes of the peer ID, e.g. "-qB4630-"
+	IsConnected bool    `json:"is_connected,omitempty"`
+
+	identity *identity // PeerID decoded on first use
+}
+
+// identity is a decoded peer ID
+type identity struct {
+	info peerid.Info
+	ok   bool
+}
+
+// Identity returns the client identity decoded from the peer ID. It is
+// decoded once and kept, since every rule on the peer ID fields asks for it.
+func (p *Peer) Identity() (peerid.Info, bool) {
+	if p.identity == nil {
+		info, ok := peerid.Decode(p.PeerID)
+		p.identity = &identity{info: info, ok: ok}
+	}
+	return p.identity.info, p.identity.ok
 }
 
 // Torrent represents a torrent in qBittorrent
 type Torrent struct {
-	Hash         string   `json:"hash"`
-	Name         string   `json:"name"`
-	Size         int64    `json:"size"`
-	Progress     float64  `json:"progress"`
-	Uploaded     int64    `json:"uploaded"`
-	Downloaded   int64    `json:"downloaded"`
-	Ratio        float64  `json:"ratio"`
-	NumPeers     int      `json:"num_peers"`
-	NumSeeds     int      `json:"num_seeds"`
-	NumLeechers  int      `json:"num_leechers"`
-	SavePath     string   `json:"save_path,omitempty"`
-	Category     string   `json:"category,omitempty"`
-	Tags         string `json:"tags,omitempty"`
-	AddedOn      int64 `json:"added_on,omitempty"`
-	CompletionOn int64 `json:"completion_on,omitempty"`
+	Hash         string  `json:"hash"`
+	Name         string  `json:"name"`
+	Size         int64   `json:"size"`
+	Progress     float64 `json:"progress"`
+	Uploaded     int64   `json:"uploaded"`
+	Downloaded   int64   `json:"downloaded"`
+	Ratio        float64 `json:"ratio"`
+	NumPeers     int     `json:"num_peers"`
+	NumSeeds     int     `json:"num_seeds"`
+	NumLeechers  int     `json:"num_leechers"`
+	SavePath     string  `json:"save_path,omitempty"`
+	Category     string  `json:"category,omitempty"`
+	Tags         string  `json:"tags,omitempty"`
+	AddedOn      int64   `json:"added_on,omitempty"`
+	CompletionOn int64   `json:"completion_on,omitempty"`
 }
 
 // DetectionResult contains the result of a detection run
@@ -40,7 +63,8 @@ type DetectionResult struct {
 	BannedIPs          map[string]*BannedIP
 	TotalPeers         int
 	TotalBanned        int
-	TotalAlreadyBanned  int
+	TotalAlreadyBanned int
+	TotalShadowed      int // Bans not enforced because a safety limit tripped
 	ServerName         string
 	Timestamp          time.Time
 }
@@ -53,13 +77,14 @@ func NewDetectionResult() *DetectionResult {
 }
 
 // AddBannedIP adds an IP to the ban list
-func (r *DetectionResult) AddBannedIP(ip string, reason, ruleName string) {
+func (r *DetectionResult) AddBannedIP(ip string, reason, ruleName string, evidence *Evidence) {
 	if _, exists := r.BannedIPs[ip]; !exists {
 		r.BannedIPs[ip] = &BannedIP{
 			IP:       ip,
 			Reason:   reason,
 			RuleName: ruleName,
 			BannedAt: time.Now(),
+			Evidence: evidence,
 		}
 	}
 }
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/blocklist"
 	"github.com/philogag/peer-banner/internal/config"
 	"github.com/philogag/peer-banner/internal/models"
 )
@@ -17,6 +20,7 @@ type DATWriter struct {
 	format     string
 	datFile    string
 	banManager *ban.Manager
+	blocklists *blocklist.Set
 }
 
 // NewDATWriter creates a new DAT writer
@@ -28,12 +32,18 @@ func NewDATWriter(cfg *config.OutputConfig, banManager *ban.Manager) *DATWriter
 	}
 }
 
+// UseBlocklists adds the ranges of imported blocklists to the output
+func (w *DATWriter) UseBlocklists(set *blocklist.Set) {
+	w.blocklists = set
+}
+
 // Write writes the detection result to the DAT file
 func (w *DATWriter) Write(result *models.DetectionResult, dryRun bool) error {
-	// Get all active bans from manager (including persistent bans from previous runs)
+	// Get all active bans from manager (including persistent bans from previous
+	// runs), with pardoned IPs carved out of range bans
 	var activeBans []*models.BannedIP
 	if w.banManager != nil {
-		activeBans = w.banManager.GetActiveBans()
+		activeBans = w.banManager.OutputBans()
 	} else {
 		// Fallback to result-based (old behavior)
 		activeBans = make([]*models.BannedIP, 0, len(result.BannedIPs))
@@ -42,21 +52,28 @@ func (w *DATWriter) Write(result *models.DetectionResult, dryRun bool) error {
 		}
 	}
 
+	// Blocklists are written after the bans, tagged with their source
+	var lists []blocklist.List
+	if w.blocklists != nil {
+		lists = w.blocklists.Lists()
+	}
+
 	var content string
 
 	switch w.format {
 	case "peerbanana":
-		content = w.formatPeerBanana(activeBans, result.Timestamp)
+		content = w.formatPeerBanana(activeBans, lists, result.Timestamp)
 	case "plain":
-		content = w.formatPlain(activeBans)
+		content = w.formatPlain(activeBans, lists)
 	default:
-		content = w.formatPeerBanana(activeBans, result.Timestamp)
+		content = w.formatPeerBanana(activeBans, lists, result.Timestamp)
 	}
 
 	if dryRun {
 		fmt.Println("=== Dry Run Mode - No changes written ===")
 		fmt.Println("Output would be:")
 		fmt.Println(content)
+		printNewBans(result)
 		fmt.Println("=========================================")
 		return nil
 	}
@@ -75,8 +92,27 @@ func (w *DATWriter) Write(result *models.DetectionResult, dryRun bool) error {
 	return nil
 }
 
+// printNewBans lists the bans issued by this detection run with their evidence
+func printNewBans(result *models.DetectionResult) {
+	if len(result.BannedIPs) == 0 {
+		return
+	}
+	ips := make([]string, 0, len(result.BannedIPs))
+	for ip := range result.BannedIPs {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	fmt.Println("New bans:")
+	for _, ip := range ips {
+		b := result.BannedIPs[ip]
+		fmt.Printf("  %s (rule: %s)\n", b.IP, b.RuleName)
+		fmt.Print(FormatEvidence(b.Evidence, "    "))
+	}
+}
+
 // formatPeerBanana formats the result in PeerBanana format
-func (w *DATWriter) formatPeerBanana(bans []*models.BannedIP, timestamp time.Time) string {
+func (w *DATWriter) formatPeerBanana(bans []*models.BannedIP, lists []blocklist.List, timestamp time.Time) string {
 	tmpl := `# PeerBanana DAT File
 # Generated by qBittorrent Leecher Banner
 # Date: {{ .Timestamp }}
@@ -85,25 +121,38 @@ func (w *DATWriter) formatPeerBanana(bans []*models.BannedIP, timestamp time.Tim
 {{- range .Bans }}
 {{ .IP }}
 {{- end }}
+{{- range .Blocklists }}
+# Blocklist: {{ .Name }} ({{ len .Prefixes }} ranges from {{ .Source }})
+{{- range .Prefixes }}
+{{ . }}
+{{- end }}
+{{- end }}
 `
 	data := struct {
-		Bans      []*models.BannedIP
-		Count     int
-		Timestamp time.Time
+		Bans       []*models.BannedIP
+		Blocklists []blocklist.List
+		Count      int
+		Timestamp  time.Time
 	}{
-		Bans:      bans,
-		Count:     len(bans),
-		Timestamp: timestamp,
+		Bans:       bans,
+		Blocklists: lists,
+		Count:      len(bans),
+		Timestamp:  timestamp,
 	}
 	return w.executeTemplate(tmpl, data)
 }
 
 // formatPlain formats the result in plain IP list format
-func (w *DATWriter) formatPlain(bans []*models.BannedIP) string {
+func (w *DATWriter) formatPlain(bans []*models.BannedIP, lists []blocklist.List) string {
 	var ips []string
 	for _, ban := range bans {
 		ips = append(ips, ban.IP)
 	}
+	for _, l := range lists {
+		for _, p := range l.Prefixes {
+			ips = append(ips, p.String())
+		}
+	}
 	return joinWithNewline(ips)
 }
 
@@ -115,35 +164,19 @@ func (w *DATWriter) executeTemplate(tmplStr string, data interface{}) string {
 		return fmt.Sprintf("Error formatting template: %v", err)
 	}
 
-	var buf string
-	err = tmpl.Execute(&stringWriter{&buf}, data)
+	// Blocklists make for large outputs; build them without copying
+	var buf strings.Builder
+	err = tmpl.Execute(&buf, data)
 	if err != nil {
 		return fmt.Sprintf("Error executing template: %v", err)
 	}
 
-	return buf
-}
-
-// stringWriter implements io.Writer for strings.Builder
-type stringWriter struct {
-	s *string
-}
-
-func (w *stringWriter) Write(p []byte) (n int, err error) {
-	*w.s += string(p)
-	return len(p), nil
+	return buf.String()
 }
 
 // joinWithNewline joins strings with newlines
 func joinWithNewline(items []string) string {
-	if len(items) == 0 {
-		return ""
-	}
-	result := items[0]
-	for i := 1; i < len(items); i++ {
-		result += "\n" + items[i]
-	}
-	return result
+	return strings.Join(items, "\n")
 }
 
 // DATFile returns the path to the DAT file
@@ -158,11 +191,16 @@ func (w *DATWriter) Format() string {
 
 // GetStats returns statistics about the ban list
 func GetStats(result *models.DetectionResult) string {
+	shadowed := ""
+	if result.TotalShadowed > 0 {
+		shadowed = fmt.Sprintf(" | Not enforced: %d", result.TotalShadowed)
+	}
 	return fmt.Sprintf(
-		"Server: %s | Total Peers: %d | Banned: %d | Timestamp: %s",
+		"Server: %s | Total Peers: %d | Banned: %d%s | Timestamp: %s",
 		result.ServerName,
 		result.TotalPeers,
 		result.TotalBanned,
+		shadowed,
 		result.Timestamp.Format(time.RFC3339),
 	)
 }
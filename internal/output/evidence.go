@@ -0,0 +1,37 @@
+package output
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/philogag/peer-banner/internal/models"
+	"github.com/philogag/peer-banner/internal/units"
+)
+
+// FormatEvidence formats a ban's evidence as indented lines for display
+func FormatEvidence(e *models.Evidence, indent string) string {
+	if e == nil {
+		return indent + "no evidence recorded\n"
+	}
+
+	var b strings.Builder
+	if e.TorrentHash != "" || e.TorrentName != "" {
+		fmt.Fprintf(&b, "%storrent %q (%s)\n", indent, e.TorrentName, e.TorrentHash)
+	}
+	if e.PeerID != "" {
+		fmt.Fprintf(&b, "%speer ID %q\n", indent, e.PeerID)
+	}
+	fmt.Fprintf(&b, "%sport %d, client %q, flags %q, progress %.2f%%, downloaded %s, uploaded %s\n",
+		indent, e.Port, e.Client, e.Flags, e.Progress*100, units.FormatSize(e.Downloaded), units.FormatSize(e.Uploaded))
+	for _, f := range e.Filters {
+		result := "fail"
+		if f.Passed {
+			result = "pass"
+		}
+		fmt.Fprintf(&b, "%s%s: observed %s (%s)\n", indent, f.Filter, f.Observed, result)
+	}
+	if len(e.Contributions) > 0 || e.Threshold > 0 {
+		fmt.Fprintf(&b, "%sscore %g/%g\n", indent, e.Score, e.Threshold)
+	}
+	return b.String()
+}
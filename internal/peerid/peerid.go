@@ -0,0 +1,241 @@
+// Package peerid decodes the client identity encoded in a BitTorrent peer ID.
+//
+// qBittorrent reports the first 8 bytes of the peer ID as peer_id_client.
+// Two encodings are recognised:
+//
+//	Azureus style: "-qB4630-"  dash, 2-letter client code, 4 version characters, dash
+//	Shadow style:  "T03I----"  1-letter client code, up to 5 version characters, dashes
+//
+// The handshake client string can be set to anything, while the peer ID is
+// what the client actually announces to trackers. Leech clients that pose as
+// well-known clients often forget to change one of the two.
+package peerid
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Style is the encoding of a peer ID
+type Style int
+
+const (
+	// Azureus is the "-XXVVVV-" style used by most modern clients
+	Azureus Style = iota + 1
+	// Shadow is the "XVVVVV--" style used by older clients
+	Shadow
+)
+
+// client is a known client with the names it uses in handshake strings
+type client struct {
+	name    string
+	aliases []string // Other names the same client goes by, lower case
+}
+
+// azureusClients maps Azureus-style client codes to clients
+var azureusClients = map[string]client{
+	"7T": {name: "aTorrent"},
+	"AG": {name: "Ares"},
+	"AZ": {name: "Vuze", aliases: []string{"azureus"}},
+	"BC": {name: "BitComet"},
+	"BI": {name: "BiglyBT"},
+	"BN": {name: "Baidu Netdisk", aliases: []string{"baidu"}},
+	"BT": {name: "BitTorrent"},
+	"DE": {name: "Deluge"},
+	"FD": {name: "Free Download Manager", aliases: []string{"fdm"}},
+	"FW": {name: "FrostWire"},
+	"KT": {name: "KTorrent"},
+	"LT": {name: "libtorrent", aliases: []string{"libtorrent (rasterbar)"}},
+	"lt": {name: "libTorrent", aliases: []string{"rtorrent", "libtorrent (rakshasa)"}},
+	"PI": {name: "PicoTorrent"},
+	"qB": {name: "qBittorrent"},
+	"QD": {name: "QQDownload", aliases: []string{"qq"}},
+	"SD": {name: "Thunder", aliases: []string{"xunlei"}},
+	"TR": {name: "Transmission"},
+	"UM": {name: "µTorrent Mac", aliases: []string{"utorrent", "µtorrent"}},
+	"UT": {name: "µTorrent", aliases: []string{"utorrent"}},
+	"WW": {name: "WebTorrent"},
+	"XF": {name: "Xfplay"},
+	"XL": {name: "Xunlei", aliases: []string{"thunder"}},
+}
+
+// shadowClients maps Shadow-style client codes to clients
+var shadowClients = map[byte]client{
+	'A': {name: "ABC"},
+	'O': {name: "Osprey Permaseed"},
+	'Q': {name: "BTQueue"},
+	'R': {name: "Tribler"},
+	'S': {name: "Shadow"},
+	'T': {name: "BitTornado"},
+	'U': {name: "UPnP NAT Bit Torrent"},
+}
+
+// Info is a client identity decoded from a peer ID
+type Info struct {
+	Style   Style
+	Code    string // The client code, e.g. "qB"
+	Name    string // The client name, empty when the code is not known
+	Version string // Dotted version, e.g. "4.6.3"
+	aliases []string
+}
+
+// String formats the identity as "name version", falling back to the code
+// for unknown clients
+func (i Info) String() string {
+	name := i.Name
+	if name == "" {
+		name = "unknown (" + i.Code + ")"
+	}
+	if i.Version == "" {
+		return name
+	}
+	return name + " " + i.Version
+}
+
+// Known reports whether the client code is a known client
+func (i Info) Known() bool {
+	return i.Name != ""
+}
+
+// Decode decodes the client identity from a peer ID or its prefix. It
+// reports false when the ID is in neither style.
+func Decode(id string) (Info, bool) {
+	if info, ok := decodeAzureus(id); ok {
+		return info, true
+	}
+	return decodeShadow(id)
+}
+
+// decodeAzureus decodes "-XXVVVV-"
+func decodeAzureus(id string) (Info, bool) {
+	if len(id) < 8 || id[0] != '-' || id[7] != '-' {
+		return Info{}, false
+	}
+	code := id[1:3]
+	if !isAlnum(code[0]) || !isAlnum(code[1]) {
+		return Info{}, false
+	}
+
+	parts := make([]string, 0, 4)
+	for i := 3; i < 7; i++ {
+		v := azureusDigit(id[i])
+		if v < 0 {
+			return Info{}, false
+		}
+		// The fourth character is a build number, only shown when set
+		if i == 6 && v == 0 {
+			break
+		}
+		parts = append(parts, strconv.Itoa(v))
+	}
+
+	c := azureusClients[code]
+	return Info{
+		Style:   Azureus,
+		Code:    code,
+		Name:    c.name,
+		Version: strings.Join(parts, "."),
+		aliases: c.aliases,
+	}, true
+}
+
+// decodeShadow decodes "XVVVVV--" where the version ends at the first dash
+func decodeShadow(id string) (Info, bool) {
+	if len(id) < 3 {
+		return Info{}, false
+	}
+	c, ok := shadowClients[id[0]]
+	if !ok {
+		return Info{}, false
+	}
+
+	var parts []string
+	i := 1
+	for ; i < len(id) && i <= 5 && id[i] != '-'; i++ {
+		v := shadowDigit(id[i])
+		if v < 0 {
+			return Info{}, false
+		}
+		parts = append(parts, strconv.Itoa(v))
+	}
+	// At least one version character, followed by the dash padding
+	if len(parts) == 0 || i >= len(id) || id[i] != '-' {
+		return Info{}, false
+	}
+
+	return Info{
+		Style:   Shadow,
+		Code:    id[:1],
+		Name:    c.name,
+		Version: strings.Join(parts, "."),
+		aliases: c.aliases,
+	}, true
+}
+
+// Mismatch reports whether a peer ID and a handshake client string name
+// different clients. It is false when either side cannot be identified.
+func Mismatch(id, clientString string) bool {
+	info, ok := Decode(id)
+	return ok && info.Mismatch(clientString)
+}
+
+// Mismatch reports whether a handshake client string names a different
+// client than the decoded one. It is false when either side is unknown.
+func (i Info) Mismatch(clientString string) bool {
+	clientString = strings.TrimSpace(clientString)
+	if clientString == "" || strings.EqualFold(clientString, "unknown") {
+		return false
+	}
+	if !i.Known() {
+		return false
+	}
+	if containsFold(clientString, i.Name) {
+		return false
+	}
+	for _, alias := range i.aliases {
+		if containsFold(clientString, alias) {
+			return false
+		}
+	}
+	return true
+}
+
+// azureusDigit decodes an Azureus version character: 0-9, then A-Z and
+// a-z for 10-35
+func azureusDigit(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 10
+	}
+	return -1
+}
+
+// shadowDigit decodes a Shadow version character: 0-9, A-Z for 10-35,
+// a-z for 36-61 and '.' for 62
+func shadowDigit(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36
+	case c == '.':
+		return 62
+	}
+	return -1
+}
+
+// isAlnum reports whether c is an ASCII letter or digit
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// containsFold reports whether substr is within s, ignoring case
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
@@ -0,0 +1,134 @@
+package peerid
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		id     string
+		ok     bool
+		style  Style
+		code   string
+		name   string
+		str    string
+		known  bool
+		reason string
+	}{
+		// Azureus style
+		{id: "-qB4630-", ok: true, style: Azureus, code: "qB", name: "qBittorrent", str: "qBittorrent 4.6.3", known: true},
+		{id: "-TR4050-", ok: true, style: Azureus, code: "TR", name: "Transmission", str: "Transmission 4.0.5", known: true},
+		{id: "-UT355W-", ok: true, style: Azureus, code: "UT", name: "µTorrent", str: "µTorrent 3.5.5.32", known: true, reason: "letters are 10-35"},
+		{id: "-XL0019-", ok: true, style: Azureus, code: "XL", name: "Xunlei", str: "Xunlei 0.0.1.9", known: true},
+		{id: "-SD0100-", ok: true, style: Azureus, code: "SD", name: "Thunder", str: "Thunder 0.1.0", known: true},
+		{id: "-lt0D80-", ok: true, style: Azureus, code: "lt", name: "libTorrent", str: "libTorrent 0.13.8", known: true, reason: "codes are case sensitive"},
+		{id: "-LT2090-", ok: true, style: Azureus, code: "LT", name: "libtorrent", str: "libtorrent 2.0.9", known: true},
+		{id: "-BC0206-", ok: true, style: Azureus, code: "BC", name: "BitComet", str: "BitComet 0.2.0.6", known: true},
+		{id: "-ZZ1234-", ok: true, style: Azureus, code: "ZZ", str: "unknown (ZZ) 1.2.3.4", reason: "unknown code"},
+		{id: "-qB4630-\x01\x02garbage", ok: true, style: Azureus, code: "qB", name: "qBittorrent", str: "qBittorrent 4.6.3", known: true, reason: "full peer ID"},
+		{id: "-qB46!0-", reason: "bad version character"},
+		{id: "-q!4630-", reason: "bad code character"},
+		{id: "-qB4630", reason: "too short"},
+		{id: "-qB46300", reason: "no closing dash"},
+
+		// Shadow style
+		{id: "T03I----", ok: true, style: Shadow, code: "T", name: "BitTornado", str: "BitTornado 0.3.18", known: true},
+		{id: "S58B----", ok: true, style: Shadow, code: "S", name: "Shadow", str: "Shadow 5.8.11", known: true},
+		{id: "A310----", ok: true, style: Shadow, code: "A", name: "ABC", str: "ABC 3.1.0", known: true},
+		{id: "R1------", ok: true, style: Shadow, code: "R", name: "Tribler", str: "Tribler 1", known: true},
+		{id: "Qa.-----", ok: true, style: Shadow, code: "Q", name: "BTQueue", str: "BTQueue 36.62", known: true, reason: "a-z are 36-61, '.' is 62"},
+		{id: "T-------", reason: "no version"},
+		{id: "T03", reason: "no dash padding"},
+		{id: "Tabcdef-", reason: "version longer than 5"},
+		{id: "X03I----", reason: "unknown shadow code"},
+		{id: "M4-20-8-", reason: "Mainline style is not decoded"},
+
+		{id: "", reason: "empty"},
+	}
+	for _, tt := range tests {
+		info, ok := Decode(tt.id)
+		if ok != tt.ok {
+			t.Errorf("Decode(%q) ok = %v, want %v (%s)", tt.id, ok, tt.ok, tt.reason)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if info.Style != tt.style || info.Code != tt.code || info.Name != tt.name || info.Known() != tt.known {
+			t.Errorf("Decode(%q) = %+v, want style %d, code %q, name %q (%s)", tt.id, info, tt.style, tt.code, tt.name, tt.reason)
+		}
+		if got := info.String(); got != tt.str {
+			t.Errorf("Decode(%q).String() = %q, want %q", tt.id, got, tt.str)
+		}
+	}
+}
+
+func TestMismatch(t *testing.T) {
+	tests := []struct {
+		id, client string
+		want       bool
+	}{
+		{"-qB4630-", "qBittorrent/4.6.3", false},
+		{"-qB4630-", "qbittorrent 4.6.3", false},
+		{"-qB4630-", "Xunlei 0.0.1.9", true},
+		{"-TR4050-", "Transmission 4.0.5", false},
+		{"-TR4050-", "qBittorrent/4.6.3", true},
+
+		// Aliases
+		{"-XL0019-", "Thunder 7.10", false},
+		{"-XL0019-", "Xunlei 0019", false},
+		{"-SD0100-", "Xunlei 0.0.1", false},
+		{"-UT355W-", "uTorrent 3.5.5", false},
+		{"-UT355W-", "µTorrent 3.5.5", false},
+		{"-UM1870-", "uTorrent Mac 1.8.7", false},
+		{"-lt0D80-", "rtorrent/0.9.8/0.13.8", false},
+		{"-lt0D80-", "libTorrent (Rakshasa) 0.13.8", false},
+		{"-LT2090-", "libtorrent (Rasterbar) 2.0.9", false},
+		{"-AZ5750-", "Azureus 5.7.5.0", false},
+		{"-AZ5750-", "Vuze 5.7.5.0", false},
+		{"-AZ5750-", "BiglyBT 3.5.0.0", true},
+		{"-BN0001-", "Baidu Netdisk", false},
+		{"-FD51W0-", "FDM 6.19", false},
+		{"-QD1000-", "QQ 1.0", false},
+		{"-QD1000-", "qBittorrent/4.6.3", true},
+		{"T03I----", "BitTornado 0.3.18", false},
+		{"T03I----", "qBittorrent/4.6.3", true},
+
+		// Either side unknown
+		{"-ZZ1234-", "qBittorrent/4.6.3", false},
+		{"garbage!", "qBittorrent/4.6.3", false},
+		{"-qB4630-", "", false},
+		{"-qB4630-", "  ", false},
+		{"-qB4630-", "Unknown", false},
+	}
+	for _, tt := range tests {
+		if got := Mismatch(tt.id, tt.client); got != tt.want {
+			t.Errorf("Mismatch(%q, %q) = %v, want %v", tt.id, tt.client, got, tt.want)
+		}
+	}
+}
+
+// Every alias is lower case, as Mismatch compares it folded, and no alias
+// repeats the client's own name
+func TestAliases(t *testing.T) {
+	check := func(code string, c client) {
+		for _, alias := range c.aliases {
+			if alias != strings.ToLower(alias) {
+				t.Errorf("%s: alias %q is not lower case", code, alias)
+			}
+			if alias == strings.ToLower(c.name) {
+				t.Errorf("%s: alias %q repeats the name", code, alias)
+			}
+		}
+	}
+	for code, c := range azureusClients {
+		check(code, c)
+		if len(code) != 2 || !isAlnum(code[0]) || !isAlnum(code[1]) {
+			t.Errorf("invalid Azureus code %q", code)
+		}
+	}
+	for code, c := range shadowClients {
+		check(string(code), c)
+	}
+}
@@ -0,0 +1,160 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+	"github.com/philogag/peer-banner/internal/units"
+)
+
+// Example is a fixture a rule must classify as expected
+type Example struct {
+	Name    string
+	Expect  bool // true = match, false = no match
+	Peer    models.Peer
+	Torrent models.Torrent
+}
+
+// ParseExample converts an example config into peer and torrent values
+func ParseExample(cfg config.ExampleConfig) (*Example, error) {
+	ex := &Example{Name: cfg.Name}
+	switch cfg.Expect {
+	case config.ExpectMatch:
+		ex.Expect = true
+	case config.ExpectNoMatch:
+		ex.Expect = false
+	default:
+		return nil, fmt.Errorf("expect must be %s or %s, got %q", config.ExpectMatch, config.ExpectNoMatch, cfg.Expect)
+	}
+
+	peer, err := ParsePeerFixture(cfg.Peer)
+	if err != nil {
+		return nil, fmt.Errorf("peer: %w", err)
+	}
+	torrent, err := ParseTorrentFixture(cfg.Torrent)
+	if err != nil {
+		return nil, fmt.Errorf("torrent: %w", err)
+	}
+	ex.Peer, ex.Torrent = *peer, *torrent
+	return ex, nil
+}
+
+// ParsePeerFixture converts a peer fixture into a peer. Unset numeric
+// values are zero.
+func ParsePeerFixture(cfg config.PeerFixture) (*models.Peer, error) {
+	peer := &models.Peer{
+		IP:     cfg.IP,
+		Port:   cfg.Port,
+		Client: cfg.Client,
+		PeerID: cfg.PeerID,
+		Flags:  cfg.Flags,
+	}
+
+	if cfg.Progress != "" {
+		v, err := parsePercentOrNumber(cfg.Progress)
+		if err != nil {
+			return nil, fmt.Errorf("progress: %w", err)
+		}
+		peer.Progress = v / 100
+	}
+	if cfg.Uploaded != "" {
+		v, err := units.ParseSize(cfg.Uploaded)
+		if err != nil {
+			return nil, fmt.Errorf("uploaded: %w", err)
+		}
+		peer.Uploaded = v
+	}
+	if cfg.Downloaded != "" {
+		v, err := units.ParseSize(cfg.Downloaded)
+		if err != nil {
+			return nil, fmt.Errorf("downloaded: %w", err)
+		}
+		peer.Downloaded = v
+	}
+	if cfg.Relevance != "" {
+		v, err := units.ParseNumber(cfg.Relevance)
+		if err != nil {
+			return nil, fmt.Errorf("relevance: %w", err)
+		}
+		peer.Relevance = v
+	}
+	if cfg.ActiveTime != "" {
+		v, err := units.ParseDuration(cfg.ActiveTime)
+		if err != nil {
+			return nil, fmt.Errorf("active_time: %w", err)
+		}
+		peer.ActiveTime = int(v.Seconds())
+	}
+	return peer, nil
+}
+
+// ParseTorrentFixture converts a torrent fixture into a torrent
+func ParseTorrentFixture(cfg config.TorrentFixture) (*models.Torrent, error) {
+	torrent := &models.Torrent{
+		Name:     cfg.Name,
+		Category: cfg.Category,
+		Tags:     cfg.Tags,
+	}
+	if cfg.Size != "" {
+		v, err := units.ParseSize(cfg.Size)
+		if err != nil {
+			return nil, fmt.Errorf("size: %w", err)
+		}
+		torrent.Size = v
+	}
+	return torrent, nil
+}
+
+// parsePercentOrNumber accepts "99" or "99%"
+func parsePercentOrNumber(s string) (float64, error) {
+	if units.IsPercent(s) {
+		return units.ParsePercent(s)
+	}
+	return units.ParseNumber(s)
+}
+
+// CheckExamples evaluates the rule's examples and reports every example
+// whose outcome differs from its expectation. A disabled rule is checked
+// as if it were enabled.
+func (r *Rule) CheckExamples() error {
+	var errs []error
+	for i, ex := range r.Examples {
+		name := ex.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if got := r.evaluate(&ex.Peer, &ex.Torrent).Matched; got != ex.Expect {
+			errs = append(errs, fmt.Errorf("rule %s: example %q: expected %s, got %s (%s)",
+				r.label(), name, expectation(ex.Expect), expectation(got), r.describeFilters(&ex.Peer, &ex.Torrent)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// describeFilters lists which filters pass for a peer, for failure messages
+func (r *Rule) describeFilters(peer *models.Peer, torrent *models.Torrent) string {
+	parts := make([]string, 0, len(r.Filters))
+	for _, f := range r.Filters {
+		state := "fail"
+		if f.Match(peer, torrent) {
+			state = "pass"
+		}
+		parts = append(parts, fmt.Sprintf("%s: %s", f, state))
+	}
+	if r.Type == config.RuleTypeScoring {
+		verdict := r.evaluate(peer, torrent)
+		parts = append(parts, fmt.Sprintf("score %g/%g", verdict.Score, r.Threshold))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// expectation names a match outcome as written in the config
+func expectation(match bool) string {
+	if match {
+		return config.ExpectMatch
+	}
+	return config.ExpectNoMatch
+}
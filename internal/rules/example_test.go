@@ -0,0 +1,131 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/philogag/peer-banner/internal/config"
+)
+
+// exampleRule is a rule banning peers that download with a leecher client
+func exampleRule(enabled bool, examples ...config.ExampleConfig) config.RuleConfig {
+	return config.RuleConfig{
+		Name:        "leecher",
+		Enabled:     enabled,
+		Action:      "ban",
+		BanDuration: "24h",
+		Filters: []config.FilterConfig{
+			{Field: "client", Operator: "include", Value: "Xunlei"},
+			{Field: "downloaded", Operator: ">=", Value: "1GB"},
+		},
+		Examples: examples,
+	}
+}
+
+var (
+	leecherMatch = config.ExampleConfig{
+		Name:   "xunlei",
+		Expect: config.ExpectMatch,
+		Peer:   config.PeerFixture{Client: "Xunlei 0.0.1.9", Downloaded: "2GiB"},
+	}
+	leecherNoMatch = config.ExampleConfig{
+		Name:   "qbittorrent",
+		Expect: config.ExpectNoMatch,
+		Peer:   config.PeerFixture{Client: "qBittorrent 4.6.0", Downloaded: "2GiB"},
+	}
+	// Expects a match the rule doesn't make
+	wrongExample = config.ExampleConfig{
+		Name:   "small download",
+		Expect: config.ExpectMatch,
+		Peer:   config.PeerFixture{Client: "Xunlei 0.0.1.9", Downloaded: "10MiB"},
+	}
+)
+
+func TestParseRulesExamples(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    config.RuleConfig
+		rules   int
+		wantErr string
+	}{
+		{"passing", exampleRule(true, leecherMatch, leecherNoMatch), 1, ""},
+		{"failing", exampleRule(true, leecherMatch, wrongExample), 0, `example "small download": expected match, got no_match`},
+		{"disabled passing", exampleRule(false, leecherMatch, leecherNoMatch), 0, ""},
+		{"disabled failing", exampleRule(false, wrongExample), 0, `example "small download"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseRules([]config.RuleConfig{tt.rule})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parsed) != tt.rules {
+				t.Errorf("ParseRules returned %d rules, want %d", len(parsed), tt.rules)
+			}
+		})
+	}
+}
+
+func TestParseRulesDisabledInvalid(t *testing.T) {
+	rule := exampleRule(false)
+	rule.Filters = append(rule.Filters, config.FilterConfig{Field: "downloaded", Operator: ">=", Value: "lots"})
+	if _, err := ParseRules([]config.RuleConfig{rule}); err == nil {
+		t.Error("an invalid filter on a disabled rule was accepted")
+	}
+	// ParseRule alone still skips disabled rules
+	if r, err := ParseRule(&rule); r != nil || err != nil {
+		t.Errorf("ParseRule = %v, %v, want nil, nil", r, err)
+	}
+}
+
+func TestPeerIDFields(t *testing.T) {
+	rule := config.RuleConfig{
+		Name:        "fake_qbittorrent",
+		Enabled:     true,
+		BanDuration: "24h",
+		Filters: []config.FilterConfig{
+			{Field: "peer_client", Operator: "include", Value: "Xunlei"},
+			{Field: "client_mismatch", Operator: "==", Value: "true"},
+		},
+		Examples: []config.ExampleConfig{
+			{Name: "posing", Expect: config.ExpectMatch, Peer: config.PeerFixture{PeerID: "-XL0019-", Client: "qBittorrent/4.6.3"}},
+			{Name: "honest", Expect: config.ExpectNoMatch, Peer: config.PeerFixture{PeerID: "-XL0019-", Client: "Xunlei 0.0.1.9"}},
+			{Name: "alias", Expect: config.ExpectNoMatch, Peer: config.PeerFixture{PeerID: "-XL0019-", Client: "Thunder 7.10"}},
+			{Name: "real qbittorrent", Expect: config.ExpectNoMatch, Peer: config.PeerFixture{PeerID: "-qB4630-", Client: "qBittorrent/4.6.3"}},
+			{Name: "no peer id", Expect: config.ExpectNoMatch, Peer: config.PeerFixture{Client: "qBittorrent/4.6.3"}},
+		},
+	}
+	if _, err := ParseRules([]config.RuleConfig{rule}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScoringZeroWeight(t *testing.T) {
+	zero, two := 0.0, 2.0
+	rule := config.RuleConfig{
+		Name:        "scored",
+		Enabled:     true,
+		Type:        config.RuleTypeScoring,
+		Threshold:   2,
+		BanDuration: "24h",
+		Filters: []config.FilterConfig{
+			{Field: "client", Operator: "include", Value: "Xunlei", Weight: &two},
+			{Field: "downloaded", Operator: ">=", Value: "1GB", Weight: &zero},
+			{Field: "progress", Operator: ">=", Value: "50"}, // Unset weight counts 1
+		},
+		Examples: []config.ExampleConfig{
+			{Name: "client", Expect: config.ExpectMatch, Peer: config.PeerFixture{Client: "Xunlei 0.0.1.9"}},
+			{Name: "zero weight only", Expect: config.ExpectNoMatch, Peer: config.PeerFixture{Client: "qBittorrent 4.6.0", Downloaded: "2GiB"}},
+			{Name: "zero weight and default", Expect: config.ExpectNoMatch, Peer: config.PeerFixture{Client: "qBittorrent 4.6.0", Downloaded: "2GiB", Progress: "90"}},
+		},
+	}
+	if _, err := ParseRules([]config.RuleConfig{rule}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,136 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// External runs the command that decides an external rule. Peers that pass
+// the rule's filters are candidates; the command receives them in one batch
+// on stdin and answers with a verdict per peer on stdout.
+type External struct {
+	Command    []string
+	Timeout    time.Duration
+	FailClosed bool // Ban every candidate when the command fails
+}
+
+// ExternalPeer is a candidate peer as sent to the command
+type ExternalPeer struct {
+	models.Peer
+	Torrent *models.Torrent `json:"torrent"`
+}
+
+// ExternalRequest is written to the command's stdin
+type ExternalRequest struct {
+	Rule   string          `json:"rule"`
+	Server string          `json:"server"`
+	Peers  []*ExternalPeer `json:"peers"`
+}
+
+// ExternalVerdict is the command's decision for one peer
+type ExternalVerdict struct {
+	IP       string `json:"ip"`
+	Ban      bool   `json:"ban"`
+	Duration string `json:"duration,omitempty"` // Same grammar as ban_duration; empty = the rule's
+	Reason   string `json:"reason,omitempty"`
+
+	duration time.Duration // Parsed Duration, 0 = permanent
+}
+
+// externalResponse is read from the command's stdout
+type externalResponse struct {
+	Verdicts []ExternalVerdict `json:"verdicts"`
+}
+
+// newExternal builds the runner for an external rule config
+func newExternal(cfg *config.ExternalConfig) (*External, error) {
+	timeout, err := cfg.GetTimeout()
+	if err != nil {
+		return nil, fmt.Errorf("timeout: %w", err)
+	}
+	return &External{
+		Command:    cfg.Command,
+		Timeout:    timeout,
+		FailClosed: cfg.GetOnFailure() == config.FailClosed,
+	}, nil
+}
+
+// Decide runs the command for a batch of candidates and returns its
+// verdicts by IP. Any failure, including an invalid verdict, fails the
+// whole batch so that the rule's failure mode applies.
+func (e *External) Decide(req *ExternalRequest) (map[string]ExternalVerdict, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.Command[0], e.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Don't wait on children that inherited the pipes after a kill
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%s timed out after %s", e.Command[0], e.Timeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %w: %s", e.Command[0], err, firstLine(msg))
+		}
+		return nil, fmt.Errorf("%s: %w", e.Command[0], err)
+	}
+
+	var resp externalResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("%s: invalid output: %w", e.Command[0], err)
+	}
+
+	verdicts := make(map[string]ExternalVerdict, len(resp.Verdicts))
+	for _, v := range resp.Verdicts {
+		if v.Ban && v.Duration != "" {
+			d, err := config.ParseBanDuration(v.Duration)
+			if err != nil {
+				return nil, fmt.Errorf("%s: verdict for %s: duration: %w", e.Command[0], v.IP, err)
+			}
+			v.duration = d
+		}
+		verdicts[v.IP] = v
+	}
+	return verdicts, nil
+}
+
+// PenaltyFor returns the penalty for a ban the command decided. A duration
+// in the verdict replaces the rule's ban_duration and escalation; the rule's
+// max_ban_count still applies.
+func (r *Rule) PenaltyFor(v ExternalVerdict) ban.Penalty {
+	if v.Duration == "" {
+		return r.Penalty
+	}
+	return ban.Penalty{
+		Duration:    v.duration,
+		MaxBanCount: r.Penalty.MaxBanCount,
+	}
+}
+
+// firstLine returns the first line of s
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+package rules
+
+import (
+	"strings"
+
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// fieldKind describes how a field's values are compared
+type fieldKind int
+
+const (
+	// fieldNumber is a plain number (relevance)
+	fieldNumber fieldKind = iota
+	// fieldPercent is a number on a 0-100 scale, written with or without % (progress)
+	fieldPercent
+	// fieldBytes is a byte count, compared absolutely or as a percent of the torrent size
+	fieldBytes
+	// fieldDuration is a time span, compared in seconds
+	fieldDuration
+	// fieldString is matched with include/exclude
+	fieldString
+	// fieldBool is true or false, matched with == or !=
+	fieldBool
+)
+
+// fieldSpec resolves a filter field name to an accessor on peer data
+type fieldSpec struct {
+	kind   fieldKind
+	number func(peer *models.Peer) float64
+	text   func(peer *models.Peer) string
+	flag   func(peer *models.Peer) bool
+}
+
+// fields maps filter field names to their accessors
+var fields = map[string]fieldSpec{
+	"progress": {
+		kind:   fieldPercent,
+		number: func(p *models.Peer) float64 { return p.Progress * 100 },
+	},
+	"relevance": {
+		kind:   fieldNumber,
+		number: func(p *models.Peer) float64 { return p.Relevance },
+	},
+	"uploaded": {
+		kind:   fieldBytes,
+		number: func(p *models.Peer) float64 { return float64(p.Uploaded) },
+	},
+	"downloaded": {
+		kind:   fieldBytes,
+		number: func(p *models.Peer) float64 { return float64(p.Downloaded) },
+	},
+	"active_time": {
+		kind:   fieldDuration,
+		number: func(p *models.Peer) float64 { return float64(p.ActiveTime) },
+	},
+	"flag": {
+		kind: fieldString,
+		text: func(p *models.Peer) string { return p.Flags },
+	},
+	"client": {
+		kind: fieldString,
+		text: func(p *models.Peer) string { return p.Client },
+	},
+	"peer_id": {
+		kind: fieldString,
+		text: func(p *models.Peer) string { return p.PeerID },
+	},
+	"peer_client": {
+		kind: fieldString,
+		text: func(p *models.Peer) string {
+			if info, ok := p.Identity(); ok {
+				return info.String()
+			}
+			return ""
+		},
+	},
+	"client_mismatch": {
+		kind: fieldBool,
+		flag: func(p *models.Peer) bool {
+			info, ok := p.Identity()
+			return ok && info.Mismatch(p.Client)
+		},
+	},
+}
+
+// lookupField returns the accessor for a field name
+func lookupField(name string) (fieldSpec, bool) {
+	spec, ok := fields[strings.ToLower(strings.TrimSpace(name))]
+	return spec, ok
+}
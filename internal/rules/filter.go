@@ -1,276 +1,290 @@
 package rules
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/philogag/peer-banner/internal/config"
 	"github.com/philogag/peer-banner/internal/models"
+	"github.com/philogag/peer-banner/internal/units"
 )
 
 // Filter is the interface for matching filters
 type Filter interface {
 	// Match checks if a peer matches the filter
 	Match(peer *models.Peer, torrent *models.Torrent) bool
+	// String describes the filter as written in the config
+	String() string
+	// Trace evaluates the filter like Match and records the values compared
+	Trace(peer *models.Peer, torrent *models.Torrent) FilterTrace
 }
 
-// BaseFilter contains common filter configuration
-type BaseFilter struct {
-	Field    string
-	Operator string
-	Value    string
+// FilterTrace records how a filter evaluated against a peer
+type FilterTrace struct {
+	Filter    string // The filter as written
+	Observed  string // The peer's value, formatted for the field
+	Threshold string // The parsed filter value, formatted for the field
+	Passed    bool
 }
 
-// parsedValue holds the parsed value with its type
-type parsedValue struct {
-	FloatValue    float64
-	IntValue      int64
-	BytesValue    int64
-	DurationValue time.Duration
-	StringValue   string
-	ValueType     ValueType
-}
+// compareFunc compares a peer value against a filter threshold
+type compareFunc func(peerValue, filterValue float64) bool
 
-// ValueType indicates the type of parsed value
-type ValueType int
+// numericOperators maps comparison operators to their implementation
+var numericOperators = map[string]compareFunc{
+	"<":  func(a, b float64) bool { return a < b },
+	">":  func(a, b float64) bool { return a > b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">=": func(a, b float64) bool { return a >= b },
+}
 
-const (
-	ValueTypeUnknown ValueType = iota
-	ValueTypeFloat
-	ValueTypePercent
-	ValueTypeBytes
-	ValueTypeDuration
-	ValueTypeString
-)
+// textFunc matches a peer string against a filter string
+type textFunc func(peerValue, filterValue string) bool
 
-// ParseValue parses a value string and determines its type
-func ParseValue(s string) parsedValue {
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return parsedValue{ValueType: ValueTypeUnknown}
-	}
+// stringOperators maps string operators to their implementation.
+// Comparisons are case-insensitive.
+var stringOperators = map[string]textFunc{
+	"include": containsFold,
+	"exclude": func(a, b string) bool { return !containsFold(a, b) },
+}
 
-	// Check for percentage
-	if strings.HasSuffix(s, "%") {
-		val, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
-		if err == nil {
-			return parsedValue{FloatValue: val, ValueType: ValueTypePercent}
+// containsFold reports whether substr is within s, ignoring case, without
+// allocating a lower-cased copy of s
+func containsFold(s, substr string) bool {
+	n := len(substr)
+	for i := 0; i+n <= len(s); i++ {
+		if strings.EqualFold(s[i:i+n], substr) {
+			return true
 		}
 	}
+	return false
+}
 
-	// Check for duration (time)
-	if strings.HasSuffix(s, "d") || strings.HasSuffix(s, "h") ||
-		strings.HasSuffix(s, "m") || strings.HasSuffix(s, "s") {
-		duration := ParseDuration(s)
-		if duration > 0 {
-			return parsedValue{DurationValue: duration, ValueType: ValueTypeDuration}
-		}
-	}
+// boolOperators maps boolean operators to whether the field must equal
+// the filter value
+var boolOperators = map[string]bool{
+	"==": true,
+	"!=": false,
+}
 
-	// Check for bytes (TB, GB, MB, KB, B)
-	if strings.HasSuffix(s, "TB") || strings.HasSuffix(s, "GB") ||
-		strings.HasSuffix(s, "MB") || strings.HasSuffix(s, "KB") || strings.HasSuffix(s, "B") {
-		bytes := ParseBytes(s)
-		if bytes > 0 {
-			return parsedValue{BytesValue: bytes, ValueType: ValueTypeBytes}
-		}
-	}
+// NumericFilter compares a numeric peer field against a pre-parsed threshold
+type NumericFilter struct {
+	Field     string
+	Operator  string
+	Value     string
+	get       func(peer *models.Peer, torrent *models.Torrent) (float64, bool)
+	compare   compareFunc
+	threshold float64
+	format    func(v float64) string
+}
 
-	// Try to parse as float
-	if val, err := strconv.ParseFloat(s, 64); err == nil {
-		return parsedValue{FloatValue: val, ValueType: ValueTypeFloat}
-	}
+// Match checks if the peer matches the filter
+func (f *NumericFilter) Match(peer *models.Peer, torrent *models.Torrent) bool {
+	v, ok := f.get(peer, torrent)
+	return ok && f.compare(v, f.threshold)
+}
 
-	// Default to string
-	return parsedValue{StringValue: s, ValueType: ValueTypeString}
+// String describes the filter as written in the config
+func (f *NumericFilter) String() string {
+	return describe(f.Field, f.Operator, f.Value)
+}
+
+// Trace evaluates the filter and records the values compared
+func (f *NumericFilter) Trace(peer *models.Peer, torrent *models.Torrent) FilterTrace {
+	trace := FilterTrace{
+		Filter:    f.String(),
+		Observed:  "n/a (torrent size unknown)",
+		Threshold: f.format(f.threshold),
+	}
+	if v, ok := f.get(peer, torrent); ok {
+		trace.Observed = f.format(v)
+		trace.Passed = f.compare(v, f.threshold)
+	}
+	return trace
 }
 
-// GenericFilter is a filter that can match any field with operator/value
-type GenericFilter struct {
+// StringFilter matches a string peer field with include/exclude
+type StringFilter struct {
 	Field    string
 	Operator string
 	Value    string
+	get      func(peer *models.Peer) string
+	match    textFunc
+	needle   string
 }
 
-// NewGenericFilter creates a new GenericFilter from config
-func NewGenericFilter(cfg config.FilterConfig) *GenericFilter {
-	return &GenericFilter{
-		Field:    cfg.Field,
-		Operator: cfg.Operator,
-		Value:    cfg.Value,
-	}
+// Match checks if the peer matches the filter
+func (f *StringFilter) Match(peer *models.Peer, torrent *models.Torrent) bool {
+	return f.match(f.get(peer), f.needle)
 }
 
-// Match checks if the peer matches the filter
-func (f *GenericFilter) Match(peer *models.Peer, torrent *models.Torrent) bool {
-	parsedVal := ParseValue(f.Value)
-	return matchField(peer, torrent, f.Field, f.Operator, parsedVal, f.Value)
+// String describes the filter as written in the config
+func (f *StringFilter) String() string {
+	return describe(f.Field, f.Operator, f.Value)
 }
 
-// matchField matches a specific field with operator against parsed value
-func matchField(peer *models.Peer, torrent *models.Torrent, field, operator string, parsedVal parsedValue, originalValue string) bool {
-	switch field {
-	case "progress":
-		peerValue := peer.Progress * 100
-		return compareFloat(peerValue, operator, parsedVal.FloatValue)
-	case "uploaded":
-		return matchBytes(peer.Uploaded, torrent, operator, parsedVal, true)
-	case "downloaded":
-		return matchBytes(peer.Downloaded, torrent, operator, parsedVal, false)
-	case "relevance":
-		return compareFloat(peer.Relevance, operator, parsedVal.FloatValue)
-	case "active_time":
-		peerDuration := time.Duration(peer.ActiveTime) * time.Second
-		return compareDuration(peerDuration, operator, parsedVal.DurationValue)
-	case "flag":
-		return matchString(strings.ToLower(peer.Flags), operator, strings.ToLower(originalValue))
-	default:
-		return false
+// Trace evaluates the filter and records the values compared
+func (f *StringFilter) Trace(peer *models.Peer, torrent *models.Torrent) FilterTrace {
+	observed := f.get(peer)
+	return FilterTrace{
+		Filter:    f.String(),
+		Observed:  strconv.Quote(observed),
+		Threshold: strconv.Quote(f.needle),
+		Passed:    f.match(observed, f.needle),
 	}
 }
 
-// compareFloat compares a float value with operator
-func compareFloat(peerValue float64, operator string, filterValue float64) bool {
-	switch operator {
-	case "<":
-		return peerValue < filterValue
-	case ">":
-		return peerValue > filterValue
-	case "<=":
-		return peerValue <= filterValue
-	case ">=":
-		return peerValue >= filterValue
-	default:
-		return false
-	}
+// BoolFilter matches a boolean peer field with == or !=
+type BoolFilter struct {
+	Field    string
+	Operator string
+	Value    string
+	get      func(peer *models.Peer) bool
+	want     bool
 }
 
-// compareDuration compares a duration value with operator
-func compareDuration(peerValue time.Duration, operator string, filterValue time.Duration) bool {
-	switch operator {
-	case "<":
-		return peerValue < filterValue
-	case ">":
-		return peerValue > filterValue
-	case "<=":
-		return peerValue <= filterValue
-	case ">=":
-		return peerValue >= filterValue
-	default:
-		return false
-	}
+// Match checks if the peer matches the filter
+func (f *BoolFilter) Match(peer *models.Peer, torrent *models.Torrent) bool {
+	return f.get(peer) == f.want
 }
 
-// matchBytes matches byte values, supporting percent mode
-func matchBytes(peerBytes int64, torrent *models.Torrent, operator string, parsedVal parsedValue, isUploaded bool) bool {
-	if parsedVal.ValueType == ValueTypePercent {
-		// Calculate percent based on torrent size
-		if torrent == nil || torrent.Size == 0 {
-			return false
-		}
-		percent := float64(peerBytes) / float64(torrent.Size) * 100
-		return compareFloat(percent, operator, parsedVal.FloatValue)
-	}
-	// Absolute bytes comparison
-	return compareInt64(peerBytes, operator, parsedVal.BytesValue)
+// String describes the filter as written in the config
+func (f *BoolFilter) String() string {
+	return describe(f.Field, f.Operator, f.Value)
 }
 
-// compareInt64 compares an int64 value with operator
-func compareInt64(peerValue int64, operator string, filterValue int64) bool {
-	switch operator {
-	case "<":
-		return peerValue < filterValue
-	case ">":
-		return peerValue > filterValue
-	case "<=":
-		return peerValue <= filterValue
-	case ">=":
-		return peerValue >= filterValue
-	default:
-		return false
+// Trace evaluates the filter and records the values compared
+func (f *BoolFilter) Trace(peer *models.Peer, torrent *models.Torrent) FilterTrace {
+	observed := f.get(peer)
+	return FilterTrace{
+		Filter:    f.String(),
+		Observed:  strconv.FormatBool(observed),
+		Threshold: strconv.FormatBool(f.want),
+		Passed:    observed == f.want,
 	}
 }
 
-// matchString matches string values with include/exclude operators
-func matchString(peerValue string, operator string, filterValue string) bool {
-	switch operator {
-	case "include":
-		return strings.Contains(peerValue, filterValue)
-	case "exclude":
-		return !strings.Contains(peerValue, filterValue)
-	default:
-		return false
-	}
+// describe formats a filter as "field operator value"
+func describe(field, operator, value string) string {
+	return field + " " + operator + " " + value
 }
 
-// ParseBytes parses a byte string like "1GB" to bytes
-func ParseBytes(s string) int64 {
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return 0
+// CompileFilter resolves a filter config into a typed matcher. The field
+// accessor, operator and threshold are fixed here so that Match does no
+// parsing or string dispatch.
+func CompileFilter(cfg config.FilterConfig) (Filter, error) {
+	spec, ok := lookupField(cfg.Field)
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", cfg.Field)
 	}
 
-	var multiplier int64 = 1
-	var numStr string
+	if spec.kind == fieldString {
+		match, ok := stringOperators[cfg.Operator]
+		if !ok {
+			return nil, fmt.Errorf("operator %q is not valid for field %q (use include or exclude)", cfg.Operator, cfg.Field)
+		}
+		return &StringFilter{
+			Field:    cfg.Field,
+			Operator: cfg.Operator,
+			Value:    cfg.Value,
+			get:      spec.text,
+			match:    match,
+			needle:   strings.TrimSpace(cfg.Value),
+		}, nil
+	}
 
-	switch {
-	case strings.HasSuffix(s, "TB"):
-		multiplier = 1024 * 1024 * 1024 * 1024
-		numStr = s[:len(s)-2]
-	case strings.HasSuffix(s, "GB"):
-		multiplier = 1024 * 1024 * 1024
-		numStr = s[:len(s)-2]
-	case strings.HasSuffix(s, "MB"):
-		multiplier = 1024 * 1024
-		numStr = s[:len(s)-2]
-	case strings.HasSuffix(s, "KB"):
-		multiplier = 1024
-		numStr = s[:len(s)-2]
-	case strings.HasSuffix(s, "B"):
-		multiplier = 1
-		numStr = s[:len(s)-1]
-	default:
-		numStr = s
+	if spec.kind == fieldBool {
+		equal, ok := boolOperators[cfg.Operator]
+		if !ok {
+			return nil, fmt.Errorf("operator %q is not valid for field %q (use == or !=)", cfg.Operator, cfg.Field)
+		}
+		value, err := strconv.ParseBool(strings.TrimSpace(cfg.Value))
+		if err != nil {
+			return nil, fmt.Errorf("field %q: invalid value %q (use true or false)", cfg.Field, cfg.Value)
+		}
+		return &BoolFilter{
+			Field:    cfg.Field,
+			Operator: cfg.Operator,
+			Value:    cfg.Value,
+			get:      spec.flag,
+			want:     value == equal,
+		}, nil
 	}
 
-	val, err := strconv.ParseFloat(numStr, 64)
-	if err != nil {
-		return 0
+	compare, ok := numericOperators[cfg.Operator]
+	if !ok {
+		return nil, fmt.Errorf("operator %q is not valid for field %q (use <, >, <= or >=)", cfg.Operator, cfg.Field)
+	}
+	f := &NumericFilter{
+		Field:    cfg.Field,
+		Operator: cfg.Operator,
+		Value:    cfg.Value,
+		compare:  compare,
 	}
-	return int64(val * float64(multiplier))
-}
 
-// ParseDuration parses a duration string like "24h" to time.Duration
-func ParseDuration(s string) time.Duration {
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return 0
+	threshold, get, err := compileNumber(spec, cfg.Value)
+	if err != nil {
+		return nil, fmt.Errorf("field %q: %w", cfg.Field, err)
 	}
+	f.threshold = threshold
+	f.get = get
+	f.format = formatter(spec.kind, units.IsPercent(cfg.Value))
+
+	return f, nil
+}
 
-	var multiplier time.Duration
-	var numStr string
+// compileNumber parses a filter value according to the field kind and
+// returns the threshold together with the matching accessor. The field
+// decides the grammar, so "1m" is a duration for active_time and an error
+// for uploaded.
+func compileNumber(spec fieldSpec, value string) (float64, func(*models.Peer, *models.Torrent) (float64, bool), error) {
+	number := spec.number
+	direct := func(p *models.Peer, _ *models.Torrent) (float64, bool) { return number(p), true }
 
-	switch {
-	case strings.HasSuffix(s, "d"):
-		multiplier = 24 * time.Hour
-		numStr = s[:len(s)-1]
-	case strings.HasSuffix(s, "h"):
-		multiplier = time.Hour
-		numStr = s[:len(s)-1]
-	case strings.HasSuffix(s, "m"):
-		multiplier = time.Minute
-		numStr = s[:len(s)-1]
-	case strings.HasSuffix(s, "s"):
-		multiplier = time.Second
-		numStr = s[:len(s)-1]
-	default:
-		numStr = s
+	switch spec.kind {
+	case fieldPercent:
+		// Progress accepts "99" or "99%"
+		if units.IsPercent(value) {
+			v, err := units.ParsePercent(value)
+			return v, direct, err
+		}
+		v, err := units.ParseNumber(value)
+		return v, direct, err
+	case fieldNumber:
+		v, err := units.ParseNumber(value)
+		return v, direct, err
+	case fieldBytes:
+		if units.IsPercent(value) {
+			// Percent of the torrent size
+			v, err := units.ParsePercent(value)
+			return v, func(p *models.Peer, t *models.Torrent) (float64, bool) {
+				if t == nil || t.Size == 0 {
+					return 0, false
+				}
+				return number(p) / float64(t.Size) * 100, true
+			}, err
+		}
+		v, err := units.ParseSize(value)
+		return float64(v), direct, err
+	case fieldDuration:
+		v, err := units.ParseDuration(value)
+		return v.Seconds(), direct, err
 	}
+	return 0, nil, fmt.Errorf("field does not take a numeric value")
+}
 
-	val, err := strconv.ParseFloat(numStr, 64)
-	if err != nil {
-		return 0
+// formatter returns how values of a field kind are shown in traces.
+// percentOfSize is set for byte fields compared against the torrent size.
+func formatter(kind fieldKind, percentOfSize bool) func(float64) string {
+	switch {
+	case kind == fieldPercent || percentOfSize:
+		return func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) + "%" }
+	case kind == fieldBytes:
+		return func(v float64) string { return units.FormatSize(int64(v)) }
+	case kind == fieldDuration:
+		return func(v float64) string { return units.FormatDuration(time.Duration(v) * time.Second) }
 	}
-	return time.Duration(val * float64(multiplier))
+	return func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
 }
@@ -0,0 +1,274 @@
+package rules
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// This file keeps a copy of the filter matching that rules used before
+// filters were compiled, for BenchmarkRuleMatchLegacy to compare against:
+// every match parsed the filter value with ParseValue and switched on the
+// field and operator names.
+
+// legacyFilterMatch is the old GenericFilter.Match
+func legacyFilterMatch(peer *models.Peer, torrent *models.Torrent, field, operator, value string) bool {
+	parsedVal := legacyParseValue(value)
+	return legacyMatchField(peer, torrent, field, operator, parsedVal, value)
+}
+
+// BenchmarkRuleMatchLegacy is BenchmarkRuleMatch on the old path
+func BenchmarkRuleMatchLegacy(b *testing.B) {
+	cfgs := benchRuleConfigs()
+	peers := benchPeers(50000)
+	torrent := &models.Torrent{Size: 4 << 30}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range peers {
+			for _, rc := range cfgs {
+				// All filters must match (AND logic)
+				for _, fc := range rc.Filters {
+					if !legacyFilterMatch(&peers[j], torrent, fc.Field, fc.Operator, fc.Value) {
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+// legacyValue holds the parsed value with its type
+type legacyValue struct {
+	FloatValue    float64
+	IntValue      int64
+	BytesValue    int64
+	DurationValue time.Duration
+	StringValue   string
+	ValueType     legacyType
+}
+
+// legacyType indicates the type of parsed value
+type legacyType int
+
+const (
+	legacyUnknown legacyType = iota
+	legacyFloat
+	legacyPercent
+	legacyBytes
+	legacyDuration
+	legacyString
+)
+
+// legacyParseValue parses a value string and determines its type
+func legacyParseValue(s string) legacyValue {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return legacyValue{ValueType: legacyUnknown}
+	}
+
+	// Check for percentage
+	if strings.HasSuffix(s, "%") {
+		val, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err == nil {
+			return legacyValue{FloatValue: val, ValueType: legacyPercent}
+		}
+	}
+
+	// Check for duration (time)
+	if strings.HasSuffix(s, "d") || strings.HasSuffix(s, "h") ||
+		strings.HasSuffix(s, "m") || strings.HasSuffix(s, "s") {
+		duration := legacyParseDuration(s)
+		if duration > 0 {
+			return legacyValue{DurationValue: duration, ValueType: legacyDuration}
+		}
+	}
+
+	// Check for bytes (TB, GB, MB, KB, B)
+	if strings.HasSuffix(s, "TB") || strings.HasSuffix(s, "GB") ||
+		strings.HasSuffix(s, "MB") || strings.HasSuffix(s, "KB") || strings.HasSuffix(s, "B") {
+		bytes := legacyParseBytes(s)
+		if bytes > 0 {
+			return legacyValue{BytesValue: bytes, ValueType: legacyBytes}
+		}
+	}
+
+	// Try to parse as float
+	if val, err := strconv.ParseFloat(s, 64); err == nil {
+		return legacyValue{FloatValue: val, ValueType: legacyFloat}
+	}
+
+	// Default to string
+	return legacyValue{StringValue: s, ValueType: legacyString}
+}
+
+// legacyMatchField matches a specific field with operator against parsed value
+func legacyMatchField(peer *models.Peer, torrent *models.Torrent, field, operator string, parsedVal legacyValue, originalValue string) bool {
+	switch field {
+	case "progress":
+		peerValue := peer.Progress * 100
+		return legacyCompareFloat(peerValue, operator, parsedVal.FloatValue)
+	case "uploaded":
+		return legacyMatchBytes(peer.Uploaded, torrent, operator, parsedVal, true)
+	case "downloaded":
+		return legacyMatchBytes(peer.Downloaded, torrent, operator, parsedVal, false)
+	case "relevance":
+		return legacyCompareFloat(peer.Relevance, operator, parsedVal.FloatValue)
+	case "active_time":
+		peerDuration := time.Duration(peer.ActiveTime) * time.Second
+		return legacyCompareDuration(peerDuration, operator, parsedVal.DurationValue)
+	case "flag":
+		return legacyMatchString(strings.ToLower(peer.Flags), operator, strings.ToLower(originalValue))
+	default:
+		return false
+	}
+}
+
+// legacyCompareFloat compares a float value with operator
+func legacyCompareFloat(peerValue float64, operator string, filterValue float64) bool {
+	switch operator {
+	case "<":
+		return peerValue < filterValue
+	case ">":
+		return peerValue > filterValue
+	case "<=":
+		return peerValue <= filterValue
+	case ">=":
+		return peerValue >= filterValue
+	default:
+		return false
+	}
+}
+
+// legacyCompareDuration compares a duration value with operator
+func legacyCompareDuration(peerValue time.Duration, operator string, filterValue time.Duration) bool {
+	switch operator {
+	case "<":
+		return peerValue < filterValue
+	case ">":
+		return peerValue > filterValue
+	case "<=":
+		return peerValue <= filterValue
+	case ">=":
+		return peerValue >= filterValue
+	default:
+		return false
+	}
+}
+
+// legacyMatchBytes matches byte values, supporting percent mode
+func legacyMatchBytes(peerBytes int64, torrent *models.Torrent, operator string, parsedVal legacyValue, isUploaded bool) bool {
+	if parsedVal.ValueType == legacyPercent {
+		// Calculate percent based on torrent size
+		if torrent == nil || torrent.Size == 0 {
+			return false
+		}
+		percent := float64(peerBytes) / float64(torrent.Size) * 100
+		return legacyCompareFloat(percent, operator, parsedVal.FloatValue)
+	}
+	// Absolute bytes comparison
+	return legacyCompareInt64(peerBytes, operator, parsedVal.BytesValue)
+}
+
+// legacyCompareInt64 compares an int64 value with operator
+func legacyCompareInt64(peerValue int64, operator string, filterValue int64) bool {
+	switch operator {
+	case "<":
+		return peerValue < filterValue
+	case ">":
+		return peerValue > filterValue
+	case "<=":
+		return peerValue <= filterValue
+	case ">=":
+		return peerValue >= filterValue
+	default:
+		return false
+	}
+}
+
+// legacyMatchString matches string values with include/exclude operators
+func legacyMatchString(peerValue string, operator string, filterValue string) bool {
+	switch operator {
+	case "include":
+		return strings.Contains(peerValue, filterValue)
+	case "exclude":
+		return !strings.Contains(peerValue, filterValue)
+	default:
+		return false
+	}
+}
+
+// legacyParseBytes parses a byte string like "1GB" to bytes
+func legacyParseBytes(s string) int64 {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+
+	var multiplier int64 = 1
+	var numStr string
+
+	switch {
+	case strings.HasSuffix(s, "TB"):
+		multiplier = 1024 * 1024 * 1024 * 1024
+		numStr = s[:len(s)-2]
+	case strings.HasSuffix(s, "GB"):
+		multiplier = 1024 * 1024 * 1024
+		numStr = s[:len(s)-2]
+	case strings.HasSuffix(s, "MB"):
+		multiplier = 1024 * 1024
+		numStr = s[:len(s)-2]
+	case strings.HasSuffix(s, "KB"):
+		multiplier = 1024
+		numStr = s[:len(s)-2]
+	case strings.HasSuffix(s, "B"):
+		multiplier = 1
+		numStr = s[:len(s)-1]
+	default:
+		numStr = s
+	}
+
+	val, err := strconv.ParseFloat(numStr, 64)
+	if err != nil {
+		return 0
+	}
+	return int64(val * float64(multiplier))
+}
+
+// legacyParseDuration parses a duration string like "24h" to time.Duration
+func legacyParseDuration(s string) time.Duration {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+
+	var multiplier time.Duration
+	var numStr string
+
+	switch {
+	case strings.HasSuffix(s, "d"):
+		multiplier = 24 * time.Hour
+		numStr = s[:len(s)-1]
+	case strings.HasSuffix(s, "h"):
+		multiplier = time.Hour
+		numStr = s[:len(s)-1]
+	case strings.HasSuffix(s, "m"):
+		multiplier = time.Minute
+		numStr = s[:len(s)-1]
+	case strings.HasSuffix(s, "s"):
+		multiplier = time.Second
+		numStr = s[:len(s)-1]
+	default:
+		numStr = s
+	}
+
+	val, err := strconv.ParseFloat(numStr, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(val * float64(multiplier))
+}
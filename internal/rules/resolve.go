@@ -0,0 +1,65 @@
+package rules
+
+import (
+	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/config"
+)
+
+// Match is a rule that matched a peer, with its verdict
+type Match struct {
+	Rule    *Rule
+	Verdict Verdict
+}
+
+// Resolve picks the match that decides the ban. matches must be in
+// evaluation order (priority, then file order), which also breaks ties.
+// count is the offence number the ban would be for this IP.
+//
+//   - first-match: the first match
+//   - most-severe: the rule with the harshest penalty it can ever give, so
+//     a rule that escalates to permanent beats a flat 7d rule
+//   - longest-duration: the rule giving this offence the longest ban
+func Resolve(strategy string, matches []Match, count int) Match {
+	if len(matches) == 0 {
+		return Match{}
+	}
+
+	best := matches[0]
+	for _, m := range matches[1:] {
+		switch strategy {
+		case config.ResolveMostSevere:
+			if worseThan(m.Rule.Penalty, best.Rule.Penalty) {
+				best = m
+			}
+		case config.ResolveLongestDuration:
+			if longerFor(m.Rule.Penalty, best.Rule.Penalty, count) {
+				best = m
+			}
+		default:
+			return best
+		}
+	}
+	return best
+}
+
+// worseThan reports whether penalty a can end in a harsher ban than b,
+// falling back to the ban each would give a first offence
+func worseThan(a, b ban.Penalty) bool {
+	ad, ap := a.Worst()
+	bd, bp := b.Worst()
+	if ban.Longer(ad, ap, bd, bp) {
+		return true
+	}
+	if ban.Longer(bd, bp, ad, ap) {
+		return false
+	}
+	return longerFor(a, b, 1)
+}
+
+// longerFor reports whether penalty a gives the count-th offence a longer
+// ban than b
+func longerFor(a, b ban.Penalty, count int) bool {
+	ad, ap := a.For(count)
+	bd, bp := b.For(count)
+	return ban.Longer(ad, ap, bd, bp)
+}
@@ -1,8 +1,13 @@
 package rules
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
 	"time"
 
+	"github.com/philogag/peer-banner/internal/ban"
 	"github.com/philogag/peer-banner/internal/config"
 	"github.com/philogag/peer-banner/internal/models"
 )
@@ -11,59 +16,268 @@ import (
 type Rule struct {
 	Name        string
 	Enabled     bool
+	Priority    int
+	Type        string
+	Threshold   float64
 	Action      string
 	BanDuration time.Duration
 	MaxBanCount int
+	Penalty     ban.Penalty
+	Scope       Scope
+	Schedule    *Schedule // nil = always active
 	Filters     []Filter
+	Weights     []float64 // Per-filter weights, used by scoring rules
+	Examples    []*Example
+	External    *External // Command deciding the ban, for external rules
+	Source      string    // File the rule was defined in
 }
 
-// ParseRule parses a rule configuration into a Rule struct
+// Verdict is the outcome of evaluating a rule against a peer
+type Verdict struct {
+	Matched       bool
+	Score         float64
+	Contributions []models.FilterContribution
+}
+
+// Evidence snapshots the peer and the value each filter saw, to be stored
+// with the ban the verdict leads to
+func (r *Rule) Evidence(peer *models.Peer, torrent *models.Torrent, v Verdict) *models.Evidence {
+	evidence := &models.Evidence{
+		TorrentHash: torrent.Hash,
+		TorrentName: torrent.Name,
+		Port:        peer.Port,
+		Client:      peer.Client,
+		PeerID:      peer.PeerID,
+		Flags:       peer.Flags,
+		Progress:    peer.Progress,
+		Uploaded:    peer.Uploaded,
+		Downloaded:  peer.Downloaded,
+	}
+	for _, f := range r.Filters {
+		trace := f.Trace(peer, torrent)
+		evidence.Filters = append(evidence.Filters, models.FilterObservation{
+			Filter:   trace.Filter,
+			Observed: trace.Observed,
+			Passed:   trace.Passed,
+		})
+	}
+	if r.Type == config.RuleTypeScoring {
+		evidence.Score = v.Score
+		evidence.Threshold = r.Threshold
+		evidence.Contributions = v.Contributions
+	}
+	return evidence
+}
+
+// ParseRule parses a rule configuration into a Rule struct. Disabled
+// rules give nil.
 func ParseRule(cfg *config.RuleConfig) (*Rule, error) {
 	if !cfg.Enabled {
 		return nil, nil
 	}
+	return compileRule(cfg)
+}
 
-	banDuration, _ := cfg.GetBanDuration()
+// compileRule parses a rule configuration whether or not it is enabled
+func compileRule(cfg *config.RuleConfig) (*Rule, error) {
+	banDuration, err := cfg.GetBanDuration()
+	if err != nil {
+		return nil, fmt.Errorf("ban_duration: %w", err)
+	}
+	ladder, err := cfg.Escalation.GetLadder()
+	if err != nil {
+		return nil, fmt.Errorf("escalation ladder: %w", err)
+	}
+	maxDuration, err := cfg.Escalation.GetMaxDuration()
+	if err != nil {
+		return nil, fmt.Errorf("escalation max_duration: %w", err)
+	}
 
 	rule := &Rule{
 		Name:        cfg.Name,
 		Enabled:     cfg.Enabled,
+		Priority:    cfg.Priority,
+		Type:        cfg.GetType(),
+		Threshold:   cfg.Threshold,
 		Action:      cfg.Action,
 		BanDuration: banDuration,
-		MaxBanCount:  cfg.MaxBanCount,
+		MaxBanCount: cfg.MaxBanCount,
+		Penalty: ban.Penalty{
+			Duration:    banDuration,
+			MaxBanCount: cfg.MaxBanCount,
+			Ladder:      ladder,
+			Multiplier:  cfg.Escalation.Multiplier,
+			MaxDuration: maxDuration,
+		},
+		Scope:  newScope(cfg),
+		Source: cfg.Source,
 	}
 
-	// Parse each filter
-	for _, f := range cfg.Filters {
-		filter := NewGenericFilter(f)
+	if rule.Type == config.RuleTypeExternal {
+		external, err := newExternal(cfg.External)
+		if err != nil {
+			return nil, fmt.Errorf("external: %w", err)
+		}
+		rule.External = external
+	}
+
+	if cfg.Schedule != nil {
+		schedule, err := ParseSchedule(cfg.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: %w", err)
+		}
+		rule.Schedule = schedule
+	}
+
+	// Compile each filter
+	for i, f := range cfg.Filters {
+		filter, err := CompileFilter(f)
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: %w", i+1, err)
+		}
 		rule.Filters = append(rule.Filters, filter)
+		rule.Weights = append(rule.Weights, f.GetWeight())
+	}
+
+	// Parse example fixtures
+	for i, e := range cfg.Examples {
+		example, err := ParseExample(e)
+		if err != nil {
+			return nil, fmt.Errorf("example %d: %w", i+1, err)
+		}
+		rule.Examples = append(rule.Examples, example)
 	}
 
 	return rule, nil
 }
 
+// ParseRules parses the rules and checks their examples, and returns the
+// enabled ones. Disabled rules are checked too, so that they still work
+// when enabled again. It stops at the first invalid rule, and reports
+// every failing example.
+// The result is in evaluation order: highest priority first, rules of
+// equal priority in file order.
+func ParseRules(cfgs []config.RuleConfig) ([]*Rule, error) {
+	var parsed []*Rule
+	var failed []error
+	for i := range cfgs {
+		rule, err := compileRule(&cfgs[i])
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", cfgs[i].Label(), err)
+		}
+		if err := rule.CheckExamples(); err != nil {
+			failed = append(failed, err)
+		}
+		if rule.Enabled {
+			parsed = append(parsed, rule)
+		}
+	}
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("rule examples failed:\n%w", errors.Join(failed...))
+	}
+	sort.SliceStable(parsed, func(i, j int) bool {
+		return parsed[i].Priority > parsed[j].Priority
+	})
+	return parsed, nil
+}
+
+// ForServer returns the rules that run on the named server
+func ForServer(rules []*Rule, server string) []*Rule {
+	var scoped []*Rule
+	for _, r := range rules {
+		if r.Scope.AppliesToServer(server) {
+			scoped = append(scoped, r)
+		}
+	}
+	return scoped
+}
+
+// ForTorrent returns the rules that run for peers of a torrent. The input
+// slice is returned as is when no rule is limited by category or tag.
+func ForTorrent(rules []*Rule, torrent *models.Torrent) []*Rule {
+	scoped := rules[:0:0]
+	filtered := false
+	for _, r := range rules {
+		if r.Scope.AppliesToTorrent(torrent) {
+			scoped = append(scoped, r)
+		} else {
+			filtered = true
+		}
+	}
+	if !filtered {
+		return rules
+	}
+	return scoped
+}
+
+// label names the rule and the file it came from, for error messages
+func (r *Rule) label() string {
+	if r.Source == "" {
+		return strconv.Quote(r.Name)
+	}
+	return fmt.Sprintf("%q (%s)", r.Name, r.Source)
+}
+
+// ActiveAt reports whether the rule's schedule allows it to run at t
+func (r *Rule) ActiveAt(t time.Time) bool {
+	return r.Schedule == nil || r.Schedule.ActiveAt(t)
+}
+
 // GetBanDuration returns the ban duration for this rule
 func (r *Rule) GetBanDuration() time.Duration {
 	return r.BanDuration
 }
 
+// GetPenalty returns the escalation policy for this rule
+func (r *Rule) GetPenalty() ban.Penalty {
+	return r.Penalty
+}
+
 // GetMaxBanCount returns the max ban count before escalation
 func (r *Rule) GetMaxBanCount() int {
 	return r.MaxBanCount
 }
 
-// Match checks if a peer matches all filters in the rule (AND logic)
+// Match checks if a peer matches the rule
 func (r *Rule) Match(peer *models.Peer, torrent *models.Torrent) bool {
+	verdict := r.Evaluate(peer, torrent)
+	return verdict.Matched
+}
+
+// Evaluate checks a peer against the rule. Rules of type all need every
+// filter to match (AND logic); scoring rules sum the weights of the matched
+// filters and match once the score reaches the threshold. For external
+// rules a match makes the peer a candidate for the command.
+func (r *Rule) Evaluate(peer *models.Peer, torrent *models.Torrent) Verdict {
 	if !r.Enabled {
-		return false
+		return Verdict{}
 	}
+	return r.evaluate(peer, torrent)
+}
 
-	// All filters must match (AND logic)
-	for _, f := range r.Filters {
-		if !f.Match(peer, torrent) {
-			return false
+// evaluate checks a peer against the rule's filters, enabled or not
+func (r *Rule) evaluate(peer *models.Peer, torrent *models.Torrent) Verdict {
+	if r.Type != config.RuleTypeScoring {
+		// All filters must match (AND logic)
+		for _, f := range r.Filters {
+			if !f.Match(peer, torrent) {
+				return Verdict{}
+			}
 		}
+		return Verdict{Matched: true}
 	}
 
-	return true
+	var verdict Verdict
+	for i, f := range r.Filters {
+		if !f.Match(peer, torrent) {
+			continue
+		}
+		verdict.Score += r.Weights[i]
+		verdict.Contributions = append(verdict.Contributions, models.FilterContribution{
+			Filter: f.String(),
+			Weight: r.Weights[i],
+		})
+	}
+	verdict.Matched = verdict.Score >= r.Threshold
+	return verdict
 }
@@ -0,0 +1,91 @@
+package rules
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// benchRuleConfigs mirrors a typical configuration: a dozen rules mixing
+// byte, percent, float, duration and string filters.
+func benchRuleConfigs() []config.RuleConfig {
+	var cfgs []config.RuleConfig
+	for i := 0; i < 12; i++ {
+		cfgs = append(cfgs, config.RuleConfig{
+			Name:        fmt.Sprintf("rule_%d", i),
+			Enabled:     true,
+			Action:      "ban",
+			BanDuration: "24h",
+			Filters: []config.FilterConfig{
+				{Field: "downloaded", Operator: ">=", Value: "1GB"},
+				{Field: "uploaded", Operator: "<", Value: "50%"},
+				{Field: "progress", Operator: ">=", Value: "99"},
+				{Field: "relevance", Operator: "<", Value: "0.3"},
+				{Field: "active_time", Operator: ">=", Value: "24h"},
+				{Field: "flag", Operator: "include", Value: "E"},
+			},
+		})
+	}
+	return cfgs
+}
+
+// benchPeers returns n peers that pass every filter, so each rule
+// evaluates all of its filters.
+func benchPeers(n int) []models.Peer {
+	peers := make([]models.Peer, n)
+	for i := range peers {
+		peers[i] = models.Peer{
+			IP:         fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff),
+			Progress:   0.995,
+			Downloaded: 2 << 30,
+			Uploaded:   1 << 20,
+			Relevance:  0.1,
+			ActiveTime: 90000,
+			Flags:      "D E X",
+		}
+	}
+	return peers
+}
+
+func BenchmarkRuleMatch(b *testing.B) {
+	var parsed []*Rule
+	for _, rc := range benchRuleConfigs() {
+		rc := rc
+		rule, err := ParseRule(&rc)
+		if err != nil {
+			b.Fatal(err)
+		}
+		parsed = append(parsed, rule)
+	}
+	peers := benchPeers(50000)
+	torrent := &models.Torrent{Size: 4 << 30}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range peers {
+			for _, rule := range parsed {
+				rule.Match(&peers[j], torrent)
+			}
+		}
+	}
+}
+
+func BenchmarkFilterMatch(b *testing.B) {
+	peer := &benchPeers(1)[0]
+	torrent := &models.Torrent{Size: 4 << 30}
+	for _, fc := range benchRuleConfigs()[0].Filters {
+		f, err := CompileFilter(fc)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fc.Field, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				f.Match(peer, torrent)
+			}
+		})
+	}
+}
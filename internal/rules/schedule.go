@@ -0,0 +1,128 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/config"
+)
+
+// weekdays maps day names to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule is the set of time windows in which a rule is active
+type Schedule struct {
+	loc     *time.Location
+	windows []window
+}
+
+// window is a daily range of minutes since midnight on selected weekdays
+type window struct {
+	days       [7]bool
+	start, end int
+}
+
+// ParseSchedule parses a schedule config
+func ParseSchedule(cfg *config.ScheduleConfig) (*Schedule, error) {
+	if len(cfg.Windows) == 0 {
+		return nil, fmt.Errorf("no windows defined")
+	}
+
+	s := &Schedule{loc: time.Local}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %w", cfg.Timezone, err)
+		}
+		s.loc = loc
+	}
+
+	for i, wc := range cfg.Windows {
+		w, err := parseWindow(wc)
+		if err != nil {
+			return nil, fmt.Errorf("window %d: %w", i+1, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+// parseWindow parses a single window config
+func parseWindow(cfg config.WindowConfig) (window, error) {
+	var w window
+	if len(cfg.Days) == 0 {
+		for d := range w.days {
+			w.days[d] = true
+		}
+	}
+	for _, name := range cfg.Days {
+		day, ok := weekdays[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q (use mon, tue, wed, thu, fri, sat, sun)", name)
+		}
+		w.days[day] = true
+	}
+
+	var err error
+	if w.start, err = parseClock(cfg.Start); err != nil {
+		return w, fmt.Errorf("start: %w", err)
+	}
+	if w.end, err = parseClock(cfg.End); err != nil {
+		return w, fmt.Errorf("end: %w", err)
+	}
+	return w, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight. 24:00 is accepted as
+// the end of the day.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &h, &m); err != nil {
+		return 0, fmt.Errorf("invalid time %q (use HH:MM)", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q (use HH:MM)", s)
+	}
+	return h*60 + m, nil
+}
+
+// ActiveAt reports whether any window contains t
+func (s *Schedule) ActiveAt(t time.Time) bool {
+	t = t.In(s.loc)
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, w := range s.windows {
+		switch {
+		case w.start == w.end:
+			// Whole day
+			if w.days[today] {
+				return true
+			}
+		case w.start < w.end:
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+		default:
+			// Runs past midnight: the evening part belongs to the start day,
+			// the early morning part to the day before
+			if w.days[today] && minute >= w.start {
+				return true
+			}
+			if w.days[yesterday] && minute < w.end {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// Scope limits a rule to certain servers and torrents. Empty selectors
+// match everything.
+type Scope struct {
+	Servers    []string
+	Categories []string
+	Tags       []string
+}
+
+// newScope builds a scope from a rule config
+func newScope(cfg *config.RuleConfig) Scope {
+	return Scope{
+		Servers:    cfg.Servers,
+		Categories: cfg.Categories,
+		Tags:       cfg.Tags,
+	}
+}
+
+// AppliesToServer reports whether the rule runs on the named server
+func (s *Scope) AppliesToServer(server string) bool {
+	return len(s.Servers) == 0 || contains(s.Servers, server)
+}
+
+// AppliesToTorrent reports whether the rule runs for peers of a torrent.
+// A torrent is in scope when its category is listed and it carries at least
+// one of the listed tags.
+func (s *Scope) AppliesToTorrent(torrent *models.Torrent) bool {
+	if len(s.Categories) > 0 && !contains(s.Categories, torrent.Category) {
+		return false
+	}
+	if len(s.Tags) > 0 {
+		for _, tag := range strings.Split(torrent.Tags, ",") {
+			if contains(s.Tags, strings.TrimSpace(tag)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// contains reports whether list holds value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// excludes explains why a torrent is outside the scope, or returns "" when
+// the rule runs for it
+func (s *Scope) excludes(torrent *models.Torrent) string {
+	if s.AppliesToTorrent(torrent) {
+		return ""
+	}
+	if len(s.Categories) > 0 && !contains(s.Categories, torrent.Category) {
+		return fmt.Sprintf("category %q is not one of %s", torrent.Category, strings.Join(s.Categories, ", "))
+	}
+	return fmt.Sprintf("tags %q include none of %s", torrent.Tags, strings.Join(s.Tags, ", "))
+}
@@ -0,0 +1,33 @@
+package rules
+
+import (
+	"time"
+
+	"github.com/philogag/peer-banner/internal/models"
+)
+
+// RuleTrace records how a rule evaluated against a peer, filter by filter
+type RuleTrace struct {
+	Rule    *Rule
+	Skipped string // Why the detector would not run the rule, empty if it would
+	Verdict Verdict
+	Filters []FilterTrace
+}
+
+// Trace evaluates the rule against a peer as the detector would at time
+// now. Rules out of scope or schedule are still evaluated, so the trace
+// shows what they would have decided.
+func (r *Rule) Trace(peer *models.Peer, torrent *models.Torrent, now time.Time) RuleTrace {
+	trace := RuleTrace{
+		Rule:    r,
+		Skipped: r.Scope.excludes(torrent),
+		Verdict: r.Evaluate(peer, torrent),
+	}
+	if trace.Skipped == "" && !r.ActiveAt(now) {
+		trace.Skipped = "outside its schedule"
+	}
+	for _, f := range r.Filters {
+		trace.Filters = append(trace.Filters, f.Trace(peer, torrent))
+	}
+	return trace
+}
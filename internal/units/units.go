@@ -0,0 +1,279 @@
+// Package units implements the duration, size and percentage grammar shared
+// by the configuration file and rule filters.
+//
+//	duration:   "30s", "15m", "24h", "7d", "2w", compounds such as "1h30m"
+//	size:       "512B", "1KB", "1KiB", "100MB", "100MiB", "1GB", "1GiB", "2TB", "2TiB"
+//	percentage: "50%", "0.5%"
+//
+// Spaces may separate a number from its unit, and the parts of a compound
+// duration, so "1 GB" and "1 h 30 m" are accepted too.
+//
+// All size units are powers of 1024: KB, MB, GB and TB keep the meaning
+// they always had in rule filters and are the same as KiB, MiB, GiB and
+// TiB. "0" is the only value accepted without a unit; anything else that
+// could be read more than one way is rejected.
+package units
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Common durations beyond what the time package defines
+const (
+	Day  = 24 * time.Hour
+	Week = 7 * Day
+)
+
+// durationUnits lists duration units from largest to smallest
+var durationUnits = []struct {
+	name string
+	unit time.Duration
+}{
+	{"w", Week},
+	{"d", Day},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+}
+
+// sizeUnits maps size unit suffixes to their multiplier
+var sizeUnits = map[string]int64{
+	"B":   1,
+	"KB":  1 << 10,
+	"MB":  1 << 20,
+	"GB":  1 << 30,
+	"TB":  1 << 40,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// ParseDuration parses a duration such as "24h", "7d" or "1h30m". Units
+// are s, m, h, d and w; in a compound value each unit may appear once,
+// largest first.
+func ParseDuration(s string) (time.Duration, error) {
+	orig := s
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("invalid duration %q: empty value", orig)
+	}
+	if isZero(s) {
+		return 0, nil
+	}
+
+	var total time.Duration
+	last := -1
+	for s != "" {
+		num, rest := splitNumber(s)
+		if num == "" {
+			return 0, fmt.Errorf("invalid duration %q: expected a number at %q", orig, s)
+		}
+		unit, rest := splitUnit(strings.TrimLeft(rest, " \t"))
+		if unit == "" {
+			return 0, fmt.Errorf("invalid duration %q: %q has no unit (use s, m, h, d or w, e.g. %ss)", orig, num, num)
+		}
+
+		idx := durationUnitIndex(unit)
+		if idx < 0 {
+			return 0, fmt.Errorf("invalid duration %q: unknown unit %q%s", orig, unit, durationUnitHint(unit))
+		}
+		if idx <= last {
+			return 0, fmt.Errorf("invalid duration %q: units must appear once each, largest first (e.g. 1d12h)", orig)
+		}
+		last = idx
+
+		val, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: bad number %q", orig, num)
+		}
+		part := val * float64(durationUnits[idx].unit)
+		if part >= math.MaxInt64 || total > math.MaxInt64-time.Duration(part) {
+			return 0, fmt.Errorf("invalid duration %q: too large", orig)
+		}
+		total += time.Duration(part)
+		s = strings.TrimLeft(rest, " \t")
+	}
+	return total, nil
+}
+
+// ParseSize parses a byte size such as "512KiB" or "1GB" into bytes
+func ParseSize(s string) (int64, error) {
+	orig := s
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("invalid size %q: empty value", orig)
+	}
+	if isZero(s) {
+		return 0, nil
+	}
+
+	num, rest := splitNumber(s)
+	if num == "" {
+		return 0, fmt.Errorf("invalid size %q: expected a number", orig)
+	}
+	unit := strings.TrimSpace(rest)
+	if unit == "" {
+		return 0, fmt.Errorf("invalid size %q: %q has no unit (use B, KB, KiB, MB, MiB, GB, GiB, TB or TiB)", orig, num)
+	}
+
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: %s", orig, sizeUnitHint(unit))
+	}
+
+	val, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: bad number %q", orig, num)
+	}
+	size := val * float64(multiplier)
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: too large", orig)
+	}
+	return int64(size), nil
+}
+
+// ParsePercent parses a percentage such as "50%" and returns 50
+func ParsePercent(s string) (float64, error) {
+	orig := s
+	s = strings.TrimSpace(s)
+	if !strings.HasSuffix(s, "%") {
+		return 0, fmt.Errorf("invalid percentage %q: missing %% suffix", orig)
+	}
+	num := strings.TrimSpace(strings.TrimSuffix(s, "%"))
+	val, err := strconv.ParseFloat(num, 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid percentage %q: bad number %q", orig, num)
+	}
+	return val, nil
+}
+
+// IsPercent reports whether s is written as a percentage
+func IsPercent(s string) bool {
+	return strings.HasSuffix(strings.TrimSpace(s), "%")
+}
+
+// ParseNumber parses a plain number with no unit
+func ParseNumber(s string) (float64, error) {
+	orig := s
+	s = strings.TrimSpace(s)
+	val, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		if num, rest := splitNumber(s); num != "" && rest != "" {
+			return 0, fmt.Errorf("invalid number %q: unexpected unit %q", orig, rest)
+		}
+		return 0, fmt.Errorf("invalid number %q", orig)
+	}
+	return val, nil
+}
+
+// isZero reports whether s is a unitless zero such as "0" or "0.0"
+func isZero(s string) bool {
+	val, err := strconv.ParseFloat(s, 64)
+	return err == nil && val == 0
+}
+
+// splitNumber splits a leading unsigned decimal number off s
+func splitNumber(s string) (num, rest string) {
+	i := 0
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// splitUnit splits a leading run of letters off s
+func splitUnit(s string) (unit, rest string) {
+	i := 0
+	for i < len(s) && (s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z') {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// durationUnitIndex returns the position of unit in durationUnits, or -1
+func durationUnitIndex(unit string) int {
+	for i, u := range durationUnits {
+		if u.name == unit {
+			return i
+		}
+	}
+	return -1
+}
+
+// durationUnitHint explains common mistakes in duration units
+func durationUnitHint(unit string) string {
+	switch unit {
+	case "M":
+		return " (use m for minutes; months are not supported, use d)"
+	case "H", "D", "W", "S":
+		return fmt.Sprintf(" (units are lower case: %s)", strings.ToLower(unit))
+	case "ms", "us", "ns":
+		return " (sub-second units are not supported)"
+	case "y", "Y":
+		return " (years are not supported, use d or w)"
+	case "B", "KB", "KiB", "MB", "MiB", "GB", "GiB", "TB", "TiB":
+		return " (that is a size unit)"
+	}
+	return " (use s, m, h, d or w)"
+}
+
+// sizeUnitHint explains why unit is not a valid size unit
+func sizeUnitHint(unit string) string {
+	upper := strings.ToUpper(unit)
+	switch {
+	case unit == "b":
+		return `ambiguous unit "b": lower-case b means bits; use B`
+	case unit == "kB":
+		return `unknown unit "kB": use KB or KiB (both 1024 bytes)`
+	case upper == "K" || upper == "M" || upper == "G" || upper == "T":
+		return fmt.Sprintf("ambiguous unit %q: use %sB or %siB (both powers of 1024)", unit, upper, upper)
+	case strings.HasSuffix(unit, "b") && !strings.HasSuffix(unit, "ib"):
+		return fmt.Sprintf("ambiguous unit %q: lower-case b means bits; use %sB or %siB", unit,
+			strings.ToUpper(strings.TrimSuffix(unit, "b")), strings.ToUpper(strings.TrimSuffix(unit, "b")))
+	case strings.HasSuffix(upper, "IB") && len(upper) == 3:
+		return fmt.Sprintf("unknown unit %q: did you mean %siB?", unit, upper[:1])
+	case durationUnitIndex(unit) >= 0:
+		return fmt.Sprintf("unknown unit %q: that is a duration unit", unit)
+	}
+	return fmt.Sprintf("unknown unit %q (use B, KB, KiB, MB, MiB, GB, GiB, TB or TiB)", unit)
+}
+
+// FormatSize formats a byte count with binary units, e.g. "1.50 GiB"
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		if value < unit && value > -unit || suffix == "TiB" {
+			return fmt.Sprintf("%.2f %s", value, suffix)
+		}
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// FormatDuration formats a duration using the same units ParseDuration
+// accepts, e.g. "1d2h" or "45s". Sub-second remainders are dropped.
+func FormatDuration(d time.Duration) string {
+	if d < 0 {
+		return "-" + FormatDuration(-d)
+	}
+	if d < time.Second {
+		return "0s"
+	}
+	var b strings.Builder
+	for _, u := range durationUnits {
+		if n := d / u.unit; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u.name)
+			d -= n * u.unit
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,157 @@
+package units
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr string // Substring of the error, "" for success
+	}{
+		{"0", 0, ""},
+		{"0.0", 0, ""},
+		{"512B", 512, ""},
+		{" 1KB ", 1024, ""},
+		{"1KiB", 1024, ""},
+		{"100MB", 100 << 20, ""},
+		{"100MiB", 100 << 20, ""},
+		{"1GB", 1 << 30, ""},
+		{"1GiB", 1 << 30, ""},
+		{"1.5GiB", 3 << 29, ""},
+		{"2TB", 2 << 40, ""},
+		{"2TiB", 2 << 40, ""},
+		{"1 GB", 1 << 30, ""},
+		{"1\tGiB", 1 << 30, ""},
+
+		{"", 0, "empty value"},
+		{"1024", 0, "has no unit"},
+		{"GB", 0, "expected a number"},
+		{"1m", 0, `ambiguous unit "m"`},
+		{"1G", 0, `ambiguous unit "G"`},
+		{"1k", 0, `ambiguous unit "k"`},
+		{"1b", 0, `ambiguous unit "b"`},
+		{"1Mb", 0, `ambiguous unit "Mb"`},
+		{"1kB", 0, `unknown unit "kB"`},
+		{"1MIB", 0, "did you mean MiB"},
+		{"1h", 0, "duration unit"},
+		{"1PB", 0, `unknown unit "PB"`},
+		{"1..2GB", 0, "bad number"},
+		{"-1GB", 0, "expected a number"},
+		{"10000000000TB", 0, "too large"},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseSize(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr string
+	}{
+		{"0", 0, ""},
+		{"30s", 30 * time.Second, ""},
+		{"15m", 15 * time.Minute, ""},
+		{"24h", 24 * time.Hour, ""},
+		{"7d", 7 * Day, ""},
+		{"2w", 2 * Week, ""},
+		{"1h30m", 90 * time.Minute, ""},
+		{"1d12h", 36 * time.Hour, ""},
+		{"1.5h", 90 * time.Minute, ""},
+		{"1w2d3h4m5s", Week + 2*Day + 3*time.Hour + 4*time.Minute + 5*time.Second, ""},
+		{"1 h", time.Hour, ""},
+		{"1h 30m", 90 * time.Minute, ""},
+		{" 1 d 12 h ", 36 * time.Hour, ""},
+
+		{"", 0, "empty value"},
+		{"86400", 0, "has no unit"},
+		{"1h1h", 0, "largest first"},
+		{"30m1h", 0, "largest first"},
+		{"1M", 0, "months are not supported"},
+		{"1H", 0, "lower case"},
+		{"100ms", 0, "sub-second"},
+		{"1y", 0, "years are not supported"},
+		{"1GB", 0, "size unit"},
+		{"1x", 0, `unknown unit "x"`},
+		{"h", 0, "expected a number"},
+		{"1 h 1 h", 0, "largest first"},
+		{"300y", 0, "years are not supported"},
+		{"9999999w", 0, "too large"},
+		{"15249w9d", 0, "too large"},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseDuration(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseDuration(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{"50%", 50, false},
+		{"0.5%", 0.5, false},
+		{" 100 % ", 100, false},
+		{"50", 0, true},
+		{"%", 0, true},
+		{"-5%", 0, true},
+		{"abc%", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePercent(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePercent(%q) = %v, %v, want %v (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	if got, err := ParseNumber(" 0.3 "); err != nil || got != 0.3 {
+		t.Errorf("ParseNumber(0.3) = %v, %v", got, err)
+	}
+	if _, err := ParseNumber("5GB"); err == nil || !strings.Contains(err.Error(), "unexpected unit") {
+		t.Errorf("ParseNumber(5GB) error = %v", err)
+	}
+	if _, err := ParseNumber("x"); err == nil {
+		t.Error("ParseNumber(x) succeeded")
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for _, d := range []time.Duration{time.Second, 90 * time.Minute, 36 * time.Hour, Week + Day + time.Second} {
+		got, err := ParseDuration(FormatDuration(d))
+		if err != nil || got != d {
+			t.Errorf("ParseDuration(FormatDuration(%v)) = %v, %v", d, got, err)
+		}
+	}
+	if got := FormatSize(3 << 29); got != "1.50 GiB" {
+		t.Errorf("FormatSize = %q", got)
+	}
+	if got := FormatSize(512); got != "512 B" {
+		t.Errorf("FormatSize = %q", got)
+	}
+}
@@ -11,9 +11,11 @@ import (
 
 	"github.com/philogag/peer-banner/internal/api"
 	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/blocklist"
 	"github.com/philogag/peer-banner/internal/config"
 	"github.com/philogag/peer-banner/internal/detector"
 	"github.com/philogag/peer-banner/internal/output"
+	"github.com/philogag/peer-banner/internal/rules"
 )
 
 var (
@@ -24,6 +26,7 @@ var (
 )
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
 	if *version {
@@ -32,12 +35,38 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Subcommands
+	switch flag.Arg(0) {
+	case "":
+	case "validate":
+		os.Exit(runValidate(*configPath))
+	case "explain":
+		os.Exit(runExplain(*configPath, flag.Args()[1:]))
+	case "history":
+		os.Exit(runHistory(*configPath, flag.Args()[1:]))
+	case "ban":
+		os.Exit(runBan(*configPath, flag.Args()[1:]))
+	case "pardon":
+		os.Exit(runPardon(*configPath, flag.Args()[1:]))
+	case "safety":
+		os.Exit(runSafety(*configPath, flag.Args()[1:]))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// Load configuration
 	cfg, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Check rules and their examples before connecting to any server
+	if _, err := rules.ParseRules(cfg.Rules); err != nil {
+		log.Fatalf("Invalid rule configuration: %v", err)
+	}
+
 	// Override dry-run if flag is set
 	if *dryRun {
 		cfg.App.DryRun = true
@@ -50,13 +79,27 @@ func main() {
 	log.Printf("Config: %s, Dry Run: %v", *configPath, cfg.App.DryRun)
 
 	// Create ban manager
-	banManager, err := ban.NewManager(cfg.App.GetStateFile())
+	// Refuse to start rather than run with an empty state and forgive
+	// every ban
+	banManager, err := ban.NewManager(cfg.App.GetStateFile(), &cfg.Ban)
 	if err != nil {
-		log.Printf("Warning: Failed to create ban manager: %v", err)
+		log.Fatalf("Failed to open ban state: %v", err)
+	}
+	defer banManager.Close()
+
+	// Lift bans the configuration no longer supports, such as bans of IPs
+	// whitelisted since
+	reconcile(cfg, banManager)
+
+	// Imported blocklists, refreshed before each detection run
+	lists, err := blocklist.NewSet(cfg)
+	if err != nil {
+		log.Fatalf("Invalid blocklist configuration: %v", err)
 	}
 
 	// Create output writer
 	writer := output.NewDATWriter(&cfg.Output, banManager)
+	writer.UseBlocklists(lists)
 
 	// Create detectors for each server
 	detectors := make([]*detector.Detector, 0, len(cfg.Servers))
@@ -69,12 +112,13 @@ func main() {
 			continue
 		}
 
-		d, err := detector.NewDetector(client, cfg.Rules, cfg.Whitelist, banManager)
+		d, err := detector.NewDetector(client, cfg, banManager)
 		if err != nil {
 			log.Printf("Warning: Failed to create detector for %s: %v", serverCfg.Name, err)
 			continue
 		}
 
+		d.UseBlocklists(lists)
 		detectors = append(detectors, d)
 		log.Printf("Connected to qBittorrent server: %s", serverCfg.Name)
 	}
@@ -85,23 +129,50 @@ func main() {
 
 	// Run detection once or in a loop
 	if *once {
-		runDetection(detectors, writer, cfg.App.DryRun)
+		runDetection(detectors, writer, lists, cfg.App.DryRun)
 	} else {
-		runLoop(detectors, writer, cfg.App.DryRun, cfg.App.GetInterval())
+		runLoop(detectors, writer, banManager, lists, cfg.App.DryRun, cfg.App.GetInterval())
 	}
 }
 
-func runDetection(detectors []*detector.Detector, writer *output.DATWriter, dryRun bool) {
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Commands:")
+	fmt.Fprintln(out, "  validate    Check the configuration and rule examples, then exit")
+	fmt.Fprintln(out, "  explain     Show how each rule evaluates a peer (see explain -h)")
+	fmt.Fprintln(out, "  history     Search the audit log of ban events (see history -h)")
+	fmt.Fprintln(out, "  ban         Add, remove, list, show and prune bans by hand (see ban -h)")
+	fmt.Fprintln(out, "  pardon      Exempt an IP or range from bans until a given time (see pardon -h)")
+	fmt.Fprintln(out, "  safety      Show, acknowledge or freeze the ban safety limits (see safety -h)")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func runDetection(detectors []*detector.Detector, writer *output.DATWriter, lists *blocklist.Set, dryRun bool) {
 	var totalBanned int
 
+	// Fetch the blocklists that are due before they are checked and written
+	lists.Refresh()
+
+	runs := make([]*detector.Run, 0, len(detectors))
 	for _, d := range detectors {
 		log.Printf("Running detection on %s...", d.Name())
 
-		result, err := d.Detect()
+		run, err := d.Evaluate()
 		if err != nil {
 			log.Printf("Error during detection: %v", err)
 			continue
 		}
+		runs = append(runs, run)
+	}
+
+	// The safety limits count the bans of every server in the cycle, so
+	// they are made together once all servers are checked
+	detector.Enforce(runs)
+
+	for _, run := range runs {
+		result := run.Result
 
 		// Write result
 		if err := writer.Write(result, dryRun); err != nil {
@@ -116,13 +187,13 @@ func runDetection(detectors []*detector.Detector, writer *output.DATWriter, dryR
 	log.Printf("Total banned IPs: %d", totalBanned)
 }
 
-func runLoop(detectors []*detector.Detector, writer *output.DATWriter, dryRun bool, interval time.Duration) {
+func runLoop(detectors []*detector.Detector, writer *output.DATWriter, banManager *ban.Manager, lists *blocklist.Set, dryRun bool, interval time.Duration) {
 	// Run initial detection
-	runDetection(detectors, writer, dryRun)
+	runDetection(detectors, writer, lists, dryRun)
 
-	// Set up signal handling for graceful shutdown
+	// Set up signal handling for graceful shutdown and reloads
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -132,15 +203,70 @@ func runLoop(detectors []*detector.Detector, writer *output.DATWriter, dryRun bo
 	for {
 		select {
 		case <-ticker.C:
-			runDetection(detectors, writer, dryRun)
+			runDetection(detectors, writer, lists, dryRun)
 			log.Printf("Next detection in %v", interval)
 		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				log.Printf("Received signal %v, reloading configuration...", sig)
+				if err := reload(*configPath, detectors, banManager, lists); err != nil {
+					log.Printf("Failed to reload configuration, keeping the current one: %v", err)
+					continue
+				}
+				// Rewrite the output without the lifted bans
+				runDetection(detectors, writer, lists, dryRun)
+				continue
+			}
 			log.Printf("Received signal %v, shutting down...", sig)
 			return
 		}
 	}
 }
 
+// reload rereads the configuration, applies its rules, whitelist and
+// blocklists, then reconciles the bans. Other settings, such as the servers
+// and the output, take a restart. Either every detector and the blocklists
+// switch to the new configuration or none does.
+func reload(path string, detectors []*detector.Detector, banManager *ban.Manager, lists *blocklist.Set) error {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	if _, err := rules.ParseRules(cfg.Rules); err != nil {
+		return fmt.Errorf("invalid rule configuration: %w", err)
+	}
+	settings := make([]*detector.Settings, len(detectors))
+	for i, d := range detectors {
+		if settings[i], err = d.Prepare(cfg); err != nil {
+			return fmt.Errorf("%s: %w", d.Name(), err)
+		}
+	}
+	// Configure changes nothing when it fails
+	if err := lists.Configure(cfg); err != nil {
+		return err
+	}
+	for i, d := range detectors {
+		d.Apply(settings[i])
+	}
+	reconcile(cfg, banManager)
+	return nil
+}
+
+// reconcile lifts the bans the configuration no longer supports and
+// reports each of them
+func reconcile(cfg *config.Config, banManager *ban.Manager) {
+	lifted := detector.Reconcile(cfg, banManager)
+	if len(lifted) == 0 {
+		return
+	}
+	for _, l := range lifted {
+		log.Printf("Lifted ban on %s (rule: %s): %s", l.Target, orDash(l.Rule), l.Reason)
+	}
+	log.Printf("Lifted %d bans the configuration no longer supports", len(lifted))
+	if err := banManager.Save(); err != nil {
+		log.Printf("Failed to save ban state: %v", err)
+	}
+}
+
 func setLogLevel(level string) {
 	switch level {
 	case "debug":
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/units"
+)
+
+// runPardon manages pardons, whitelist entries that expire by themselves.
+// It returns the process exit code.
+func runPardon(path string, args []string) int {
+	if len(args) == 0 {
+		pardonUsage(os.Stderr)
+		return 2
+	}
+
+	switch args[0] {
+	case "add":
+		return runPardonAdd(path, args[1:])
+	case "remove":
+		return runPardonRemove(path, args[1:])
+	case "list":
+		return runPardonList(path, args[1:])
+	case "-h", "-help", "--help", "help":
+		pardonUsage(os.Stdout)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "pardon: unknown command %q\n", args[0])
+	pardonUsage(os.Stderr)
+	return 2
+}
+
+// pardonUsage lists the pardon subcommands
+func pardonUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [flags] pardon <command> [arguments]\n\n", os.Args[0])
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  add <ip|cidr>     Exempt an IP or range from bans for a while (-for or -until, -note)")
+	fmt.Fprintln(w, "  remove <ip|cidr>  End a pardon early")
+	fmt.Fprintln(w, "  list              List pardons in force (-json)")
+	fmt.Fprintln(w, "\nRun a command with -h for its flags.")
+}
+
+func runPardonAdd(path string, args []string) int {
+	fs := newCommandFlags("pardon add", "<ip|cidr> (-for DURATION | -until TIME) [-note TEXT]")
+	length := fs.String("for", "", "How long the pardon lasts, such as 7d")
+	until := fs.String("until", "", "When the pardon ends: a date, an RFC 3339 time or a duration from now")
+	note := fs.String("note", "", "Why the IP is pardoned")
+	by := fs.String("by", currentUser(), "Who is pardoning, for the audit log")
+	targets, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(targets) != 1 || (*length == "") == (*until == "") {
+		fmt.Fprintln(os.Stderr, "pardon add: an IP or range and exactly one of -for or -until are required")
+		fs.Usage()
+		return 2
+	}
+
+	now := time.Now()
+	var end time.Time
+	if *length != "" {
+		d, err := units.ParseDuration(*length)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pardon add: -for: %v\n", err)
+			return 2
+		}
+		end = now.Add(d)
+	} else if end, err = parseTime(*until, now, false); err != nil {
+		fmt.Fprintf(os.Stderr, "pardon add: -until: %v\n", err)
+		return 2
+	}
+
+	pardon, err := ban.NewPardon(targets[0], end, *note, *by)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pardon add: %v\n", err)
+		return 2
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	stateFile := cfg.App.GetStateFile()
+
+	err = ban.UpdatePardons(stateFile, func(pardons []*ban.Pardon) ([]*ban.Pardon, error) {
+		kept := pardons[:0]
+		for _, p := range pardons {
+			if p.Target != pardon.Target {
+				kept = append(kept, p)
+			}
+		}
+		return append(kept, pardon), nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pardon add: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Pardoned %s\n", describePardon(pardon))
+
+	return liftPardoned(stateFile, &cfg.Ban)
+}
+
+// liftPardoned lifts the bans that pardons now cover, or leaves that to
+// the daemon when it holds the ban state
+func liftPardoned(stateFile string, cfg *config.BanConfig) int {
+	banManager, err := ban.NewManager(stateFile, cfg)
+	if ban.IsLocked(err) {
+		fmt.Println("The daemon is running: it lifts covered bans at the start of the next detection cycle")
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open ban state: %v\n", err)
+		return 1
+	}
+	defer banManager.Close()
+
+	lifted, err := banManager.RefreshPardons()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read pardons: %v\n", err)
+		return 1
+	}
+	if len(lifted) == 0 {
+		return 0
+	}
+	if err := banManager.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save ban state: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Lifted bans: %s\n", strings.Join(lifted, ", "))
+	return 0
+}
+
+func runPardonRemove(path string, args []string) int {
+	fs := newCommandFlags("pardon remove", "<ip|cidr>")
+	targets, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(targets) != 1 {
+		fs.Usage()
+		return 2
+	}
+	target, err := ban.ParseTarget(targets[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pardon remove: %v\n", err)
+		return 2
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	err = ban.UpdatePardons(cfg.App.GetStateFile(), func(pardons []*ban.Pardon) ([]*ban.Pardon, error) {
+		kept := pardons[:0]
+		for _, p := range pardons {
+			if p.Target != target {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == len(pardons) {
+			return nil, fmt.Errorf("%s has no pardon", target)
+		}
+		return kept, nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pardon remove: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Removed the pardon for %s\n", target)
+	return 0
+}
+
+func runPardonList(path string, args []string) int {
+	fs := newCommandFlags("pardon list", "[-json]")
+	asJSON := fs.Bool("json", false, "Print pardons as JSON lines")
+	if rest, err := parseInterspersed(fs, args); err != nil || len(rest) > 0 {
+		if err == nil {
+			fs.Usage()
+		}
+		return 2
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	pardons, err := ban.LoadPardons(cfg.App.GetStateFile())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pardon list: %v\n", err)
+		return 1
+	}
+
+	now := time.Now()
+	var active []*ban.Pardon
+	for _, p := range pardons {
+		if p.Active(now) {
+			active = append(active, p)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for _, p := range active {
+			enc.Encode(p)
+		}
+		return 0
+	}
+	if len(active) == 0 {
+		fmt.Println("No pardons in force")
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tEXPIRES\tBY\tNOTE")
+	for _, p := range active {
+		fmt.Fprintf(tw, "%s\tin %s\t%s\t%s\n", p.Target,
+			units.FormatDuration(p.ExpiresAt.Sub(now).Round(time.Minute)), orDash(p.By), p.Note)
+	}
+	tw.Flush()
+	return 0
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/philogag/peer-banner/internal/ban"
+	"github.com/philogag/peer-banner/internal/config"
+)
+
+// runSafety shows and acknowledges tripped safety limits. It returns the
+// process exit code.
+func runSafety(path string, args []string) int {
+	if len(args) == 0 {
+		safetyUsage(os.Stderr)
+		return 2
+	}
+
+	switch args[0] {
+	case "status":
+		return runSafetyStatus(path, args[1:])
+	case "ack":
+		return runSafetyAck(path, args[1:])
+	case "freeze":
+		return runSafetyFreeze(path, args[1:])
+	case "-h", "-help", "--help", "help":
+		safetyUsage(os.Stdout)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "safety: unknown command %q\n", args[0])
+	safetyUsage(os.Stderr)
+	return 2
+}
+
+// safetyUsage lists the safety subcommands
+func safetyUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [flags] safety <command> [arguments]\n\n", os.Args[0])
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  status          Show whether enforcement is frozen and which rules are tripped (-json)")
+	fmt.Fprintln(w, "  ack [rule...]   Unfreeze enforcement, or re-arm the named tripped rules (-all for both)")
+	fmt.Fprintln(w, "  freeze          Stop all new bans until acknowledged (-reason)")
+	fmt.Fprintln(w, "\nRun a command with -h for its flags.")
+}
+
+// loadSafetyConfig reads the configuration and returns its state file
+func loadSafetyConfig(path string) (string, bool) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return "", false
+	}
+	return cfg.App.GetStateFile(), true
+}
+
+func runSafetyStatus(path string, args []string) int {
+	fs := newCommandFlags("safety status", "[-json]")
+	asJSON := fs.Bool("json", false, "Print the safety state as JSON")
+	if rest, err := parseInterspersed(fs, args); err != nil || len(rest) > 0 {
+		if err == nil {
+			fs.Usage()
+		}
+		return 2
+	}
+
+	stateFile, ok := loadSafetyConfig(path)
+	if !ok {
+		return 1
+	}
+	s, err := ban.LoadSafety(stateFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "safety status: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		enc.Encode(s)
+		return 0
+	}
+	if s.Frozen == nil {
+		fmt.Println("Enforcement: active")
+	} else {
+		fmt.Printf("Enforcement: FROZEN since %s\n  %s\n", s.Frozen.Time.Format(time.RFC3339), describeTrip(s.Frozen))
+	}
+	if len(s.Tripped) == 0 {
+		fmt.Println("Tripped rules: none")
+		return 0
+	}
+	fmt.Println("Tripped rules (in shadow mode):")
+	for _, rule := range s.TrippedRules() {
+		t := s.Tripped[rule]
+		fmt.Printf("  %s since %s\n    %s\n", rule, t.Time.Format(time.RFC3339), describeTrip(t))
+	}
+	return 0
+}
+
+// describeTrip says why a limit tripped
+func describeTrip(t *ban.Trip) string {
+	if t.By != "" {
+		return t.Reason + " (by " + t.By + ")"
+	}
+	return t.Reason
+}
+
+func runSafetyAck(path string, args []string) int {
+	fs := newCommandFlags("safety ack", "[rule...] [-all]")
+	all := fs.Bool("all", false, "Unfreeze enforcement and re-arm every tripped rule")
+	names, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if *all && len(names) > 0 {
+		fmt.Fprintln(os.Stderr, "safety ack: -all takes no rule names")
+		return 2
+	}
+
+	stateFile, ok := loadSafetyConfig(path)
+	if !ok {
+		return 1
+	}
+
+	var done []string
+	err = ban.UpdateSafety(stateFile, func(s *ban.Safety) error {
+		if *all || len(names) == 0 {
+			if s.Frozen == nil && !*all {
+				return errors.New("enforcement is not frozen")
+			}
+			if s.Frozen != nil {
+				s.Frozen = nil
+				done = append(done, "unfroze enforcement")
+			}
+		}
+		if *all {
+			names = s.TrippedRules()
+		}
+		for _, rule := range names {
+			if s.Tripped[rule] == nil {
+				return fmt.Errorf("rule %s is not tripped", rule)
+			}
+			delete(s.Tripped, rule)
+			done = append(done, "re-armed rule "+rule)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "safety ack: %v\n", err)
+		return 1
+	}
+	if len(done) == 0 {
+		fmt.Println("Nothing to acknowledge")
+		return 0
+	}
+	fmt.Printf("Acknowledged: %s\n", strings.Join(done, ", "))
+	fmt.Println("The daemon enforces bans again from its next detection cycle")
+	return 0
+}
+
+func runSafetyFreeze(path string, args []string) int {
+	fs := newCommandFlags("safety freeze", "[-reason TEXT]")
+	reason := fs.String("reason", "frozen by hand", "Why enforcement is frozen")
+	by := fs.String("by", currentUser(), "Who is freezing enforcement")
+	if rest, err := parseInterspersed(fs, args); err != nil || len(rest) > 0 {
+		if err == nil {
+			fs.Usage()
+		}
+		return 2
+	}
+
+	stateFile, ok := loadSafetyConfig(path)
+	if !ok {
+		return 1
+	}
+	err := ban.UpdateSafety(stateFile, func(s *ban.Safety) error {
+		if s.Frozen != nil {
+			return fmt.Errorf("enforcement is already frozen since %s", s.Frozen.Time.Format(time.RFC3339))
+		}
+		s.Frozen = &ban.Trip{Time: time.Now(), Reason: *reason, By: *by}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "safety freeze: %v\n", err)
+		return 1
+	}
+	fmt.Println("Enforcement frozen: no new bans until `safety ack`")
+	return 0
+}
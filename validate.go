@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/philogag/peer-banner/internal/config"
+	"github.com/philogag/peer-banner/internal/rules"
+)
+
+// runValidate checks the configuration, rules and rule examples without
+// contacting any server. It returns the process exit code.
+func runValidate(path string) int {
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	parsed, err := rules.ParseRules(cfg.Rules)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid rule configuration: %v\n", err)
+		return 1
+	}
+
+	// Examples of disabled rules are checked too
+	examples := 0
+	for _, r := range cfg.Rules {
+		examples += len(r.Examples)
+	}
+	fmt.Printf("Configuration OK: %d servers, %d enabled rules, %d rule examples passed\n",
+		len(cfg.Servers), len(parsed), examples)
+	return 0
+}